@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/keep94/attachments"
+	"github.com/keep94/consume"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -28,3 +29,341 @@ func EntryById(t *testing.T, store attachments.Store) {
 	assert.Equal(
 		t, attachments.ErrNoSuchId, store.EntryById(nil, 2, 2, &fetchedEntry))
 }
+
+func TombstoneEntry(t *testing.T, store attachments.DeleteStore) {
+	first := newEntry(2, "first", "123456789A")
+	second := newEntry(2, "second", "123456789A")
+	third := newEntry(2, "third", "123456789B")
+	other := newEntry(3, "other", "123456789A")
+	addEntries(t, store, &first, &second, &third, &other)
+	assertCount(t, store, 2, "123456789A", 2)
+	assertCount(t, store, 3, "123456789A", 1)
+	assertCount(t, store, 2, "123456789C", 0)
+
+	require.NoError(t, store.TombstoneEntry(nil, first.Id, 2))
+	require.NoError(t, store.TombstoneEntry(nil, third.Id, 2))
+	assert.Equal(
+		t, attachments.ErrNoSuchId, store.TombstoneEntry(nil, first.Id, 2))
+	assert.Equal(
+		t, attachments.ErrNoSuchId, store.TombstoneEntry(nil, other.Id, 2))
+	assert.Equal(
+		t, attachments.ErrNoSuchId, store.TombstoneEntry(nil, 999, 2))
+
+	var fetchedEntry attachments.Entry
+	assert.Equal(
+		t,
+		attachments.ErrNoSuchId,
+		store.EntryById(nil, first.Id, 2, &fetchedEntry))
+	require.NoError(t, store.EntryById(nil, second.Id, 2, &fetchedEntry))
+	assert.Equal(t, second, fetchedEntry)
+	assertCount(t, store, 2, "123456789A", 1)
+	assertCount(t, store, 2, "123456789B", 0)
+	assertCount(t, store, 3, "123456789A", 1)
+
+	var tombstoned []attachments.Entry
+	require.NoError(
+		t, store.TombstonedEntries(nil, 2, consume.AppendTo(&tombstoned)))
+	assert.Equal(t, []attachments.Entry{first, third}, tombstoned)
+	tombstoned = nil
+	require.NoError(
+		t, store.TombstonedEntries(nil, 3, consume.AppendTo(&tombstoned)))
+	assert.Empty(t, tombstoned)
+}
+
+func EntriesByOwner(t *testing.T, store attachments.OwnerStore) {
+	first := newEntry(2, "first", "123456789A")
+	second := newEntry(3, "second", "123456789A")
+	third := newEntry(2, "third", "123456789B")
+	fourth := newEntry(2, "fourth", "123456789C")
+	addEntries(t, store, &first, &second, &third, &fourth)
+	tombstone(t, store, third.Id, 2)
+
+	var entries []attachments.Entry
+	require.NoError(
+		t, store.EntriesByOwner(nil, 2, consume.AppendTo(&entries)))
+	assert.Equal(t, []attachments.Entry{first, fourth}, entries)
+	entries = nil
+	require.NoError(
+		t, store.EntriesByOwner(nil, 3, consume.AppendTo(&entries)))
+	assert.Equal(t, []attachments.Entry{second}, entries)
+	entries = nil
+	require.NoError(
+		t, store.EntriesByOwner(nil, 4, consume.AppendTo(&entries)))
+	assert.Empty(t, entries)
+
+	// Consumers can stop early
+	entries = nil
+	require.NoError(
+		t,
+		store.EntriesByOwner(
+			nil, 2, consume.Slice(consume.AppendTo(&entries), 0, 1)))
+	assert.Equal(t, []attachments.Entry{first}, entries)
+}
+
+func ListEntries(t *testing.T, store attachments.Store) {
+	first := newEntryWith(2, "banana", 30, 1604000003)
+	second := newEntryWith(2, "apple", 10, 1604000002)
+	third := newEntryWith(2, "cherry", 20, 1604000002)
+	fourth := newEntryWith(2, "apple", 20, 1604000001)
+	deleted := newEntryWith(2, "aardvark", 5, 1604000000)
+	other := newEntryWith(3, "other", 1, 1604000000)
+	addEntries(t, store, &first, &second, &third, &fourth, &deleted, &other)
+	tombstone(t, store, deleted.Id, 2)
+
+	assertListEntries(
+		t, store, attachments.Order{}, nil, first, second, third, fourth)
+	assertListEntries(
+		t,
+		store,
+		attachments.Order{Descending: true},
+		nil,
+		fourth, third, second, first)
+	assertListEntries(
+		t,
+		store,
+		attachments.Order{SortBy: attachments.SortByName},
+		nil,
+		second, fourth, first, third)
+	assertListEntries(
+		t,
+		store,
+		attachments.Order{SortBy: attachments.SortByName, Descending: true},
+		nil,
+		third, first, fourth, second)
+	assertListEntries(
+		t,
+		store,
+		attachments.Order{SortBy: attachments.SortBySize},
+		nil,
+		second, third, fourth, first)
+	assertListEntries(
+		t,
+		store,
+		attachments.Order{SortBy: attachments.SortByTs},
+		nil,
+		fourth, second, third, first)
+	assertListEntries(
+		t,
+		store,
+		attachments.Order{SortBy: attachments.SortByTs, Descending: true},
+		nil,
+		first, third, second, fourth)
+
+	// Fetch only what comes after a given entry
+	assertListEntries(
+		t, store, attachments.Order{}, &second, third, fourth)
+	assertListEntries(
+		t,
+		store,
+		attachments.Order{Descending: true},
+		&third,
+		second, first)
+	assertListEntries(
+		t,
+		store,
+		attachments.Order{SortBy: attachments.SortByName},
+		&second,
+		fourth, first, third)
+	assertListEntries(
+		t,
+		store,
+		attachments.Order{SortBy: attachments.SortBySize},
+		&third,
+		fourth, first)
+	assertListEntries(
+		t,
+		store,
+		attachments.Order{SortBy: attachments.SortByTs, Descending: true},
+		&third,
+		second, fourth)
+
+	// The entry to start after need not exist
+	assertListEntries(
+		t,
+		store,
+		attachments.Order{SortBy: attachments.SortByName},
+		&attachments.Entry{Name: "b"},
+		first, third)
+	assertListEntries(t, store, attachments.Order{}, &fourth)
+
+	// Consumers can stop early
+	var entries []attachments.Entry
+	require.NoError(
+		t,
+		store.ListEntries(
+			nil,
+			2,
+			attachments.Order{SortBy: attachments.SortByName},
+			nil,
+			consume.Slice(consume.AppendTo(&entries), 0, 2)))
+	assert.Equal(t, []attachments.Entry{second, fourth}, entries)
+
+	entries = nil
+	require.NoError(
+		t,
+		store.ListEntries(
+			nil, 4, attachments.Order{}, nil, consume.AppendTo(&entries)))
+	assert.Empty(t, entries)
+
+	assert.Equal(
+		t,
+		attachments.ErrInvalidOrder,
+		store.ListEntries(
+			nil,
+			2,
+			attachments.Order{SortBy: -1},
+			nil,
+			consume.AppendTo(&entries)))
+}
+
+func EntriesByIds(t *testing.T, store attachments.BatchStore) {
+	first := newEntry(2, "first", "123456789A")
+	second := newEntry(2, "second", "123456789A")
+	third := newEntry(2, "third", "123456789B")
+	other := newEntry(3, "other", "123456789A")
+	deleted := newEntry(2, "deleted", "123456789C")
+	addEntries(t, store, &first, &second, &third, &other, &deleted)
+	tombstone(t, store, deleted.Id, 2)
+
+	var entries []attachments.Entry
+	require.NoError(
+		t,
+		store.EntriesByIds(
+			nil,
+			[]int64{third.Id, 999, other.Id, first.Id, deleted.Id, third.Id},
+			2,
+			consume.AppendTo(&entries)))
+	assert.Equal(t, []attachments.Entry{first, third}, entries)
+
+	entries = nil
+	require.NoError(
+		t, store.EntriesByIds(nil, nil, 2, consume.AppendTo(&entries)))
+	assert.Empty(t, entries)
+
+	// Consumers can stop early
+	entries = nil
+	require.NoError(
+		t,
+		store.EntriesByIds(
+			nil,
+			[]int64{third.Id, second.Id, first.Id},
+			2,
+			consume.Slice(consume.AppendTo(&entries), 0, 2)))
+	assert.Equal(t, []attachments.Entry{first, second}, entries)
+
+	// Lots of ids
+	var ids []int64
+	for i := 0; i < 1200; i++ {
+		entry := newEntry(4, "many", "123456789A")
+		addEntries(t, store, &entry)
+		ids = append(ids, entry.Id)
+	}
+	ids = append(ids, first.Id)
+	entries = nil
+	require.NoError(
+		t, store.EntriesByIds(nil, ids, 4, consume.AppendTo(&entries)))
+	require.Len(t, entries, 1200)
+	for i := range entries {
+		assert.Equal(t, ids[i], entries[i].Id)
+	}
+}
+
+func DeleteEntry(t *testing.T, store attachments.DeleteStore) {
+	first := newEntry(2, "first", "123456789A")
+	second := newEntry(2, "second", "123456789A")
+	addEntries(t, store, &first, &second)
+	require.NoError(t, store.TombstoneEntry(nil, first.Id, 2))
+
+	assert.Equal(
+		t, attachments.ErrNoSuchId, store.DeleteEntry(nil, first.Id, 3))
+	require.NoError(t, store.DeleteEntry(nil, first.Id, 2))
+	require.NoError(t, store.DeleteEntry(nil, second.Id, 2))
+	assert.Equal(
+		t, attachments.ErrNoSuchId, store.DeleteEntry(nil, first.Id, 2))
+	assert.Equal(
+		t, attachments.ErrNoSuchId, store.DeleteEntry(nil, second.Id, 2))
+
+	var fetchedEntry attachments.Entry
+	assert.Equal(
+		t,
+		attachments.ErrNoSuchId,
+		store.EntryById(nil, second.Id, 2, &fetchedEntry))
+	assert.Equal(
+		t,
+		attachments.ErrNoSuchId,
+		store.TombstoneEntry(nil, second.Id, 2))
+	var tombstoned []attachments.Entry
+	require.NoError(
+		t, store.TombstonedEntries(nil, 2, consume.AppendTo(&tombstoned)))
+	assert.Empty(t, tombstoned)
+	assertCount(t, store, 2, "123456789A", 0)
+
+	// Ids of deleted entries are not reused
+	third := newEntry(2, "third", "123456789A")
+	addEntries(t, store, &third)
+	assert.True(t, third.Id > second.Id)
+}
+
+func newEntry(ownerId int64, name, checksum string) attachments.Entry {
+	return attachments.Entry{
+		Name:     name,
+		Size:     123,
+		Ts:       1604123456,
+		OwnerId:  ownerId,
+		Checksum: checksum,
+	}
+}
+
+func newEntryWith(
+	ownerId int64, name string, size, ts int64) attachments.Entry {
+	return attachments.Entry{
+		Name:     name,
+		Size:     size,
+		Ts:       ts,
+		OwnerId:  ownerId,
+		Checksum: "123456789A",
+	}
+}
+
+func addEntries(
+	t *testing.T, store attachments.Store, entries ...*attachments.Entry) {
+	for _, entry := range entries {
+		require.NoError(t, store.AddEntry(nil, entry))
+	}
+}
+
+func assertCount(
+	t *testing.T,
+	store attachments.DeleteStore,
+	ownerId int64,
+	checksum string,
+	expected int) {
+	count, err := store.CountEntriesByChecksum(nil, ownerId, checksum)
+	require.NoError(t, err)
+	assert.Equal(t, expected, count)
+}
+
+func assertListEntries(
+	t *testing.T,
+	store attachments.Store,
+	order attachments.Order,
+	after *attachments.Entry,
+	expected ...attachments.Entry) {
+	t.Helper()
+	var entries []attachments.Entry
+	require.NoError(
+		t, store.ListEntries(nil, 2, order, after, consume.AppendTo(&entries)))
+	if len(expected) == 0 {
+		assert.Empty(t, entries)
+	} else {
+		assert.Equal(t, expected, entries)
+	}
+}
+
+// tombstone marks the entry with given id and ownerId in store as deleted.
+// store must be an attachments.DeleteStore.
+func tombstone(t *testing.T, store attachments.Store, id, ownerId int64) {
+	deleteStore, ok := store.(attachments.DeleteStore)
+	require.True(t, ok, "store must be a DeleteStore")
+	require.NoError(t, deleteStore.TombstoneEntry(nil, id, ownerId))
+}
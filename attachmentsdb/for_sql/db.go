@@ -0,0 +1,248 @@
+// Package for_sql provides a database/sql implementation of the
+// attachments database.
+package for_sql
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/keep94/attachments"
+	"github.com/keep94/attachments/attachmentsdb/internal/sqlquery"
+	"github.com/keep94/attachments/internal/idlist"
+	"github.com/keep94/consume"
+	"github.com/keep94/toolbox/db"
+)
+
+const (
+	kSQLEntryById              = "select id, name, size, ts, owner, checksum from attachments where id = ? and owner = ? and deleted = 0"
+	kSQLEntriesByIds           = "select id, name, size, ts, owner, checksum from attachments where owner = ? and deleted = 0 and id in (%s) order by id"
+	kSQLAddEntry               = "insert into attachments (name, size, ts, owner, checksum) values (?, ?, ?, ?, ?)"
+	kSQLTombstoneEntry         = "update attachments set deleted = 1 where id = ? and owner = ? and deleted = 0"
+	kSQLEntriesByOwner         = "select id, name, size, ts, owner, checksum from attachments where owner = ? and deleted = 0 order by id"
+	kSQLTombstonedEntries      = "select id, name, size, ts, owner, checksum from attachments where owner = ? and deleted = 1 order by id"
+	kSQLDeleteEntry            = "delete from attachments where id = ? and owner = ?"
+	kSQLCountEntriesByChecksum = "select count(*) from attachments where owner = ? and checksum = ? and deleted = 0"
+)
+
+const (
+	// The most ids EntriesByIds puts in one query.
+	kMaxIdsPerQuery = 500
+)
+
+// Querier is what *sql.DB and *sql.Tx have in common.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Store is a database/sql implementation of attachments.Store. The
+// db.Transaction that Store methods accept is either nil or a *sql.Tx. If
+// it is a *sql.Tx, the method runs within that transaction.
+type Store struct {
+	db      Querier
+	dialect *Dialect
+}
+
+// New creates a new Store instance. db is usually a *sql.DB, but may be a
+// *sql.Tx. dialect is the dialect of SQL that db speaks.
+func New(db Querier, dialect *Dialect) Store {
+	return Store{db: db, dialect: dialect}
+}
+
+func (s Store) AddEntry(
+	t db.Transaction, entry *attachments.Entry) error {
+	q, err := s.querier(t)
+	if err != nil {
+		return err
+	}
+	params := []interface{}{
+		entry.Name, entry.Size, entry.Ts, entry.OwnerId, entry.Checksum}
+	if s.dialect.returning {
+		return q.QueryRow(
+			s.dialect.rebind(kSQLAddEntry+" returning id"),
+			params...).Scan(&entry.Id)
+	}
+	result, err := q.Exec(s.dialect.rebind(kSQLAddEntry), params...)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	entry.Id = id
+	return nil
+}
+
+func (s Store) EntryById(
+	t db.Transaction, id, ownerId int64, entry *attachments.Entry) error {
+	q, err := s.querier(t)
+	if err != nil {
+		return err
+	}
+	row := q.QueryRow(s.dialect.rebind(kSQLEntryById), id, ownerId)
+	var result attachments.Entry
+	err = row.Scan(ptrs(&result)...)
+	if err == sql.ErrNoRows {
+		return attachments.ErrNoSuchId
+	}
+	if err != nil {
+		return err
+	}
+	*entry = result
+	return nil
+}
+
+// EntriesByIds fetches the records with given ids in one query per
+// kMaxIdsPerQuery ids.
+func (s Store) EntriesByIds(
+	t db.Transaction,
+	ids []int64,
+	ownerId int64,
+	consumer consume.Consumer) error {
+	ids = idlist.Sorted(ids)
+	for len(ids) > 0 && consumer.CanConsume() {
+		chunk := ids
+		if len(chunk) > kMaxIdsPerQuery {
+			chunk = chunk[:kMaxIdsPerQuery]
+		}
+		ids = ids[len(chunk):]
+		params := make([]interface{}, 0, len(chunk)+1)
+		params = append(params, ownerId)
+		for _, id := range chunk {
+			params = append(params, id)
+		}
+		query := fmt.Sprintf(
+			kSQLEntriesByIds,
+			strings.TrimSuffix(strings.Repeat("?, ", len(chunk)), ", "))
+		if err := s.readMultiple(t, consumer, query, params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s Store) TombstoneEntry(t db.Transaction, id, ownerId int64) error {
+	return s.execOne(t, kSQLTombstoneEntry, id, ownerId)
+}
+
+func (s Store) EntriesByOwner(
+	t db.Transaction, ownerId int64, consumer consume.Consumer) error {
+	return s.readMultiple(t, consumer, kSQLEntriesByOwner, ownerId)
+}
+
+func (s Store) ListEntries(
+	t db.Transaction,
+	ownerId int64,
+	order attachments.Order,
+	after *attachments.Entry,
+	consumer consume.Consumer) error {
+	query, params, err := sqlquery.ListEntries(
+		s.dialect.nameColumn, ownerId, order, after)
+	if err != nil {
+		return err
+	}
+	return s.readMultiple(t, consumer, query, params...)
+}
+
+func (s Store) TombstonedEntries(
+	t db.Transaction, ownerId int64, consumer consume.Consumer) error {
+	return s.readMultiple(t, consumer, kSQLTombstonedEntries, ownerId)
+}
+
+func (s Store) DeleteEntry(t db.Transaction, id, ownerId int64) error {
+	return s.execOne(t, kSQLDeleteEntry, id, ownerId)
+}
+
+func (s Store) CountEntriesByChecksum(
+	t db.Transaction, ownerId int64, checksum string) (int, error) {
+	q, err := s.querier(t)
+	if err != nil {
+		return 0, err
+	}
+	var result int
+	err = q.QueryRow(
+		s.dialect.rebind(kSQLCountEntriesByChecksum),
+		ownerId,
+		checksum).Scan(&result)
+	return result, err
+}
+
+// querier returns t as a Querier if it is non-nil; otherwise it returns
+// the Querier this Store was created with. querier returns an error if t
+// is neither nil nor a *sql.Tx.
+func (s Store) querier(t db.Transaction) (Querier, error) {
+	if t == nil {
+		return s.db, nil
+	}
+	tx, ok := t.(*sql.Tx)
+	if !ok {
+		return nil, fmt.Errorf(
+			"for_sql: Transaction is a %T, not a *sql.Tx", t)
+	}
+	return tx, nil
+}
+
+// execOne executes query which is supposed to change exactly one row.
+// If query changes no rows, execOne returns attachments.ErrNoSuchId.
+func (s Store) execOne(
+	t db.Transaction, query string, params ...interface{}) error {
+	q, err := s.querier(t)
+	if err != nil {
+		return err
+	}
+	result, err := q.Exec(s.dialect.rebind(query), params...)
+	if err != nil {
+		return err
+	}
+	changes, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if changes == 0 {
+		return attachments.ErrNoSuchId
+	}
+	return nil
+}
+
+// readMultiple executes query and passes the resulting entries to
+// consumer.
+func (s Store) readMultiple(
+	t db.Transaction,
+	consumer consume.Consumer,
+	query string,
+	params ...interface{}) error {
+	q, err := s.querier(t)
+	if err != nil {
+		return err
+	}
+	rows, err := q.Query(s.dialect.rebind(query), params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for consumer.CanConsume() && rows.Next() {
+		var entry attachments.Entry
+		if err := rows.Scan(ptrs(&entry)...); err != nil {
+			return err
+		}
+		consumer.Consume(&entry)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+func ptrs(entry *attachments.Entry) []interface{} {
+	return []interface{}{
+		&entry.Id,
+		&entry.Name,
+		&entry.Size,
+		&entry.Ts,
+		&entry.OwnerId,
+		&entry.Checksum,
+	}
+}
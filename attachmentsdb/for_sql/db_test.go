@@ -0,0 +1,107 @@
+package for_sql_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/keep94/attachments"
+	"github.com/keep94/attachments/attachmentsdb/fixture"
+	"github.com/keep94/attachments/attachmentsdb/for_sql"
+	"github.com/keep94/consume"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryById(t *testing.T) {
+	fixture.EntryById(t, newStore(t))
+}
+
+func TestTombstoneEntry(t *testing.T) {
+	fixture.TombstoneEntry(t, newStore(t))
+}
+
+func TestEntriesByOwner(t *testing.T) {
+	fixture.EntriesByOwner(t, newStore(t))
+}
+
+func TestListEntries(t *testing.T) {
+	fixture.ListEntries(t, newStore(t))
+}
+
+func TestEntriesByIds(t *testing.T) {
+	fixture.EntriesByIds(t, newStore(t))
+}
+
+func TestDeleteEntry(t *testing.T) {
+	fixture.DeleteEntry(t, newStore(t))
+}
+
+func TestSetUpTablesTwice(t *testing.T) {
+	db := openDb(t)
+	require.NoError(t, for_sql.SetUpTables(db, for_sql.SQLite))
+	fixture.EntryById(t, for_sql.New(db, for_sql.SQLite))
+}
+
+func TestTransaction(t *testing.T) {
+	db := openDb(t)
+	store := for_sql.New(db, for_sql.SQLite)
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	entry := attachments.Entry{Name: "name", OwnerId: 2, Checksum: "1234"}
+	require.NoError(t, store.AddEntry(tx, &entry))
+	var fetched attachments.Entry
+	require.NoError(t, store.EntryById(tx, entry.Id, 2, &fetched))
+	assert.Equal(t, entry, fetched)
+	require.NoError(t, tx.Rollback())
+	assert.Equal(
+		t,
+		attachments.ErrNoSuchId,
+		store.EntryById(nil, entry.Id, 2, &fetched))
+
+	// A Store can also be created from a transaction
+	tx, err = db.Begin()
+	require.NoError(t, err)
+	require.NoError(
+		t, for_sql.New(tx, for_sql.SQLite).AddEntry(nil, &entry))
+	require.NoError(t, tx.Commit())
+	require.NoError(t, store.EntryById(nil, entry.Id, 2, &fetched))
+}
+
+func TestForeignTransaction(t *testing.T) {
+	store := newStore(t)
+	entry := attachments.Entry{Name: "name", OwnerId: 2, Checksum: "1234"}
+	assert.Error(t, store.AddEntry("not a transaction", &entry))
+	assert.Error(t, store.EntriesByOwner(
+		"not a transaction", 2, consume.Nil()))
+}
+
+func TestSetUpTables_Indexes(t *testing.T) {
+	rows, err := openDb(t).Query(
+		"select name from sqlite_master where type = 'index' order by name")
+	require.NoError(t, err)
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(
+		t, []string{"attachments_checksum", "attachments_owner"}, names)
+}
+
+func newStore(t *testing.T) for_sql.Store {
+	return for_sql.New(openDb(t), for_sql.SQLite)
+}
+
+func openDb(t *testing.T) *sql.DB {
+	db, err := sql.Open(
+		"sqlite3", filepath.Join(t.TempDir(), "attachments.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	require.NoError(t, for_sql.SetUpTables(db, for_sql.SQLite))
+	return db
+}
@@ -0,0 +1,109 @@
+package for_sql
+
+import (
+	"strconv"
+	"strings"
+)
+
+var (
+	// SQLite is the dialect of SQLite.
+	SQLite = &Dialect{
+		name:       "sqlite",
+		idColumn:   "id INTEGER PRIMARY KEY AUTOINCREMENT",
+		nameColumn: "name",
+	}
+
+	// MySQL is the dialect of MySQL and MariaDB.
+	MySQL = &Dialect{
+		name:          "mysql",
+		idColumn:      "id BIGINT PRIMARY KEY AUTO_INCREMENT",
+		nameColumn:    "binary name",
+		inlineIndexes: true,
+	}
+
+	// Postgres is the dialect of PostgreSQL.
+	Postgres = &Dialect{
+		name:       "postgres",
+		numbered:   true,
+		returning:  true,
+		idColumn:   "id BIGSERIAL PRIMARY KEY",
+		nameColumn: `name collate "C"`,
+	}
+)
+
+// Dialect is a dialect of SQL. Dialects differ in how they write
+// placeholders, how they report the id of an inserted row, how they
+// declare an auto incrementing id, how they compare names byte by byte,
+// and how they create indexes.
+type Dialect struct {
+	name string
+
+	// If true, placeholders are $1, $2, ... instead of ?
+	numbered bool
+
+	// If true, inserts report the new id with "returning id" because
+	// sql.Result.LastInsertId isn't supported.
+	returning bool
+
+	// The declaration of the id column
+	idColumn string
+
+	// The name column with a collation that compares byte by byte
+	nameColumn string
+
+	// If true, indexes are declared in the create table statement
+	// because there is no "create index if not exists." TEXT columns
+	// need a prefix length in these indexes.
+	inlineIndexes bool
+}
+
+func (d *Dialect) String() string {
+	return d.name
+}
+
+// rebind rewrites the ? placeholders in query for this dialect. query
+// must not contain ? anywhere but in placeholders.
+func (d *Dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var sb strings.Builder
+	n := 0
+	for {
+		index := strings.IndexByte(query, '?')
+		if index == -1 {
+			sb.WriteString(query)
+			return sb.String()
+		}
+		n++
+		sb.WriteString(query[:index])
+		sb.WriteString("$")
+		sb.WriteString(strconv.Itoa(n))
+		query = query[index+1:]
+	}
+}
+
+// SetUpTables creates all needed tables for attachments in db. db is
+// usually a *sql.DB, but may be a *sql.Tx. dialect is the dialect of SQL
+// that db speaks. Calling SetUpTables on a database that is already set
+// up is harmless. For MySQL, SetUpTables creates indexes only when it
+// creates the table.
+func SetUpTables(db Querier, dialect *Dialect) error {
+	indexes := ""
+	if dialect.inlineIndexes {
+		indexes = ", index attachments_owner (owner, deleted, id), index attachments_checksum (owner, checksum(64))"
+	}
+	_, err := db.Exec("create table if not exists attachments (" +
+		dialect.idColumn +
+		", name TEXT, size BIGINT, ts BIGINT, owner BIGINT, checksum TEXT, deleted INTEGER NOT NULL DEFAULT 0" +
+		indexes + ")")
+	if err != nil || dialect.inlineIndexes {
+		return err
+	}
+	_, err = db.Exec("create index if not exists attachments_owner on attachments (owner, deleted, id)")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("create index if not exists attachments_checksum on attachments (owner, checksum)")
+	return err
+}
@@ -0,0 +1,18 @@
+package for_sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebind(t *testing.T) {
+	query := "select * from attachments where id = ? and owner = ?"
+	assert.Equal(t, query, SQLite.rebind(query))
+	assert.Equal(t, query, MySQL.rebind(query))
+	assert.Equal(
+		t,
+		"select * from attachments where id = $1 and owner = $2",
+		Postgres.rebind(query))
+	assert.Equal(t, "select 1", Postgres.rebind("select 1"))
+}
@@ -3,7 +3,13 @@
 package for_sqlite
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/keep94/attachments"
+	"github.com/keep94/attachments/attachmentsdb/internal/sqlquery"
+	"github.com/keep94/attachments/internal/idlist"
+	"github.com/keep94/consume"
 	"github.com/keep94/gosqlite/sqlite"
 	"github.com/keep94/toolbox/db"
 	"github.com/keep94/toolbox/db/sqlite_db"
@@ -11,8 +17,21 @@ import (
 )
 
 const (
-	kSQLEntryById = "select id, name, size, ts, owner, checksum from attachments where id = ? and owner = ?"
-	kSQLAddEntry  = "insert into attachments (name, size, ts, owner, checksum) values (?, ?, ?, ?, ?)"
+	kSQLEntryById              = "select id, name, size, ts, owner, checksum from attachments where id = ? and owner = ? and deleted = 0"
+	kSQLAddEntry               = "insert into attachments (name, size, ts, owner, checksum) values (?, ?, ?, ?, ?)"
+	kSQLEntriesByIds           = "select id, name, size, ts, owner, checksum from attachments where owner = ? and deleted = 0 and id in (%s) order by id"
+	kSQLTombstoneEntry         = "update attachments set deleted = 1 where id = ? and owner = ? and deleted = 0"
+	kSQLEntriesByOwner         = "select id, name, size, ts, owner, checksum from attachments where owner = ? and deleted = 0 order by id"
+	kSQLTombstonedEntries      = "select id, name, size, ts, owner, checksum from attachments where owner = ? and deleted = 1 order by id"
+	kSQLDeleteEntry            = "delete from attachments where id = ? and owner = ?"
+	kSQLCountEntriesByChecksum = "select count(*) from attachments where owner = ? and checksum = ? and deleted = 0"
+	kSQLChanges                = "select changes()"
+)
+
+const (
+	// The most ids EntriesByIds puts in one query. sqlite allows at most
+	// 999 parameters per query by default.
+	kMaxIdsPerQuery = 500
 )
 
 // Store is a sqlite implementation of attachments.Store
@@ -51,6 +70,152 @@ func (s Store) EntryById(
 	})
 }
 
+// EntriesByIds fetches the records with given ids in one query per
+// kMaxIdsPerQuery ids.
+func (s Store) EntriesByIds(
+	t db.Transaction,
+	ids []int64,
+	ownerId int64,
+	consumer consume.Consumer) error {
+	ids = idlist.Sorted(ids)
+	return sqlite_db.ToDoer(s.db, t).Do(func(conn *sqlite.Conn) error {
+		for len(ids) > 0 && consumer.CanConsume() {
+			chunk := ids
+			if len(chunk) > kMaxIdsPerQuery {
+				chunk = chunk[:kMaxIdsPerQuery]
+			}
+			ids = ids[len(chunk):]
+			params := make([]interface{}, 0, len(chunk)+1)
+			params = append(params, ownerId)
+			for _, id := range chunk {
+				params = append(params, id)
+			}
+			sql := fmt.Sprintf(
+				kSQLEntriesByIds,
+				strings.TrimSuffix(strings.Repeat("?, ", len(chunk)), ", "))
+			err := sqlite_rw.ReadMultiple(
+				conn,
+				(&rawEntry{}).init(&attachments.Entry{}),
+				consumer,
+				sql,
+				params...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s Store) TombstoneEntry(t db.Transaction, id, ownerId int64) error {
+	return sqlite_db.ToDoer(s.db, t).Do(func(conn *sqlite.Conn) error {
+		return execOne(conn, kSQLTombstoneEntry, id, ownerId)
+	})
+}
+
+func (s Store) EntriesByOwner(
+	t db.Transaction, ownerId int64, consumer consume.Consumer) error {
+	return sqlite_db.ToDoer(s.db, t).Do(func(conn *sqlite.Conn) error {
+		return sqlite_rw.ReadMultiple(
+			conn,
+			(&rawEntry{}).init(&attachments.Entry{}),
+			consumer,
+			kSQLEntriesByOwner,
+			ownerId)
+	})
+}
+
+func (s Store) ListEntries(
+	t db.Transaction,
+	ownerId int64,
+	order attachments.Order,
+	after *attachments.Entry,
+	consumer consume.Consumer) error {
+	sql, params, err := sqlquery.ListEntries(
+		"name", ownerId, order, after)
+	if err != nil {
+		return err
+	}
+	return sqlite_db.ToDoer(s.db, t).Do(func(conn *sqlite.Conn) error {
+		return sqlite_rw.ReadMultiple(
+			conn,
+			(&rawEntry{}).init(&attachments.Entry{}),
+			consumer,
+			sql,
+			params...)
+	})
+}
+
+func (s Store) TombstonedEntries(
+	t db.Transaction, ownerId int64, consumer consume.Consumer) error {
+	return sqlite_db.ToDoer(s.db, t).Do(func(conn *sqlite.Conn) error {
+		return sqlite_rw.ReadMultiple(
+			conn,
+			(&rawEntry{}).init(&attachments.Entry{}),
+			consumer,
+			kSQLTombstonedEntries,
+			ownerId)
+	})
+}
+
+func (s Store) DeleteEntry(t db.Transaction, id, ownerId int64) error {
+	return sqlite_db.ToDoer(s.db, t).Do(func(conn *sqlite.Conn) error {
+		return execOne(conn, kSQLDeleteEntry, id, ownerId)
+	})
+}
+
+func (s Store) CountEntriesByChecksum(
+	t db.Transaction, ownerId int64, checksum string) (int, error) {
+	var result int64
+	err := sqlite_db.ToDoer(s.db, t).Do(func(conn *sqlite.Conn) error {
+		var err error
+		result, err = readInt(conn, kSQLCountEntriesByChecksum, ownerId, checksum)
+		return err
+	})
+	return int(result), err
+}
+
+// execOne executes sql which is supposed to change exactly one row.
+// If sql changes no rows, execOne returns attachments.ErrNoSuchId.
+func execOne(conn *sqlite.Conn, sql string, params ...interface{}) error {
+	if err := conn.Exec(sql, params...); err != nil {
+		return err
+	}
+	changes, err := readInt(conn, kSQLChanges)
+	if err != nil {
+		return err
+	}
+	if changes == 0 {
+		return attachments.ErrNoSuchId
+	}
+	return nil
+}
+
+// readInt executes sql which returns a single integer and returns that
+// integer.
+func readInt(
+	conn *sqlite.Conn, sql string, params ...interface{}) (int64, error) {
+	stmt, err := conn.Prepare(sql)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Finalize()
+	if err := stmt.Exec(params...); err != nil {
+		return 0, err
+	}
+	if !stmt.Next() {
+		if err := stmt.Error(); err != nil {
+			return 0, err
+		}
+		return 0, sqlite_db.NoResult
+	}
+	var result int64
+	if err := stmt.Scan(&result); err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
 type rawEntry struct {
 	*attachments.Entry
 	sqlite_rw.SimpleRow
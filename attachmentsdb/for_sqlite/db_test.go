@@ -8,6 +8,7 @@ import (
 	"github.com/keep94/attachments/attachmentsdb/sqlite_setup"
 	"github.com/keep94/gosqlite/sqlite"
 	"github.com/keep94/toolbox/db/sqlite_db"
+	"github.com/stretchr/testify/require"
 )
 
 func TestEntryById(t *testing.T) {
@@ -16,6 +17,58 @@ func TestEntryById(t *testing.T) {
 	fixture.EntryById(t, for_sqlite.New(db))
 }
 
+func TestTombstoneEntry(t *testing.T) {
+	db := openDb(t)
+	defer closeDb(t, db)
+	fixture.TombstoneEntry(t, for_sqlite.New(db))
+}
+
+func TestEntriesByOwner(t *testing.T) {
+	db := openDb(t)
+	defer closeDb(t, db)
+	fixture.EntriesByOwner(t, for_sqlite.New(db))
+}
+
+func TestListEntries(t *testing.T) {
+	db := openDb(t)
+	defer closeDb(t, db)
+	fixture.ListEntries(t, for_sqlite.New(db))
+}
+
+func TestEntriesByIds(t *testing.T) {
+	db := openDb(t)
+	defer closeDb(t, db)
+	fixture.EntriesByIds(t, for_sqlite.New(db))
+}
+
+func TestDeleteEntry(t *testing.T) {
+	db := openDb(t)
+	defer closeDb(t, db)
+	fixture.DeleteEntry(t, for_sqlite.New(db))
+}
+
+func TestUpgradeOriginalSchema(t *testing.T) {
+	conn, err := sqlite.Open(":memory:")
+	require.NoError(t, err)
+	db := sqlite_db.New(conn)
+	defer closeDb(t, db)
+	err = db.Do(func(conn *sqlite.Conn) error {
+		return conn.Exec("create table attachments (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, size INTEGER, ts INTEGER, owner INTEGER, checksum TEXT)")
+	})
+	require.NoError(t, err)
+	err = db.Do(func(conn *sqlite.Conn) error {
+		return sqlite_setup.SetUpTables(conn)
+	})
+	require.NoError(t, err)
+
+	// Calling again should be harmless
+	err = db.Do(func(conn *sqlite.Conn) error {
+		return sqlite_setup.SetUpTables(conn)
+	})
+	require.NoError(t, err)
+	fixture.TombstoneEntry(t, for_sqlite.New(db))
+}
+
 func closeDb(t *testing.T, db *sqlite_db.Db) {
 	if err := db.Close(); err != nil {
 		t.Errorf("Error closing database: %v", err)
@@ -0,0 +1,71 @@
+// Package sqlquery builds the SQL queries that the attachments stores
+// share.
+package sqlquery
+
+import (
+	"fmt"
+
+	"github.com/keep94/attachments"
+)
+
+const (
+	kSQLListEntries = "select id, name, size, ts, owner, checksum from attachments where owner = ? and deleted = 0"
+)
+
+// ListEntries returns the SQL and parameters for Store.ListEntries. The
+// SQL uses ? placeholders. nameColumn is how the SQL refers to the name
+// column so that names compare byte by byte e.g "name" in SQLite.
+// ListEntries returns attachments.ErrInvalidOrder if order isn't valid.
+func ListEntries(
+	nameColumn string,
+	ownerId int64,
+	order attachments.Order,
+	after *attachments.Entry) (string, []interface{}, error) {
+	var column string
+	var value interface{}
+	switch order.SortBy {
+	case attachments.SortById:
+	case attachments.SortByName:
+		column = nameColumn
+		if after != nil {
+			value = after.Name
+		}
+	case attachments.SortBySize:
+		column = "size"
+		if after != nil {
+			value = after.Size
+		}
+	case attachments.SortByTs:
+		column = "ts"
+		if after != nil {
+			value = after.Ts
+		}
+	default:
+		return "", nil, attachments.ErrInvalidOrder
+	}
+	op, direction := ">", "asc"
+	if order.Descending {
+		op, direction = "<", "desc"
+	}
+	query := kSQLListEntries
+	params := []interface{}{ownerId}
+	if after != nil {
+		if column == "" {
+			query += fmt.Sprintf(" and id %s ?", op)
+			params = append(params, after.Id)
+		} else {
+			query += fmt.Sprintf(
+				" and (%[1]s %[2]s ? or (%[1]s = ? and id %[2]s ?))",
+				column,
+				op)
+			params = append(params, value, value, after.Id)
+		}
+	}
+	if column == "" {
+		query += fmt.Sprintf(" order by id %s", direction)
+	} else {
+		query += fmt.Sprintf(
+			" order by %[1]s %[2]s, id %[2]s", column, direction)
+	}
+	return query, params, nil
+}
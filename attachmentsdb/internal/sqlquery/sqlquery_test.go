@@ -0,0 +1,33 @@
+package sqlquery
+
+import (
+	"testing"
+
+	"github.com/keep94/attachments"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListEntries(t *testing.T) {
+	query, params, err := ListEntries(
+		"binary name",
+		3,
+		attachments.Order{SortBy: attachments.SortByName, Descending: true},
+		&attachments.Entry{Id: 5, Name: "a.txt"})
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		kSQLListEntries+" and (binary name < ? or (binary name = ? and id < ?)) order by binary name desc, id desc",
+		query)
+	assert.Equal(
+		t, []interface{}{int64(3), "a.txt", "a.txt", int64(5)}, params)
+
+	query, params, err = ListEntries("name", 3, attachments.Order{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, kSQLListEntries+" order by id asc", query)
+	assert.Equal(t, []interface{}{int64(3)}, params)
+
+	_, _, err = ListEntries(
+		"name", 3, attachments.Order{SortBy: -1}, nil)
+	assert.Equal(t, attachments.ErrInvalidOrder, err)
+}
@@ -2,10 +2,137 @@
 package sqlite_setup
 
 import (
+	"fmt"
+
 	"github.com/keep94/gosqlite/sqlite"
 )
 
-// SetUpTables creates all needed tables for attachments.
+// migrations evolve the schema one version at a time. migrations[i]
+// takes the schema from version i to version i+1. The schema version is
+// stored in the database's user_version. To change the schema, append a
+// migration; never change or remove one already released.
+var migrations = []func(conn *sqlite.Conn) error{
+	createAttachments,
+	addIndexes,
+}
+
+// LatestVersion returns the schema version that SetUpTables brings
+// databases up to.
+func LatestVersion() int {
+	return len(migrations)
+}
+
+// Version returns the schema version of the database. Version returns 0
+// for new databases and for databases set up before schema versions were
+// tracked.
+func Version(conn *sqlite.Conn) (int, error) {
+	stmt, err := conn.Prepare("pragma user_version")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Finalize()
+	if err := stmt.Exec(); err != nil {
+		return 0, err
+	}
+	var version int
+	if stmt.Next() {
+		if err := stmt.Scan(&version); err != nil {
+			return 0, err
+		}
+	}
+	return version, stmt.Error()
+}
+
+// SetUpTables creates all needed tables for attachments. SetUpTables also
+// brings tables created by earlier versions up to date by applying the
+// migrations they are missing in order. Each migration and the new schema
+// version it brings are applied together or not at all, so if
+// SetUpTables fails, calling it again picks up where it left off.
+// SetUpTables works whether or not conn is already in a transaction.
+// SetUpTables returns an error if the database has a newer schema version
+// than this package knows about.
 func SetUpTables(conn *sqlite.Conn) error {
-	return conn.Exec("create table if not exists attachments (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, size INTEGER, ts INTEGER, owner INTEGER, checksum TEXT)")
+	version, err := Version(conn)
+	if err != nil {
+		return err
+	}
+	if version > LatestVersion() {
+		return fmt.Errorf(
+			"sqlite_setup: schema version %d is newer than %d",
+			version,
+			LatestVersion())
+	}
+	for ; version < LatestVersion(); version++ {
+		if err := migrate(conn, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate applies the migration that takes the schema from version to
+// version+1 within a savepoint so that it nests in any transaction
+// already in progress.
+func migrate(conn *sqlite.Conn, version int) error {
+	if err := conn.Exec("savepoint migration"); err != nil {
+		return err
+	}
+	err := migrations[version](conn)
+	if err == nil {
+		err = conn.Exec(fmt.Sprintf("pragma user_version = %d", version+1))
+	}
+	if err != nil {
+		conn.Exec("rollback to migration")
+		conn.Exec("release migration")
+		return fmt.Errorf(
+			"sqlite_setup: migrating to version %d: %w", version+1, err)
+	}
+	return conn.Exec("release migration")
+}
+
+// createAttachments creates the attachments table. Databases set up
+// before schema versions were tracked may already have the table, with or
+// without the deleted column.
+func createAttachments(conn *sqlite.Conn) error {
+	err := conn.Exec("create table if not exists attachments (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, size INTEGER, ts INTEGER, owner INTEGER, checksum TEXT, deleted INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+		return err
+	}
+	hasDeleted, err := hasColumn(conn, "attachments", "deleted")
+	if err != nil {
+		return err
+	}
+	if !hasDeleted {
+		return conn.Exec("alter table attachments add column deleted INTEGER NOT NULL DEFAULT 0")
+	}
+	return nil
+}
+
+// addIndexes adds indexes for looking up the entries of an owner and for
+// counting the entries of an owner with a given checksum.
+func addIndexes(conn *sqlite.Conn) error {
+	err := conn.Exec("create index if not exists attachments_owner on attachments (owner, deleted, id)")
+	if err != nil {
+		return err
+	}
+	return conn.Exec("create index if not exists attachments_checksum on attachments (owner, checksum)")
+}
+
+func hasColumn(conn *sqlite.Conn, table, column string) (bool, error) {
+	stmt, err := conn.Prepare(
+		"select count(*) from pragma_table_info(?) where name = ?")
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Finalize()
+	if err := stmt.Exec(table, column); err != nil {
+		return false, err
+	}
+	var count int
+	if stmt.Next() {
+		if err := stmt.Scan(&count); err != nil {
+			return false, err
+		}
+	}
+	return count > 0, stmt.Error()
 }
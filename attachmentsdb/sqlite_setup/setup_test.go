@@ -0,0 +1,147 @@
+package sqlite_setup
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/keep94/attachments/attachmentsdb/fixture"
+	"github.com/keep94/attachments/attachmentsdb/for_sqlite"
+	"github.com/keep94/gosqlite/sqlite"
+	"github.com/keep94/toolbox/db/sqlite_db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	kOriginalSchema    = "create table attachments (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, size INTEGER, ts INTEGER, owner INTEGER, checksum TEXT)"
+	kUnversionedSchema = "create table attachments (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, size INTEGER, ts INTEGER, owner INTEGER, checksum TEXT, deleted INTEGER NOT NULL DEFAULT 0)"
+)
+
+func TestSetUpTables(t *testing.T) {
+	conn := openConn(t)
+	require.NoError(t, SetUpTables(conn))
+	assertLatest(t, conn)
+
+	// Calling again should be harmless
+	require.NoError(t, SetUpTables(conn))
+	assertLatest(t, conn)
+	fixture.EntriesByOwner(t, for_sqlite.ConnNew(conn))
+}
+
+func TestSetUpTables_OriginalSchema(t *testing.T) {
+	conn := openConn(t)
+	require.NoError(t, conn.Exec(kOriginalSchema))
+	require.NoError(
+		t,
+		conn.Exec("insert into attachments (name, size, ts, owner, checksum) values ('a.txt', 1, 2, 3, 'abcd')"))
+	require.NoError(t, SetUpTables(conn))
+	assertLatest(t, conn)
+	assert.Equal(
+		t,
+		int64(1),
+		readInt(t, conn, "select count(*) from attachments where owner = 3 and deleted = 0"))
+	fixture.TombstoneEntry(t, for_sqlite.ConnNew(conn))
+}
+
+func TestSetUpTables_Unversioned(t *testing.T) {
+	conn := openConn(t)
+	require.NoError(t, conn.Exec(kUnversionedSchema))
+	require.NoError(
+		t,
+		conn.Exec("insert into attachments (name, size, ts, owner, checksum, deleted) values ('a.txt', 1, 2, 3, 'abcd', 1)"))
+	require.NoError(t, SetUpTables(conn))
+	assertLatest(t, conn)
+	assert.Equal(
+		t,
+		int64(1),
+		readInt(t, conn, "select count(*) from attachments where deleted = 1"))
+}
+
+func TestSetUpTables_InTransaction(t *testing.T) {
+	conn, err := sqlite.Open(":memory:")
+	require.NoError(t, err)
+	db := sqlite_db.New(conn)
+	defer db.Close()
+	err = db.Do(func(conn *sqlite.Conn) error {
+		if err := conn.Exec(kOriginalSchema); err != nil {
+			return err
+		}
+		return SetUpTables(conn)
+	})
+	require.NoError(t, err)
+	err = db.Do(func(conn *sqlite.Conn) error {
+		assertLatest(t, conn)
+		return nil
+	})
+	require.NoError(t, err)
+	fixture.DeleteEntry(t, for_sqlite.New(db))
+}
+
+func TestSetUpTables_NewerVersion(t *testing.T) {
+	conn := openConn(t)
+	require.NoError(t, SetUpTables(conn))
+	require.NoError(t, conn.Exec("pragma user_version = 1000"))
+	assert.Error(t, SetUpTables(conn))
+}
+
+func TestSetUpTables_FailedMigration(t *testing.T) {
+	conn := openConn(t)
+	require.NoError(t, SetUpTables(conn))
+	errMigration := errors.New("migration failed")
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = append(migrations[:len(migrations):len(migrations)],
+		func(conn *sqlite.Conn) error {
+			if err := conn.Exec("create table partial (id INTEGER)"); err != nil {
+				return err
+			}
+			return errMigration
+		})
+	err := SetUpTables(conn)
+	assert.True(t, errors.Is(err, errMigration))
+
+	// The failed migration left nothing behind
+	version, err := Version(conn)
+	require.NoError(t, err)
+	assert.Equal(t, LatestVersion()-1, version)
+	assert.Equal(
+		t,
+		int64(0),
+		readInt(t, conn, "select count(*) from sqlite_master where name = 'partial'"))
+
+	migrations[len(migrations)-1] = func(conn *sqlite.Conn) error {
+		return conn.Exec("create table partial (id INTEGER)")
+	}
+	require.NoError(t, SetUpTables(conn))
+	assertLatest(t, conn)
+}
+
+func assertLatest(t *testing.T, conn *sqlite.Conn) {
+	t.Helper()
+	version, err := Version(conn)
+	require.NoError(t, err)
+	assert.Equal(t, LatestVersion(), version)
+	assert.Equal(
+		t,
+		int64(2),
+		readInt(t, conn, "select count(*) from sqlite_master where type = 'index' and name in ('attachments_owner', 'attachments_checksum')"))
+}
+
+func openConn(t *testing.T) *sqlite.Conn {
+	conn, err := sqlite.Open(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readInt(t *testing.T, conn *sqlite.Conn, sql string) int64 {
+	t.Helper()
+	stmt, err := conn.Prepare(sql)
+	require.NoError(t, err)
+	defer stmt.Finalize()
+	require.NoError(t, stmt.Exec())
+	require.True(t, stmt.Next())
+	var result int64
+	require.NoError(t, stmt.Scan(&result))
+	return result
+}
@@ -0,0 +1,192 @@
+// Package attachmentshttp serves and accepts attachments over HTTP.
+package attachmentshttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/keep94/attachments"
+)
+
+const (
+	// Files belong to an owner, so shared caches must not keep them.
+	// Browsers may keep them but must revalidate with the ETag first since
+	// files can be deleted.
+	kCacheControl = "private, no-cache"
+)
+
+// ServeOptions contains options for NewServeHandler.
+type ServeOptions struct {
+
+	// If true, browsers are asked to display files rather than download
+	// them. Files that could run script in the browser such as HTML and
+	// SVG are always downloaded.
+	Inline bool
+}
+
+func (o *ServeOptions) dispositionType() string {
+	if o != nil && o.Inline {
+		return "inline"
+	}
+	return "attachment"
+}
+
+// NewServeHandler returns a handler that serves the files in fileSystem.
+// The handler expects request paths of the form /EntryId/EntryName, which
+// is Entry.Path() with a leading slash. Use http.StripPrefix to serve
+// files under some other path. The handler answers GET and HEAD requests
+// including byte range requests. It uses the checksum of each file as a
+// strong ETag so that it can answer conditional requests with 304 Not
+// Modified. The handler serves the file name in the Content-Disposition
+// header using RFC 5987 encoding for names that aren't plain ASCII. nil
+// options means the defaults.
+func NewServeHandler(
+	fileSystem attachments.ImmutableFS, options *ServeOptions) http.Handler {
+	return &serveHandler{
+		fileSystem:      fileSystem,
+		dispositionType: options.dispositionType(),
+	}
+}
+
+type serveHandler struct {
+	fileSystem      attachments.ImmutableFS
+	dispositionType string
+}
+
+func (h *serveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	file, err := h.fileSystem.Open(name)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	// Only files, not directories, have an Entry.
+	entry, ok := fileInfo.Sys().(*attachments.Entry)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// Files from ImmutableFS implement io.Seeker
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		httpError(w, r, errors.New("attachmentshttp: File can't seek"))
+		return
+	}
+	header := w.Header()
+	mimeType := contentType(entry.Name)
+	dispositionType := h.dispositionType
+	if active(mimeType) {
+		dispositionType = "attachment"
+		header.Set("Content-Security-Policy", "sandbox")
+	}
+	header.Set("ETag", fmt.Sprintf("%q", entry.Checksum))
+	header.Set("Cache-Control", kCacheControl)
+	header.Set("Content-Type", mimeType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set(
+		"Content-Disposition",
+		contentDisposition(dispositionType, entry.Name))
+	http.ServeContent(w, r, entry.Name, time.Unix(entry.Ts, 0), content)
+}
+
+// httpError responds to r with the status that best fits err.
+func httpError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.NotFound(w, r)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		http.Error(
+			w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// contentType returns the content type for a file called name. Since
+// the handler forbids browsers from sniffing, contentType falls back to
+// application/octet-stream which browsers won't display.
+func contentType(name string) string {
+	if result := mime.TypeByExtension(path.Ext(name)); result != "" {
+		return result
+	}
+	return "application/octet-stream"
+}
+
+// active returns true if browsers may run script in content of given type
+// when displaying it. Uploaded files of these types would run with the
+// origin of the application.
+func active(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	switch mediaType {
+	case "text/html", "text/xml", "application/xml", "text/xsl":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+xml")
+}
+
+// contentDisposition returns the Content-Disposition header value for a
+// file called name. The filename parameter holds an ASCII approximation
+// of name for old clients. If that approximation isn't exact, a
+// filename* parameter holds the real name encoded as RFC 5987 describes.
+func contentDisposition(dispositionType, name string) string {
+	var sb strings.Builder
+	sb.WriteString(dispositionType)
+	sb.WriteString(`; filename="`)
+	exact := true
+	for _, r := range name {
+		switch {
+		case r == '"' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r < 0x20 || r >= 0x7f:
+			sb.WriteByte('_')
+			exact = false
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	if !exact {
+		sb.WriteString("; filename*=UTF-8''")
+		sb.WriteString(encodeRFC5987(name))
+	}
+	return sb.String()
+}
+
+// encodeRFC5987 percent encodes the bytes of value that aren't attr-chars
+// as RFC 5987 defines them.
+func encodeRFC5987(value string) string {
+	const attrChars = "!#$&+-.^_`|~"
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' ||
+			'0' <= b && b <= '9' || strings.IndexByte(attrChars, b) != -1 {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,305 @@
+package attachmentshttp_test
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/keep94/attachments"
+	"github.com/keep94/attachments/attachmentsdb/for_sqlite"
+	"github.com/keep94/attachments/attachmentsdb/sqlite_setup"
+	"github.com/keep94/attachments/attachmentshttp"
+	"github.com/keep94/gosqlite/sqlite"
+	"github.com/keep94/toolbox/db/sqlite_db"
+	"github.com/keep94/toolbox/kdf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeHandler(t *testing.T) {
+	immutableFs := newImmutableFS(t)
+	id, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	entry := entryById(t, immutableFs, id)
+	handler := attachmentshttp.NewServeHandler(immutableFs, nil)
+
+	resp := serve(handler, "GET", urlPath(entry), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello World!", body(t, resp))
+	etag := resp.Header.Get("ETag")
+	assert.Equal(t, `"`+entry.Checksum+`"`, etag)
+	assert.Equal(
+		t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "12", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	assert.Equal(t, "private, no-cache", resp.Header.Get("Cache-Control"))
+	assert.Equal(
+		t,
+		`attachment; filename="hello.txt"`,
+		resp.Header.Get("Content-Disposition"))
+	assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+
+	resp = serve(handler, "HEAD", urlPath(entry), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "12", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "", body(t, resp))
+
+	// Conditional requests
+	resp = serve(
+		handler, "GET", urlPath(entry), http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Equal(t, "", body(t, resp))
+	resp = serve(
+		handler,
+		"GET",
+		urlPath(entry),
+		http.Header{"If-None-Match": {`"other", ` + etag}})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	resp = serve(
+		handler,
+		"GET",
+		urlPath(entry),
+		http.Header{"If-None-Match": {`"other"`}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello World!", body(t, resp))
+}
+
+func TestServeHandler_Range(t *testing.T) {
+	immutableFs := newImmutableFS(t)
+	id, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	entry := entryById(t, immutableFs, id)
+	handler := attachmentshttp.NewServeHandler(immutableFs, nil)
+	path := urlPath(entry)
+
+	resp := serve(handler, "GET", path, http.Header{"Range": {"bytes=6-"}})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 6-11/12", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "World!", body(t, resp))
+
+	resp = serve(handler, "GET", path, http.Header{"Range": {"bytes=-3"}})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "ld!", body(t, resp))
+
+	// Ranges out of order
+	resp = serve(
+		handler, "GET", path, http.Header{"Range": {"bytes=6-10,0-4"}})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, []string{"World", "Hello"}, parts(t, resp))
+
+	resp = serve(handler, "GET", path, http.Header{"Range": {"bytes=12-"}})
+	assert.Equal(
+		t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	// Range is ignored if If-Range doesn't match
+	resp = serve(
+		handler,
+		"GET",
+		path,
+		http.Header{"Range": {"bytes=6-"}, "If-Range": {`"other"`}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello World!", body(t, resp))
+	resp = serve(
+		handler,
+		"GET",
+		path,
+		http.Header{
+			"Range":    {"bytes=6-"},
+			"If-Range": {resp.Header.Get("ETag")},
+		})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "World!", body(t, resp))
+}
+
+func TestServeHandler_ContentDisposition(t *testing.T) {
+	immutableFs := newImmutableFS(t)
+	id, err := immutableFs.Write("café résumé.pdf", ([]byte)("PDF"))
+	require.NoError(t, err)
+	accentedPath := urlPath(entryById(t, immutableFs, id))
+	id, err = immutableFs.Write(`say "hi".txt`, ([]byte)("hi"))
+	require.NoError(t, err)
+	quotedPath := urlPath(entryById(t, immutableFs, id))
+	id, err = immutableFs.Write("unknown.zzz", ([]byte)("?"))
+	require.NoError(t, err)
+	unknownPath := urlPath(entryById(t, immutableFs, id))
+	handler := attachmentshttp.NewServeHandler(immutableFs, nil)
+
+	resp := serve(handler, "GET", accentedPath, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	disposition := resp.Header.Get("Content-Disposition")
+	assert.Equal(
+		t,
+		`attachment; filename="caf_ r_sum_.pdf"; `+
+			`filename*=UTF-8''caf%C3%A9%20r%C3%A9sum%C3%A9.pdf`,
+		disposition)
+	_, params, err := mime.ParseMediaType(disposition)
+	require.NoError(t, err)
+	assert.Equal(t, "café résumé.pdf", params["filename"])
+	assert.Equal(t, "application/pdf", resp.Header.Get("Content-Type"))
+
+	resp = serve(handler, "GET", quotedPath, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	disposition = resp.Header.Get("Content-Disposition")
+	assert.Equal(t, `attachment; filename="say \"hi\".txt"`, disposition)
+	_, params, err = mime.ParseMediaType(disposition)
+	require.NoError(t, err)
+	assert.Equal(t, `say "hi".txt`, params["filename"])
+
+	resp = serve(handler, "GET", unknownPath, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(
+		t, "application/octet-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+
+	inlineHandler := attachmentshttp.NewServeHandler(
+		immutableFs, &attachmentshttp.ServeOptions{Inline: true})
+	resp = serve(inlineHandler, "GET", quotedPath, nil)
+	assert.Equal(
+		t,
+		`inline; filename="say \"hi\".txt"`,
+		resp.Header.Get("Content-Disposition"))
+	assert.Empty(t, resp.Header.Get("Content-Security-Policy"))
+
+	// Files that could run script are never displayed
+	for _, name := range []string{"page.html", "image.svg", "data.xml"} {
+		id, err := immutableFs.Write(name, ([]byte)("<script></script>"))
+		require.NoError(t, err)
+		resp = serve(
+			inlineHandler, "GET", urlPath(entryById(t, immutableFs, id)), nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, name)
+		assert.Equal(
+			t,
+			fmt.Sprintf(`attachment; filename="%s"`, name),
+			resp.Header.Get("Content-Disposition"))
+		assert.Equal(
+			t, "sandbox", resp.Header.Get("Content-Security-Policy"), name)
+		assert.Equal(
+			t, "nosniff", resp.Header.Get("X-Content-Type-Options"), name)
+	}
+}
+
+func TestServeHandler_NotFound(t *testing.T) {
+	immutableFs := newImmutableFS(t)
+	id, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	entry := entryById(t, immutableFs, id)
+	handler := attachmentshttp.NewServeHandler(immutableFs, nil)
+
+	for _, path := range []string{
+		"/",
+		"/1",
+		"/1/",
+		"/1/goodbye.txt",
+		"/2/hello.txt",
+		"/01/hello.txt",
+		"/1/hello.txt/more",
+	} {
+		resp := serve(handler, "GET", path, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+	require.NoError(t, immutableFs.Delete(id))
+	resp := serve(handler, "GET", urlPath(entry), nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = serve(handler, "POST", urlPath(entry), nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+}
+
+func TestServeHandler_StripPrefix(t *testing.T) {
+	immutableFs := newImmutableFS(t)
+	id, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	entry := entryById(t, immutableFs, id)
+	mux := http.NewServeMux()
+	mux.Handle(
+		"/files/",
+		http.StripPrefix(
+			"/files", attachmentshttp.NewServeHandler(immutableFs, nil)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/files" + urlPath(entry))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello World!", body(t, resp))
+}
+
+func serve(
+	handler http.Handler,
+	method, path string,
+	header http.Header) *http.Response {
+	request := httptest.NewRequest(method, path, nil)
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Result()
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	contents, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(contents)
+}
+
+func parts(t *testing.T, resp *http.Response) []string {
+	t.Helper()
+	defer resp.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(
+		resp.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/byteranges", mediaType)
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	var result []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return result
+		}
+		require.NoError(t, err)
+		contents, err := io.ReadAll(part)
+		require.NoError(t, err)
+		result = append(result, string(contents))
+	}
+}
+
+// urlPath returns the path to entry as it appears in a URL.
+func urlPath(entry *attachments.Entry) string {
+	return (&url.URL{Path: "/" + entry.Path()}).EscapedPath()
+}
+
+func entryById(
+	t *testing.T,
+	immutableFs attachments.ImmutableFS,
+	id int64) *attachments.Entry {
+	t.Helper()
+	entries, err := immutableFs.List(nil, map[int64]bool{id: true})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	return entries[0]
+}
+
+func newImmutableFS(t *testing.T) attachments.ImmutableFS {
+	t.Helper()
+	conn, err := sqlite.Open(":memory:")
+	require.NoError(t, err)
+	db := sqlite_db.New(conn)
+	t.Cleanup(func() { db.Close() })
+	err = db.Do(func(conn *sqlite.Conn) error {
+		return sqlite_setup.SetUpTables(conn)
+	})
+	require.NoError(t, err)
+	return attachments.NewImmutableFS(
+		attachments.NewInMemoryFS(),
+		for_sqlite.New(db),
+		attachments.Owner{Id: 1, Key: kdf.Random(32)})
+}
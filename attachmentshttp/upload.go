@@ -0,0 +1,283 @@
+package attachmentshttp
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+
+	"github.com/keep94/attachments"
+)
+
+const (
+	// DefaultMaxFileSize is the largest file in bytes that the upload
+	// handler accepts when UploadOptions doesn't say.
+	DefaultMaxFileSize = 32 << 20
+
+	// DefaultMaxRequestSize is the largest request body in bytes that the
+	// upload handler accepts when UploadOptions doesn't say.
+	DefaultMaxRequestSize = 64 << 20
+)
+
+var (
+	errTooLarge = errors.New("attachmentshttp: Too large")
+)
+
+// UploadOptions contains options for NewUploadHandler.
+type UploadOptions struct {
+
+	// The largest file in bytes that the handler accepts. Zero means
+	// DefaultMaxFileSize.
+	MaxFileSize int64
+
+	// The largest request body in bytes that the handler accepts. Zero
+	// means DefaultMaxRequestSize.
+	MaxRequestSize int64
+}
+
+func (o *UploadOptions) maxFileSize() int64 {
+	if o == nil || o.MaxFileSize == 0 {
+		return DefaultMaxFileSize
+	}
+	return o.MaxFileSize
+}
+
+func (o *UploadOptions) maxRequestSize() int64 {
+	if o == nil || o.MaxRequestSize == 0 {
+		return DefaultMaxRequestSize
+	}
+	return o.MaxRequestSize
+}
+
+// UploadedFile describes a file that the upload handler stored.
+type UploadedFile struct {
+
+	// The form field the file came in
+	Field string `json:"field"`
+
+	// The Id of the new file
+	Id int64 `json:"id"`
+
+	// The name of the new file as stored
+	Name string `json:"name"`
+
+	// The size of the file in bytes
+	Size int64 `json:"size"`
+
+	// The timestamp of the file in seconds
+	Ts int64 `json:"ts"`
+
+	// Identifies the file contents
+	Checksum string `json:"checksum"`
+
+	// The path to the new file that ImmutableFS.Open accepts
+	Path string `json:"path"`
+}
+
+// UploadResponse is the JSON body of a successful upload.
+type UploadResponse struct {
+
+	// The new files in the order they were uploaded
+	Files []UploadedFile `json:"files"`
+}
+
+// NewUploadHandler returns a handler that stores the files POSTed to it
+// as multipart/form-data in fileSystem. The handler streams each file into
+// fileSystem as it arrives rather than buffering it, and it ignores form
+// fields that aren't files. On success, the handler responds with 201
+// Created and an UploadResponse as JSON. If it can't store every file in
+// a request, the handler deletes the ones it stored and responds with an
+// error: 403 if fileSystem is read-only, 413 if a file or the request is
+// too large, and 400 if the request is malformed, has no files, or has a
+// file whose name fileSystem refuses. nil options means the defaults.
+func NewUploadHandler(
+	fileSystem attachments.ImmutableFS,
+	options *UploadOptions) http.Handler {
+	return &uploadHandler{
+		fileSystem:     fileSystem,
+		maxFileSize:    options.maxFileSize(),
+		maxRequestSize: options.maxRequestSize(),
+	}
+}
+
+type uploadHandler struct {
+	fileSystem     attachments.ImmutableFS
+	maxFileSize    int64
+	maxRequestSize int64
+}
+
+func (h *uploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.fileSystem.ReadOnly() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	body := &limitReader{reader: r.Body, limit: h.maxRequestSize}
+	r.Body = readCloser{Reader: body, Closer: r.Body}
+	files, err := h.upload(r)
+	if err != nil {
+		h.deleteAll(files)
+		switch {
+		case body.exceeded:
+			http.Error(
+				w, "Request too large", http.StatusRequestEntityTooLarge)
+		case err == errTooLarge:
+			http.Error(
+				w, "File too large", http.StatusRequestEntityTooLarge)
+		case errors.As(err, new(badRequest)):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, fs.ErrInvalid):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			httpError(w, r, err)
+		}
+		return
+	}
+	if len(files) == 0 {
+		http.Error(w, "No files in request", http.StatusBadRequest)
+		return
+	}
+	response, err := h.response(files)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// upload stores the files in r. upload returns the files stored so far
+// even if it returns an error.
+func (h *uploadHandler) upload(r *http.Request) ([]UploadedFile, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, badRequest{err}
+	}
+	var files []UploadedFile
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, badRequest{err}
+		}
+		if part.FileName() == "" {
+			if _, err := io.Copy(io.Discard, part); err != nil {
+				return files, badRequest{err}
+			}
+			continue
+		}
+		file := &limitReader{
+			reader: clientReader{reader: part}, limit: h.maxFileSize}
+		id, err := h.fileSystem.WriteFrom(part.FileName(), file)
+		if file.exceeded {
+			return files, errTooLarge
+		}
+		if err != nil {
+			return files, err
+		}
+		files = append(
+			files, UploadedFile{Field: part.FormName(), Id: id})
+	}
+}
+
+// response fills in the rest of files from the Store.
+func (h *uploadHandler) response(
+	files []UploadedFile) (*UploadResponse, error) {
+	entries, err := h.fileSystem.List(nil, ids(files))
+	if err != nil {
+		return nil, err
+	}
+	entriesById := make(map[int64]*attachments.Entry, len(entries))
+	for _, entry := range entries {
+		entriesById[entry.Id] = entry
+	}
+	for i := range files {
+		entry, ok := entriesById[files[i].Id]
+		if !ok {
+			return nil, attachments.ErrNoSuchId
+		}
+		files[i].Name = entry.Name
+		files[i].Size = entry.Size
+		files[i].Ts = entry.Ts
+		files[i].Checksum = entry.Checksum
+		files[i].Path = entry.Path()
+	}
+	return &UploadResponse{Files: files}, nil
+}
+
+func (h *uploadHandler) deleteAll(files []UploadedFile) {
+	for _, file := range files {
+		h.fileSystem.Delete(file.Id)
+	}
+}
+
+func ids(files []UploadedFile) map[int64]bool {
+	result := make(map[int64]bool, len(files))
+	for _, file := range files {
+		result[file.Id] = true
+	}
+	return result
+}
+
+// badRequest marks an error as the client's fault.
+type badRequest struct {
+	error
+}
+
+func (b badRequest) Unwrap() error {
+	return b.error
+}
+
+// limitReader reads at most limit bytes from reader. limitReader fails
+// with errTooLarge if reader has more.
+type limitReader struct {
+	reader   io.Reader
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, errTooLarge
+	}
+
+	// Read one byte more than allowed to see if there is more.
+	if remaining := l.limit - l.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := l.reader.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		l.exceeded = true
+		return n - 1, errTooLarge
+	}
+	return n, err
+}
+
+// clientReader reads from reader, which reads from the request body, and
+// marks the errors it returns as the client's fault.
+type clientReader struct {
+	reader io.Reader
+}
+
+func (c clientReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = badRequest{err}
+	}
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
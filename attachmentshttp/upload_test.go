@@ -0,0 +1,192 @@
+package attachmentshttp_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/keep94/attachments"
+	"github.com/keep94/attachments/attachmentshttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadHandler(t *testing.T) {
+	immutableFs := newImmutableFS(t)
+	handler := attachmentshttp.NewUploadHandler(immutableFs, nil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	body, contentType := multipartBody(
+		t,
+		formFile{field: "first", name: "hello.txt", contents: "Hello World!"},
+		formFile{field: "comment", contents: "Not a file"},
+		formFile{field: "second", name: "café.txt", contents: "Café"})
+	resp, err := http.Post(server.URL, contentType, body)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var response attachmentshttp.UploadResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	require.Len(t, response.Files, 2)
+
+	first := response.Files[0]
+	assert.Equal(t, "first", first.Field)
+	assert.Equal(t, "hello.txt", first.Name)
+	assert.Equal(t, int64(12), first.Size)
+	assert.NotZero(t, first.Ts)
+	assert.Len(t, first.Checksum, 64)
+	assert.Equal(t, "1/hello.txt", first.Path)
+	contents, err := fs.ReadFile(immutableFs, first.Path)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello World!", string(contents))
+
+	second := response.Files[1]
+	assert.Equal(t, "second", second.Field)
+	assert.Equal(t, int64(2), second.Id)
+	assert.Equal(t, "café.txt", second.Name)
+	assert.Equal(t, "2/café.txt", second.Path)
+	contents, err = fs.ReadFile(immutableFs, second.Path)
+	require.NoError(t, err)
+	assert.Equal(t, "Café", string(contents))
+	assert.Equal(t, 2, numFiles(t, immutableFs))
+}
+
+func TestUploadHandler_Limits(t *testing.T) {
+	immutableFs := newImmutableFS(t)
+	handler := attachmentshttp.NewUploadHandler(
+		immutableFs,
+		&attachmentshttp.UploadOptions{
+			MaxFileSize: 10, MaxRequestSize: 1000})
+
+	// A file that's too big undoes the files before it
+	resp := upload(
+		t,
+		handler,
+		formFile{field: "f", name: "small.txt", contents: "Small"},
+		formFile{field: "f", name: "big.txt", contents: "Hello World!"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal(t, 0, numFiles(t, immutableFs))
+
+	resp = upload(
+		t,
+		handler,
+		formFile{field: "f", name: "exact.txt", contents: "0123456789"})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, 1, numFiles(t, immutableFs))
+
+	var files []formFile
+	for i := 0; i < 20; i++ {
+		files = append(
+			files, formFile{field: "f", name: "a.txt", contents: "Small"})
+	}
+	resp = upload(t, handler, files...)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal(t, 1, numFiles(t, immutableFs))
+}
+
+func TestUploadHandler_BadRequest(t *testing.T) {
+	immutableFs := newImmutableFS(t)
+	handler := attachmentshttp.NewUploadHandler(immutableFs, nil)
+
+	resp := upload(
+		t,
+		handler,
+		formFile{field: "f", name: "hello.txt", contents: "Hello World!"},
+		formFile{field: "f", name: "..", contents: "Dot dot"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, 0, numFiles(t, immutableFs))
+
+	resp = upload(t, handler, formFile{field: "f", contents: "Not a file"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	request := httptest.NewRequest(
+		"POST", "/", strings.NewReader(`{"name": "hello.txt"}`))
+	request.Header.Set("Content-Type", "application/json")
+	assert.Equal(t, http.StatusBadRequest, do(handler, request).StatusCode)
+
+	// Truncated body
+	body, contentType := multipartBody(
+		t, formFile{field: "f", name: "hello.txt", contents: "Hello World!"})
+	request = httptest.NewRequest(
+		"POST", "/", bytes.NewReader(body.Bytes()[:body.Len()-10]))
+	request.Header.Set("Content-Type", contentType)
+	assert.Equal(t, http.StatusBadRequest, do(handler, request).StatusCode)
+	assert.Equal(t, 0, numFiles(t, immutableFs))
+
+	request = httptest.NewRequest("GET", "/", nil)
+	resp = do(handler, request)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "POST", resp.Header.Get("Allow"))
+}
+
+func TestUploadHandler_ReadOnly(t *testing.T) {
+	immutableFs := newImmutableFS(t)
+	handler := attachmentshttp.NewUploadHandler(
+		attachments.ReadOnly(immutableFs), nil)
+	resp := upload(
+		t,
+		handler,
+		formFile{field: "f", name: "hello.txt", contents: "Hello World!"})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, 0, numFiles(t, immutableFs))
+}
+
+type formFile struct {
+
+	// The form field
+	field string
+
+	// The file name. Empty means a plain form field.
+	name string
+
+	contents string
+}
+
+func multipartBody(
+	t *testing.T, files ...formFile) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, file := range files {
+		if file.name == "" {
+			require.NoError(t, writer.WriteField(file.field, file.contents))
+			continue
+		}
+		part, err := writer.CreateFormFile(file.field, file.name)
+		require.NoError(t, err)
+		_, err = part.Write(([]byte)(file.contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	return &body, writer.FormDataContentType()
+}
+
+func upload(
+	t *testing.T, handler http.Handler, files ...formFile) *http.Response {
+	t.Helper()
+	body, contentType := multipartBody(t, files...)
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Set("Content-Type", contentType)
+	return do(handler, request)
+}
+
+func do(handler http.Handler, request *http.Request) *http.Response {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Result()
+}
+
+// numFiles returns the number of files in immutableFs not deleted.
+func numFiles(t *testing.T, immutableFs attachments.ImmutableFS) int {
+	t.Helper()
+	entries, err := immutableFs.ReadDir(".")
+	require.NoError(t, err)
+	return len(entries)
+}
@@ -0,0 +1,162 @@
+// Command rotatekey re-encrypts the attachments of an owner with a new key.
+//
+// Usage:
+//
+//	ATTACHMENTS_KEY=<new key> ATTACHMENTS_OLD_KEYS=<old keys> \
+//	    rotatekey -root <dir> -db <file> -owner <id>
+//
+// -db is the sqlite database holding the owner's entries. rotatekey
+// re-encrypts only the attachments that the owner's entries reference.
+//
+// Keys are hexadecimal. ATTACHMENTS_OLD_KEYS is a comma separated list of
+// the keys the owner used before, newest first. An empty entry stands for
+// data that was stored unencrypted. If the owner has a key for deriving
+// blob names, it must be in ATTACHMENTS_NAME_KEY. Keys are passed in the
+// environment rather than as flags so that they don't show up in process
+// listings.
+//
+// With -envelope, rotatekey gives each attachment its own data key which
+// the owner key wraps, so that later rotations only rewrap data keys.
+//
+// rotatekey can be stopped at any time and run again to resume. While it
+// runs, and until it reports no failed or missing attachments, the
+// application must read the owner's attachments with both the new and
+// old keys. rotatekey exits with status 1 if any attachments failed or
+// are missing.
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/keep94/attachments"
+	"github.com/keep94/attachments/attachmentsdb/for_sqlite"
+	"github.com/keep94/gosqlite/sqlite"
+	"github.com/keep94/toolbox/db/sqlite_db"
+)
+
+var (
+	fRoot     string
+	fDb       string
+	fOwner    int64
+	fEnvelope bool
+)
+
+func main() {
+	flag.Parse()
+	if fRoot == "" || fDb == "" || fOwner == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	owner, err := ownerFromEnv(fOwner, fEnvelope, os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ok, err := rotate(fRoot, fDb, owner, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// rotate rotates the key of owner for the attachments in the root
+// directory and sqlite database at dbPath and writes a report to w.
+// rotate returns false if some attachments failed to rotate or are
+// missing.
+func rotate(
+	root, dbPath string,
+	owner attachments.Owner,
+	w io.Writer) (bool, error) {
+	fileSystem, err := attachments.NewFS(root)
+	if err != nil {
+		return false, err
+	}
+	conn, err := sqlite.Open(dbPath)
+	if err != nil {
+		return false, err
+	}
+	dbase := sqlite_db.New(conn)
+	defer dbase.Close()
+	report, err := attachments.RotateKey(
+		fileSystem, for_sqlite.New(dbase), owner)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(w, "Scanned: %d\n", report.Scanned)
+	fmt.Fprintf(w, "Rotated: %d\n", len(report.Rotated))
+	fmt.Fprintf(w, "Already current: %d\n", len(report.Current))
+	for _, checksum := range report.Failed {
+		fmt.Fprintf(w, "Failed: %s\n", checksum)
+	}
+	for _, checksum := range report.Missing {
+		fmt.Fprintf(w, "Missing: %s\n", checksum)
+	}
+	return len(report.Failed) == 0 && len(report.Missing) == 0, nil
+}
+
+// ownerFromEnv returns the owner with given id and keys from the
+// environment. getenv looks up environment variables.
+func ownerFromEnv(
+	id int64,
+	envelope bool,
+	getenv func(string) string) (attachments.Owner, error) {
+	key, err := hex.DecodeString(getenv("ATTACHMENTS_KEY"))
+	if err != nil || len(key) == 0 {
+		return attachments.Owner{}, errors.New(
+			"ATTACHMENTS_KEY must be a hexadecimal key")
+	}
+	oldKeys, err := parseKeys(getenv("ATTACHMENTS_OLD_KEYS"))
+	if err != nil {
+		return attachments.Owner{}, err
+	}
+	nameKey, err := hex.DecodeString(getenv("ATTACHMENTS_NAME_KEY"))
+	if err != nil {
+		return attachments.Owner{}, errors.New(
+			"ATTACHMENTS_NAME_KEY must be a hexadecimal key")
+	}
+	if len(nameKey) == 0 {
+		nameKey = nil
+	}
+	return attachments.Owner{
+		Id:       id,
+		Key:      key,
+		OldKeys:  oldKeys,
+		NameKey:  nameKey,
+		Envelope: envelope,
+	}, nil
+}
+
+func parseKeys(s string) ([][]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var result [][]byte
+	for _, hexKey := range strings.Split(s, ",") {
+		if hexKey == "" {
+			result = append(result, nil)
+			continue
+		}
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("ATTACHMENTS_OLD_KEYS: %v", err)
+		}
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+func init() {
+	flag.StringVar(&fRoot, "root", "", "Root directory of attachments")
+	flag.StringVar(&fDb, "db", "", "Path to sqlite database of entries")
+	flag.Int64Var(&fOwner, "owner", 0, "Id of owner")
+	flag.BoolVar(
+		&fEnvelope, "envelope", false, "Give each blob its own data key")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	"github.com/keep94/attachments"
+	"github.com/keep94/attachments/attachmentsdb/for_sqlite"
+	"github.com/keep94/attachments/attachmentsdb/sqlite_setup"
+	"github.com/keep94/gosqlite/sqlite"
+	"github.com/keep94/toolbox/db/sqlite_db"
+	"github.com/keep94/toolbox/kdf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotate(t *testing.T) {
+	root := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "attachments.db")
+	oldKey := kdf.Random(32)
+	newKey := kdf.Random(32)
+
+	// Set up attachments with the old key
+	require.NoError(t, withConn(dbPath, sqlite_setup.SetUpTables))
+	withStore(t, dbPath, func(store attachments.Store) {
+		fileSystem, err := attachments.NewFS(root)
+		require.NoError(t, err)
+		immutableFs := attachments.NewImmutableFS(
+			fileSystem, store, attachments.Owner{Id: 1, Key: oldKey})
+		_, err = immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+		require.NoError(t, err)
+		_, err = immutableFs.Write(
+			"goodbye.txt", ([]byte)("Goodbye World!"))
+		require.NoError(t, err)
+	})
+
+	var out bytes.Buffer
+	owner := attachments.Owner{
+		Id: 1, Key: newKey, OldKeys: [][]byte{oldKey}}
+	ok, err := rotate(root, dbPath, owner, &out)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(
+		t, "Scanned: 2\nRotated: 2\nAlready current: 0\n", out.String())
+
+	// Only the new key is needed now
+	withStore(t, dbPath, func(store attachments.Store) {
+		fileSystem, err := attachments.NewFS(root)
+		require.NoError(t, err)
+		immutableFs := attachments.NewImmutableFS(
+			fileSystem, store, attachments.Owner{Id: 1, Key: newKey})
+		for id, expected := range map[int64]string{
+			1: "Hello World!", 2: "Goodbye World!"} {
+			entries, err := immutableFs.List(nil, map[int64]bool{id: true})
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			contents, err := fs.ReadFile(
+				immutableFs, fmt.Sprintf("%d/%s", id, entries[0].Name))
+			require.NoError(t, err)
+			assert.Equal(t, expected, string(contents))
+		}
+	})
+
+	// Running again finds nothing left to do
+	out.Reset()
+	ok, err = rotate(root, dbPath, owner, &out)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(
+		t, "Scanned: 2\nRotated: 0\nAlready current: 2\n", out.String())
+}
+
+func TestRotate_NameKey(t *testing.T) {
+	root := t.TempDir()
+	dbPath := filepath.Join(t.TempDir(), "attachments.db")
+	oldKey := kdf.Random(32)
+	nameKey := kdf.Random(32)
+	require.NoError(t, withConn(dbPath, sqlite_setup.SetUpTables))
+	withStore(t, dbPath, func(store attachments.Store) {
+		fileSystem, err := attachments.NewFS(root)
+		require.NoError(t, err)
+		immutableFs := attachments.NewImmutableFS(
+			fileSystem,
+			store,
+			attachments.Owner{Id: 1, Key: oldKey, NameKey: nameKey})
+		_, err = immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+		require.NoError(t, err)
+	})
+	env := map[string]string{
+		"ATTACHMENTS_KEY":      hex.EncodeToString(kdf.Random(32)),
+		"ATTACHMENTS_OLD_KEYS": hex.EncodeToString(oldKey),
+	}
+	getenv := func(name string) string { return env[name] }
+
+	// Without the name key, the attachment can't be found.
+	owner, err := ownerFromEnv(1, false, getenv)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	ok, err := rotate(root, dbPath, owner, &out)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	checksum := sha256.Sum256(([]byte)("Hello World!"))
+	assert.Equal(
+		t,
+		"Scanned: 1\nRotated: 0\nAlready current: 0\nMissing: "+
+			hex.EncodeToString(checksum[:])+"\n",
+		out.String())
+
+	env["ATTACHMENTS_NAME_KEY"] = hex.EncodeToString(nameKey)
+	owner, err = ownerFromEnv(1, false, getenv)
+	require.NoError(t, err)
+	out.Reset()
+	ok, err = rotate(root, dbPath, owner, &out)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(
+		t, "Scanned: 1\nRotated: 1\nAlready current: 0\n", out.String())
+}
+
+func TestOwnerFromEnv(t *testing.T) {
+	env := map[string]string{"ATTACHMENTS_KEY": "0102"}
+	getenv := func(name string) string { return env[name] }
+	owner, err := ownerFromEnv(3, true, getenv)
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		attachments.Owner{Id: 3, Key: []byte{1, 2}, Envelope: true},
+		owner)
+	env["ATTACHMENTS_NAME_KEY"] = "xyz"
+	_, err = ownerFromEnv(3, false, getenv)
+	assert.Error(t, err)
+	delete(env, "ATTACHMENTS_KEY")
+	_, err = ownerFromEnv(3, false, getenv)
+	assert.Error(t, err)
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := parseKeys("")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	keys, err = parseKeys("0102,,ff")
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{{1, 2}, nil, {0xff}}, keys)
+	_, err = parseKeys("xyz")
+	assert.Error(t, err)
+}
+
+func withStore(
+	t *testing.T, dbPath string, fn func(store attachments.Store)) {
+	conn, err := sqlite.Open(dbPath)
+	require.NoError(t, err)
+	dbase := sqlite_db.New(conn)
+	defer dbase.Close()
+	fn(for_sqlite.New(dbase))
+}
+
+func withConn(dbPath string, fn func(conn *sqlite.Conn) error) error {
+	conn, err := sqlite.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return fn(conn)
+}
@@ -1,15 +1,20 @@
 package attachments
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"strconv"
+	"strings"
 )
 
 // Owner represents a file owner. Owners can see only their own files.
@@ -21,6 +26,59 @@ type Owner struct {
 	// The encryption key for the owner. May be nil if no encryption is
 	// to be done for the owner.
 	Key []byte
+
+	// The keys the owner used before Key, newest first. Data encrypted
+	// with any of these keys stays readable while RotateKey re-encrypts it
+	// with Key. Data written before blobs had headers is always decrypted
+	// with the oldest key, the last one here or Key if OldKeys is empty.
+	// nil as the oldest key means that such data isn't encrypted.
+	OldKeys [][]byte
+
+	// If true, each blob the owner writes gets its own random data key
+	// which Key wraps. Rotating Key then only rewraps the data keys
+	// instead of re-encrypting the blobs. Blobs written either way stay
+	// readable whatever this is set to.
+	Envelope bool
+
+	// If non-nil, the owner's keys come from KeyProvider instead of Key
+	// and OldKeys. The newest key becomes Key and the others become
+	// OldKeys each time the owner's data is read or written.
+	KeyProvider KeyProvider
+
+	// If non-nil, the secret from which the names of the owner's blobs
+	// are derived so that someone with access to the underlying file
+	// system can't tell whether a given document is stored. Entry.Checksum
+	// remains the plain SHA-256 checksum of the data. Use MigrateBlobNames
+	// to rename blobs stored before NameKey was set. Changing NameKey
+	// once set makes existing blobs unreachable.
+	NameKey []byte
+}
+
+// encrypted returns true if any of the owner's data may be encrypted.
+func (o *Owner) encrypted() bool {
+	return o.Key != nil || len(o.OldKeys) > 0
+}
+
+// keys returns the non nil keys of the owner, newest first.
+func (o *Owner) keys() [][]byte {
+	var result [][]byte
+	if o.Key != nil {
+		result = append(result, o.Key)
+	}
+	for _, key := range o.OldKeys {
+		if key != nil {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// legacyKey returns the key for data written before blobs had headers.
+func (o *Owner) legacyKey() []byte {
+	if len(o.OldKeys) > 0 {
+		return o.OldKeys[len(o.OldKeys)-1]
+	}
+	return o.Key
 }
 
 // aesFS is an encrypted file system storing immutable data
@@ -36,34 +94,116 @@ type aesFS struct {
 // Write writes data to the underlying file system and returns the 64 digit
 // hexadecimal SHA-256 checksum of that data.
 func (a *aesFS) Write(contents []byte) (string, error) {
+	a, err := a.withKeys()
+	if err != nil {
+		return "", err
+	}
 	binaryId := checksum(contents)
 	id := hex.EncodeToString(binaryId)
-	name := idToPath(id, a.Owner.Id)
+	name := idToPath(a.blobId(binaryId), a.Owner.Id)
 	if a.FileSystem.Exists(name) {
+		touch(a.FileSystem, name)
 		return id, nil
 	}
-	if err := a.write(name, binaryId, contents); err != nil {
+	if _, err := a.write(name, bytes.NewReader(contents)); err != nil {
 		return "", err
 	}
 	return id, nil
 }
 
+// WriteFrom works like Write except that it reads the data to write from
+// reader. WriteFrom returns the checksum and the size of the data written.
+// Since the checksum isn't known until all the data is read, WriteFrom
+// first stages the data under a temporary name and moves it to its final
+// location only once the data is safely stored. WriteFrom uses a bounded
+// amount of memory no matter how much data it writes.
+func (a *aesFS) WriteFrom(reader io.Reader) (string, int64, error) {
+	a, err := a.withKeys()
+	if err != nil {
+		return "", 0, err
+	}
+	stagingName, err := stagingPath(a.Owner.Id)
+	if err != nil {
+		return "", 0, err
+	}
+	hash := sha256.New()
+	size, err := a.write(stagingName, io.TeeReader(reader, hash))
+	if err != nil {
+		Remove(a.FileSystem, stagingName)
+		return "", 0, err
+	}
+	binaryId := hash.Sum(nil)
+	id := hex.EncodeToString(binaryId)
+	name := idToPath(a.blobId(binaryId), a.Owner.Id)
+	if a.FileSystem.Exists(name) {
+		touch(a.FileSystem, name)
+		Remove(a.FileSystem, stagingName)
+		return id, size, nil
+	}
+	if err := rename(a.FileSystem, stagingName, name); err != nil {
+		Remove(a.FileSystem, stagingName)
+		return "", 0, err
+	}
+	return id, size, nil
+}
+
 // Open returns a reader to retrieve data. checksum is the 64 digit hexadecimal
-// checksum of the data that Write returned.
+// checksum of the data that Write returned. If the data was encrypted with
+// a different key, reading fails with ErrWrongKey. If the data was
+// tampered with, reading fails with ErrCorrupt.
 func (a *aesFS) Open(checksum string) (io.ReadCloser, error) {
-	name, err := safeIdToPath(checksum, a.Owner.Id)
+	a, err := a.withKeys()
 	if err != nil {
 		return nil, err
 	}
-	var binaryId []byte
-	var block cipher.Block
-	if a.Owner.Key != nil {
+	name, binaryId, err := a.resolve(checksum)
+	if err != nil {
+		return nil, err
+	}
+	return a.openBlob(name, binaryId)
+}
+
+// resolve returns the name of the blob holding the data with given
+// checksum along with what openBlob needs to decrypt it.
+func (a *aesFS) resolve(checksum string) (
+	name string, binaryId []byte, err error) {
+	name, err = a.blobPath(checksum)
+	if err != nil {
+		return "", nil, err
+	}
+	if a.Owner.NameKey != nil && !a.FileSystem.Exists(name) {
+		// MigrateBlobNames may not have gotten to this blob yet
+		name = idToPath(checksum, a.Owner.Id)
+	}
+	if a.Owner.encrypted() {
 		binaryId, err = hex.DecodeString(checksum)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
-		block, err = aes.NewCipher(a.Owner.Key)
-		if err != nil {
+	}
+	return name, binaryId, nil
+}
+
+// Remove removes the data with given checksum.
+func (a *aesFS) Remove(checksum string) error {
+	name, err := a.blobPath(checksum)
+	if err != nil {
+		return err
+	}
+	err = Remove(a.FileSystem, name)
+	if a.Owner.NameKey != nil && errors.Is(err, fs.ErrNotExist) {
+		return Remove(a.FileSystem, idToPath(checksum, a.Owner.Id))
+	}
+	return err
+}
+
+// openBlob returns a reader that decrypts the blob at name. binaryId is
+// the checksum of the blob's data which blobs in the legacy format need
+// for decryption. If binaryId is nil, openBlob can't decrypt blobs in
+// the legacy format.
+func (a *aesFS) openBlob(name string, binaryId []byte) (io.ReadCloser, error) {
+	for _, key := range a.Owner.keys() {
+		if _, err := aes.NewCipher(key); err != nil {
 			return nil, err
 		}
 	}
@@ -71,49 +211,121 @@ func (a *aesFS) Open(checksum string) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	if block != nil {
-		reader = a.addDecryption(reader, block, binaryId)
+	if !a.Owner.encrypted() {
+		return reader, nil
 	}
-	return reader, nil
+	decReader, err := a.addDecryption(reader, binaryId)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return decReader, nil
+}
+
+// blobPath returns the path of the blob holding the data with given
+// checksum.
+func (a *aesFS) blobPath(checksum string) (string, error) {
+	if a.Owner.NameKey == nil {
+		return safeIdToPath(checksum, a.Owner.Id)
+	}
+	binaryId, err := hex.DecodeString(checksum)
+	if err != nil {
+		return "", err
+	}
+	return safeIdToPath(a.blobId(binaryId), a.Owner.Id)
+}
+
+// blobId returns the 64 digit hexadecimal ID of the blob holding the data
+// with given binary checksum. If the owner has a NameKey, the ID is an
+// HMAC of the checksum so that blob names reveal nothing about their
+// contents. Otherwise, the ID is just the checksum.
+func (a *aesFS) blobId(binaryId []byte) string {
+	if a.Owner.NameKey == nil {
+		return hex.EncodeToString(binaryId)
+	}
+	return hex.EncodeToString(
+		hmacSum(a.Owner.NameKey, "attachments blob name", binaryId))
+}
+
+// withKeys returns a copy of this instance with the owner's keys fetched
+// from the owner's KeyProvider. If the owner has no KeyProvider, withKeys
+// returns this instance.
+func (a *aesFS) withKeys() (*aesFS, error) {
+	if a.Owner.KeyProvider == nil {
+		return a, nil
+	}
+	owner, err := a.Owner.withKeys()
+	if err != nil {
+		return nil, err
+	}
+	return &aesFS{FileSystem: a.FileSystem, Owner: owner}, nil
 }
 
-func (a *aesFS) write(
-	name string, binaryId, contents []byte) error {
-	var block cipher.Block
-	var err error
+// write writes the data from reader to name encrypting it if the owner has
+// a key. write returns the number of bytes read from reader. If write
+// fails, it aborts the write so that nothing is stored at name.
+func (a *aesFS) write(name string, reader io.Reader) (int64, error) {
 	if a.Owner.Key != nil {
-		block, err = aes.NewCipher(a.Owner.Key)
-		if err != nil {
-			return err
+		if _, err := aes.NewCipher(a.Owner.Key); err != nil {
+			return 0, err
 		}
 	}
 	writer, err := a.FileSystem.Write(name)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if block != nil {
-		writer = a.addEncryption(writer, block, binaryId)
+	var encWriter io.Writer = writer
+	var gcm *gcmWriter
+	if a.Owner.Key != nil {
+		gcm, err = newGCMWriter(writer, a.Owner.Key, a.Owner.Envelope)
+		if err != nil {
+			abort(a.FileSystem, name, writer)
+			return 0, err
+		}
+		encWriter = gcm
 	}
-	defer writer.Close()
-	_, err = io.Copy(writer, bytes.NewReader(contents))
-	return err
-}
-
-func (a *aesFS) addEncryption(
-	writer io.WriteCloser,
-	block cipher.Block,
-	binaryId []byte) io.WriteCloser {
-	stream := cipher.NewCFBEncrypter(block, iv(binaryId, a.Owner.Id))
-	return cipher.StreamWriter{S: stream, W: writer}
+	size, err := io.Copy(encWriter, reader)
+	if err == nil && gcm != nil {
+		// Writing the final chunk can fail too. Closing writer then
+		// would commit truncated data.
+		err = gcm.finish()
+	}
+	if err != nil {
+		abort(a.FileSystem, name, writer)
+		return 0, err
+	}
+	return size, writer.Close()
 }
 
+// addDecryption returns a reader that decrypts the data in reader.
+// binaryId is the checksum of the data which blobs in the legacy format
+// need for decryption. addDecryption picks the owner key that the data
+// was encrypted with.
 func (a *aesFS) addDecryption(
-	reader io.ReadCloser,
-	block cipher.Block,
-	binaryId []byte) io.ReadCloser {
+	reader io.ReadCloser, binaryId []byte) (io.ReadCloser, error) {
+	bufReader := bufio.NewReader(reader)
+	magic, _ := bufReader.Peek(len(kMagic))
+	if hasMagic(magic) {
+		gcmReader, err := newGCMReader(bufReader, a.Owner.keys()...)
+		if err != nil {
+			return nil, err
+		}
+		return &readerCloser{Reader: gcmReader, Closer: reader}, nil
+	}
+	key := a.Owner.legacyKey()
+	if key == nil {
+		return &readerCloser{Reader: bufReader, Closer: reader}, nil
+	}
+	if binaryId == nil {
+		return nil, ErrCorrupt
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
 	stream := cipher.NewCFBDecrypter(block, iv(binaryId, a.Owner.Id))
-	streamReader := cipher.StreamReader{S: stream, R: reader}
-	return &readerCloser{Reader: streamReader, Closer: reader}
+	streamReader := cipher.StreamReader{S: stream, R: bufReader}
+	return &readerCloser{Reader: streamReader, Closer: reader}, nil
 }
 
 type readerCloser struct {
@@ -127,6 +339,15 @@ func checksum(contents []byte) []byte {
 	return hash.Sum(nil)
 }
 
+func randomBytes(n int) ([]byte, error) {
+	result := make([]byte, n)
+	if _, err := rand.Read(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// iv returns the IV that blobs in the legacy format use.
 func iv(checksum []byte, owner int64) []byte {
 	hash := sha256.New()
 	hash.Write(checksum)
@@ -142,6 +363,33 @@ func safeIdToPath(id string, ownerId int64) (string, error) {
 	return fmt.Sprintf("%d/%s/%s", ownerId, id[:2], id), nil
 }
 
+// stagingPath returns a new, unique path for staging data of given owner.
+func stagingPath(ownerId int64) (string, error) {
+	suffix, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"%d/staging/%s", ownerId, hex.EncodeToString(suffix)), nil
+}
+
+// pathToId is the inverse of idToPath. pathToId returns false if name
+// isn't the path of a 64 digit hexadecimal ID belonging to ownerId.
+func pathToId(name string, ownerId int64) (string, bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 || parts[0] != strconv.FormatInt(ownerId, 10) {
+		return "", false
+	}
+	id := parts[2]
+	if len(id) != 64 || parts[1] != id[:2] {
+		return "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", false
+	}
+	return id, true
+}
+
 // idToPath converts a 64 digit hexadecimal ID and ownerId to a path.
 func idToPath(id string, ownerId int64) string {
 	result, err := safeIdToPath(id, ownerId)
@@ -1,7 +1,12 @@
 package attachments
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/keep94/toolbox/kdf"
@@ -78,11 +83,10 @@ func TestEncFileSystem_Encryption(t *testing.T) {
 	assert.Equal(t, helloId, helloId2)
 	assert.Equal(t, oldFileCount+1, numFiles(fakeFS))
 
-	// Assert that using the wrong encryption key to read does not work.
+	// Assert that using the wrong encryption key to read fails loudly.
 	fileSystem1.Owner.Key = key2
-	contents = readBytes(fileSystem1, helloId)
-	assert.NotNil(t, contents)
-	assert.NotEqual(t, "Hello World!", string(contents))
+	_, err = readFile(fileSystem1, helloId)
+	assert.Equal(t, ErrWrongKey, err)
 
 	// Assert that we get ErrNotExist
 	fileSystem1.Owner.Key = key1
@@ -90,6 +94,257 @@ func TestEncFileSystem_Encryption(t *testing.T) {
 	assert.Equal(t, os.ErrNotExist, err)
 }
 
+func TestEncFileSystem_WriteFrom(t *testing.T) {
+	key := kdf.Random(32)
+	fakeFS := NewInMemoryFS()
+	fileSystem := &aesFS{
+		FileSystem: fakeFS,
+		Owner:      Owner{Key: key, Id: 1},
+	}
+	helloId, size, err := fileSystem.WriteFrom(
+		strings.NewReader("Hello World!"))
+	require.NoError(t, err)
+	assert.Len(t, helloId, 64)
+	assert.Equal(t, int64(12), size)
+	assert.Equal(t, 1, numFiles(fakeFS))
+	assert.Equal(t, "Hello World!", string(readBytes(fileSystem, helloId)))
+
+	// WriteFrom should store in the same format as Write
+	otherFS := NewInMemoryFS()
+	otherFileSystem := &aesFS{
+		FileSystem: otherFS,
+		Owner:      Owner{Key: key, Id: 1},
+	}
+	otherHelloId, err := otherFileSystem.Write(([]byte)("Hello World!"))
+	require.NoError(t, err)
+	assert.Equal(t, helloId, otherHelloId)
+	assert.True(t, hasMagic(readBytes(otherFS, idToPath(helloId, 1))))
+	assert.True(t, hasMagic(readBytes(fakeFS, idToPath(helloId, 1))))
+	assert.Len(
+		t,
+		readBytes(fakeFS, idToPath(helloId, 1)),
+		len(readBytes(otherFS, idToPath(helloId, 1))))
+
+	// Empty data
+	emptyId, size, err := fileSystem.WriteFrom(strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+	assert.Equal(t, 2, numFiles(fakeFS))
+	contents, err := readFile(fileSystem, emptyId)
+	require.NoError(t, err)
+	assert.Empty(t, contents)
+}
+
+func TestEncFileSystem_WriteFromNoEncryption(t *testing.T) {
+	fakeFS := NewInMemoryFS()
+	fileSystem := &aesFS{FileSystem: fakeFS, Owner: Owner{Id: 1}}
+	helloId, size, err := fileSystem.WriteFrom(
+		strings.NewReader("Hello World!"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), size)
+	helloId2, _, err := fileSystem.WriteFrom(strings.NewReader("Hello World!"))
+	require.NoError(t, err)
+	assert.Equal(t, helloId, helloId2)
+	assert.Equal(t, 1, numFiles(fakeFS))
+	contents := readBytes(fakeFS, idToPath(helloId, 1))
+	assert.Equal(t, "Hello World!", string(contents))
+}
+
+func TestEncFileSystem_FailedWrite(t *testing.T) {
+	fileSystem, err := NewFS(t.TempDir())
+	require.NoError(t, err)
+	assertFailedWrite(t, fileSystem)
+	assertFailedWrite(t, NewInMemoryFS())
+}
+
+func TestEncFileSystem_FailedFinalChunk(t *testing.T) {
+	fileSystem, err := NewFS(t.TempDir())
+	require.NoError(t, err)
+	for _, fileSystem := range []FS{
+		fileSystem, NewInMemoryFS(), basicFS{NewInMemoryFS()}} {
+		owner := Owner{Key: kdf.Random(32), Id: 1}
+		contents := pseudoRandomBytes(kChunkSize + 100)
+
+		// Fail part way through the final chunk
+		failFS := &aesFS{
+			FileSystem: &failingFS{
+				FS:        fileSystem,
+				failAfter: kHeaderSize + kChunkSize + 16 + 50,
+			},
+			Owner: owner,
+		}
+		_, err := failFS.Write(contents)
+		assert.Equal(t, errWrite, err)
+		assert.False(
+			t, fileSystem.Exists(idToPath(checksumOf(string(contents)), 1)))
+
+		goodFS := &aesFS{FileSystem: fileSystem, Owner: owner}
+		id, err := goodFS.Write(contents)
+		require.NoError(t, err)
+		assert.Equal(t, contents, readBytes(goodFS, id))
+	}
+}
+
+func TestEncFileSystem_FailedWriteFrom(t *testing.T) {
+	root := t.TempDir()
+	fileSystem, err := NewFS(root)
+	require.NoError(t, err)
+	owner := Owner{Key: kdf.Random(32), Id: 1}
+	failFS := &aesFS{
+		FileSystem: &failingFS{FS: fileSystem, failAfter: 5},
+		Owner:      owner,
+	}
+	_, _, err = failFS.WriteFrom(strings.NewReader("Hello World!"))
+	assert.Equal(t, errWrite, err)
+	assertNoTempFiles(t, root)
+	var files []string
+	err = filepath.Walk(
+		root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				files = append(files, path)
+			}
+			return err
+		})
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func assertFailedWrite(t *testing.T, fileSystem FS) {
+	owner := Owner{Key: kdf.Random(32), Id: 1}
+	failFS := &aesFS{
+		FileSystem: &failingFS{FS: fileSystem, failAfter: 5},
+		Owner:      owner,
+	}
+	goodFS := &aesFS{FileSystem: fileSystem, Owner: owner}
+	_, err := failFS.Write(([]byte)("Hello World!"))
+	assert.Equal(t, errWrite, err)
+
+	// A failed write must not leave a truncated blob behind that later
+	// writes of the same contents would dedup against.
+	helloId, err := goodFS.Write(([]byte)("Hello World!"))
+	require.NoError(t, err)
+	assert.Equal(t, "Hello World!", string(readBytes(goodFS, helloId)))
+}
+
+func TestEncFileSystem_LegacyFormat(t *testing.T) {
+	key := kdf.Random(32)
+	fakeFS := NewInMemoryFS()
+	fileSystem := &aesFS{
+		FileSystem: fakeFS,
+		Owner:      Owner{Key: key, Id: 1},
+	}
+	contents := kdf.Random(200000)
+	helloId := writeLegacyBlob(t, fileSystem, contents)
+
+	// Legacy blobs don't have the header that new blobs have
+	assert.False(t, hasMagic(readBytes(fakeFS, idToPath(helloId, 1))))
+	assert.Equal(t, contents, readBytes(fileSystem, helloId))
+
+	// Writing the same contents dedups against the legacy blob
+	helloId2, err := fileSystem.Write(contents)
+	require.NoError(t, err)
+	assert.Equal(t, helloId, helloId2)
+	assert.Equal(t, 1, numFiles(fakeFS))
+	assert.Equal(t, contents, readBytes(fileSystem, helloId))
+
+	// New blobs are in the GCM format
+	goodbyeId, err := fileSystem.Write(([]byte)("Goodbye World!"))
+	require.NoError(t, err)
+	assert.True(t, hasMagic(readBytes(fakeFS, idToPath(goodbyeId, 1))))
+}
+
+func TestEncFileSystem_Envelope(t *testing.T) {
+	key := kdf.Random(32)
+	fakeFS := NewInMemoryFS()
+	fileSystem := &aesFS{
+		FileSystem: fakeFS,
+		Owner:      Owner{Key: key, Id: 1, Envelope: true},
+	}
+	helloId, err := fileSystem.Write(([]byte)("Hello World!"))
+	require.NoError(t, err)
+	goodbyeId, _, err := fileSystem.WriteFrom(
+		strings.NewReader("Goodbye World!"))
+	require.NoError(t, err)
+	for _, id := range []string{helloId, goodbyeId} {
+		encContents := readBytes(fakeFS, idToPath(id, 1))
+		assert.Equal(t, byte(kEnvelopeVersion), encContents[len(kMagic)])
+	}
+
+	// Blobs are readable whatever Envelope is set to
+	fileSystem.Owner.Envelope = false
+	assert.Equal(t, "Hello World!", string(readBytes(fileSystem, helloId)))
+	assert.Equal(
+		t, "Goodbye World!", string(readBytes(fileSystem, goodbyeId)))
+	fileSystem.Owner.Key = kdf.Random(32)
+	_, err = readFile(fileSystem, helloId)
+	assert.Equal(t, ErrWrongKey, err)
+}
+
+func TestEncFileSystem_Tampering(t *testing.T) {
+	fakeFS := NewInMemoryFS()
+	fileSystem := &aesFS{
+		FileSystem: fakeFS,
+		Owner:      Owner{Key: kdf.Random(32), Id: 1},
+	}
+	contents := kdf.Random(3*kChunkSize + 100)
+	id, err := fileSystem.Write(contents)
+	require.NoError(t, err)
+	name := idToPath(id, 1)
+	original := readBytes(fakeFS, name)
+	chunkLen := kChunkSize + 16
+
+	// Flip a bit
+	tampered := append([]byte(nil), original...)
+	tampered[kHeaderSize+chunkLen+5] ^= 1
+	writeBytes(t, fakeFS, name, tampered)
+	_, err = readFile(fileSystem, id)
+	assert.Equal(t, ErrCorrupt, err)
+
+	// Truncate at a chunk boundary
+	writeBytes(t, fakeFS, name, original[:kHeaderSize+2*chunkLen])
+	_, err = readFile(fileSystem, id)
+	assert.Equal(t, ErrCorrupt, err)
+
+	// Swap two chunks
+	swapped := append([]byte(nil), original[:kHeaderSize]...)
+	swapped = append(
+		swapped, original[kHeaderSize+chunkLen:kHeaderSize+2*chunkLen]...)
+	swapped = append(swapped, original[kHeaderSize:kHeaderSize+chunkLen]...)
+	swapped = append(swapped, original[kHeaderSize+2*chunkLen:]...)
+	writeBytes(t, fakeFS, name, swapped)
+	_, err = readFile(fileSystem, id)
+	assert.Equal(t, ErrCorrupt, err)
+
+	writeBytes(t, fakeFS, name, original)
+	assert.Equal(t, contents, readBytes(fileSystem, id))
+}
+
+// writeLegacyBlob writes contents in the legacy AES-CFB format that
+// blobs used before the GCM format.
+func writeLegacyBlob(t *testing.T, fileSystem *aesFS, contents []byte) string {
+	binaryId := checksum(contents)
+	id := hex.EncodeToString(binaryId)
+	block, err := aes.NewCipher(fileSystem.Owner.Key)
+	require.NoError(t, err)
+	encrypted := make([]byte, len(contents))
+	cipher.NewCFBEncrypter(block, iv(binaryId, fileSystem.Owner.Id)).
+		XORKeyStream(encrypted, contents)
+	writeBytes(
+		t,
+		fileSystem.FileSystem,
+		idToPath(id, fileSystem.Owner.Id),
+		encrypted)
+	return id
+}
+
+func writeBytes(t *testing.T, fileSystem FS, name string, contents []byte) {
+	writer, err := fileSystem.Write(name)
+	require.NoError(t, err)
+	_, err = writer.Write(contents)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+}
+
 func TestEncFileSystem_ReadBadId(t *testing.T) {
 	key1 := kdf.Random(32)
 
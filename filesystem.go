@@ -3,32 +3,158 @@ package attachments
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
+var (
+	// Indicates that a file system does not support an operation.
+	ErrNotSupported = errors.New("attachments: Operation not supported")
+)
+
+// InvalidPathError is returned when a file system refuses a name because
+// it could escape the file system's root or reach somewhere it shouldn't.
+// errors.Is(err, fs.ErrInvalid) returns true for InvalidPathError.
+type InvalidPathError struct {
+
+	// The name refused
+	Name string
+
+	// Why the name was refused
+	Reason string
+}
+
+func (e *InvalidPathError) Error() string {
+	return fmt.Sprintf("attachments: invalid path %q: %s", e.Name, e.Reason)
+}
+
+func (e *InvalidPathError) Is(target error) bool {
+	return target == fs.ErrInvalid
+}
+
 // FS is a very simple file system.
 type FS interface {
-	// Open opens a file
+	// Open opens a file. If the returned reader also implements
+	// io.ReaderAt, the files that ImmutableFS opens can read from any
+	// offset without reading everything before it.
 	Open(name string) (io.ReadCloser, error)
 
-	// Write writes a file.
+	// Write writes a file. The file appears only once Close on the
+	// returned writer succeeds. If the returned writer has an
+	// Abort() error method, callers call it instead of Close to discard
+	// what they wrote.
 	Write(name string) (io.WriteCloser, error)
 
 	// Exists returns true if file with given path exists.
 	Exists(name string) bool
 }
 
+// WalkFS is a file system that can enumerate its files.
+type WalkFS interface {
+	FS
+
+	// Walk calls fn with the name of each file that starts with prefix in
+	// lexical order. If fn returns an error, Walk stops and returns that
+	// same error.
+	Walk(prefix string, fn func(name string) error) error
+}
+
+// StatFS is a file system that can report the size and modification time
+// of its files.
+type StatFS interface {
+	FS
+
+	// Stat returns information on the named file. If there is no such file,
+	// Stat returns an error satisfying errors.Is(err, fs.ErrNotExist).
+	Stat(name string) (fs.FileInfo, error)
+}
+
+// RemoveFS is a file system that can remove files.
+type RemoveFS interface {
+	FS
+
+	// Remove removes the named file. If there is no such file, Remove
+	// returns an error satisfying errors.Is(err, fs.ErrNotExist).
+	Remove(name string) error
+}
+
+// RenameFS is a file system that can rename files.
+type RenameFS interface {
+	FS
+
+	// Rename renames oldName to newName replacing newName if it exists.
+	Rename(oldName, newName string) error
+}
+
+// aborter is implemented by writers that can discard what was written
+// instead of committing it.
+type aborter interface {
+
+	// Abort discards what was written and closes this writer.
+	Abort() error
+}
+
+// toucher is implemented by file systems that can update the modification
+// time of their files.
+type toucher interface {
+
+	// Touch sets the modification time of the named file to now.
+	Touch(name string) error
+}
+
 // NewFS returns a file system backed by disk rooted at path root.
 // If root does not exist or is not a directory, NewFS returns os.ErrNotExist.
+// The returned file system stages each file it writes in a temporary file
+// and moves it into place only when the writer is closed. The
+// temporary files live in root/.tmp. NewFS removes temporary files that
+// haven't been written to for a day since a crash must have left them
+// behind. Temporary files of writes still in progress are left alone.
+//
+// Names must be valid according to io/fs.ValidPath, so they can't escape
+// root, must not contain backslashes, which some systems treat as
+// separators, and can't be in root/.tmp. The returned file system refuses
+// other names with an *InvalidPathError.
 func NewFS(root string) (FS, error) {
+	return NewFSWithOptions(root, nil)
+}
+
+// FSOptions contains options for NewFSWithOptions.
+type FSOptions struct {
+
+	// If true, the file system refuses to follow symbolic links within
+	// root. Names that lead through a symbolic link are refused with an
+	// *InvalidPathError, and Walk skips symbolic links. This guards
+	// against links that point outside root, but a link created while an
+	// operation is in progress can still slip through.
+	NoSymlinks bool
+}
+
+func (o *FSOptions) noSymlinks() bool {
+	if o == nil {
+		return false
+	}
+	return o.NoSymlinks
+}
+
+// NewFSWithOptions works like NewFS but allows the caller to specify
+// options. nil options means the defaults that NewFS uses.
+func NewFSWithOptions(root string, options *FSOptions) (FS, error) {
 	fileInfo, err := os.Stat(root)
 	if err != nil || !fileInfo.IsDir() {
 		return nil, os.ErrNotExist
 	}
-	return &realFS{root: root}, nil
+	result := &realFS{root: root, noSymlinks: options.noSymlinks()}
+	result.sweepTempFiles()
+	return result, nil
 }
 
 // NilFS returns an empty file system that cannot be written to.
@@ -39,20 +165,25 @@ func NilFS() FS {
 // NewInMemoryFS returns a new in memory file system that can be used
 // with multiple goroutines.
 func NewInMemoryFS() FS {
-	return &fakeFS{files: make(map[string][]byte)}
+	return &fakeFS{files: make(map[string]*fakeFile)}
+}
+
+type fakeFile struct {
+	contents []byte
+	modTime  time.Time
 }
 
 type fakeFS struct {
 	lock  sync.Mutex
-	files map[string][]byte
+	files map[string]*fakeFile
 }
 
 func (f *fakeFS) Open(name string) (io.ReadCloser, error) {
-	contents, ok := f.get(name)
+	file, ok := f.get(name)
 	if !ok {
 		return nil, os.ErrNotExist
 	}
-	return io.NopCloser(bytes.NewReader(contents)), nil
+	return bytesReadCloser{Reader: bytes.NewReader(file.contents)}, nil
 }
 
 func (f *fakeFS) Write(name string) (io.WriteCloser, error) {
@@ -64,17 +195,84 @@ func (f *fakeFS) Exists(name string) bool {
 	return ok
 }
 
-func (f *fakeFS) get(key string) ([]byte, bool) {
+func (f *fakeFS) Rename(oldName, newName string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	file, ok := f.files[oldName]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(f.files, oldName)
+	f.files[newName] = file
+	return nil
+}
+
+func (f *fakeFS) Remove(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.files[name]; !ok {
+		return os.ErrNotExist
+	}
+	delete(f.files, name)
+	return nil
+}
+
+func (f *fakeFS) Walk(prefix string, fn func(name string) error) error {
+	for _, name := range f.names(prefix) {
+		if err := fn(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeFS) Stat(name string) (fs.FileInfo, error) {
+	file, ok := f.get(name)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &fakeFileInfo{
+		name:    path.Base(name),
+		size:    int64(len(file.contents)),
+		modTime: file.modTime,
+	}, nil
+}
+
+func (f *fakeFS) Touch(name string) error {
 	f.lock.Lock()
 	defer f.lock.Unlock()
-	contents, ok := f.files[key]
-	return contents, ok
+	file, ok := f.files[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	f.files[name] = &fakeFile{contents: file.contents, modTime: time.Now()}
+	return nil
+}
+
+func (f *fakeFS) get(key string) (*fakeFile, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	file, ok := f.files[key]
+	return file, ok
 }
 
 func (f *fakeFS) put(key string, contents []byte) {
 	f.lock.Lock()
 	defer f.lock.Unlock()
-	f.files[key] = contents
+	f.files[key] = &fakeFile{contents: contents, modTime: time.Now()}
+}
+
+func (f *fakeFS) names(prefix string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var result []string
+	for name := range f.files {
+		if strings.HasPrefix(name, prefix) {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
 }
 
 func (f *fakeFS) numFiles() int {
@@ -87,6 +285,17 @@ func numFiles(fileSystem FS) int {
 	return fileSystem.(*fakeFS).numFiles()
 }
 
+// bytesReadCloser is a *bytes.Reader that can be closed. Unlike
+// io.NopCloser, bytesReadCloser keeps the io.ReaderAt and io.Seeker
+// methods of the *bytes.Reader.
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+func (b bytesReadCloser) Close() error {
+	return nil
+}
+
 type fakeFSWriter struct {
 	buffer bytes.Buffer
 	name   string
@@ -100,6 +309,11 @@ func (f *fakeFSWriter) Write(p []byte) (n int, err error) {
 	return f.buffer.Write(p)
 }
 
+func (f *fakeFSWriter) Abort() error {
+	f.fs = nil
+	return nil
+}
+
 func (f *fakeFSWriter) Close() error {
 	if f.fs != nil {
 		f.fs.put(f.name, f.buffer.Bytes())
@@ -108,31 +322,299 @@ func (f *fakeFSWriter) Close() error {
 	return nil
 }
 
+const (
+	kTempDir = ".tmp"
+
+	// Temporary files not written to for this long are left over from a
+	// crash.
+	kTempFileMaxAge = 24 * time.Hour
+)
+
 type realFS struct {
-	root string
+	root       string
+	noSymlinks bool
 }
 
 func (r *realFS) Open(name string) (io.ReadCloser, error) {
-	return os.Open(r.fullPath(name))
+	fullPath, err := r.fullPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fullPath)
 }
 
 func (r *realFS) Write(name string) (io.WriteCloser, error) {
-	fullPath := r.fullPath(name)
+	fullPath, err := r.fullPath(name)
+	if err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(path.Dir(fullPath), 0700); err != nil {
 		return nil, err
 	}
-	return os.Create(fullPath)
+	tempDir := r.rootPath(kTempDir)
+	if err := os.MkdirAll(tempDir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(tempDir, "write-*")
+	if err != nil {
+		return nil, err
+	}
+	return &realFSWriter{file: file, fullPath: fullPath}, nil
 }
 
 func (r *realFS) Exists(name string) bool {
-	fileInfo, err := os.Stat(r.fullPath(name))
+	fullPath, err := r.fullPath(name)
+	if err != nil {
+		return false
+	}
+	fileInfo, err := os.Stat(fullPath)
 	return err == nil && !fileInfo.IsDir()
 }
 
-func (r *realFS) fullPath(name string) string {
+func (r *realFS) Rename(oldName, newName string) error {
+	oldPath, err := r.fullPath(oldName)
+	if err != nil {
+		return err
+	}
+	fullPath, err := r.fullPath(newName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(fullPath), 0700); err != nil {
+		return err
+	}
+	return os.Rename(oldPath, fullPath)
+}
+
+func (r *realFS) Remove(name string) error {
+	fullPath, err := r.fullPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fullPath)
+}
+
+func (r *realFS) Walk(prefix string, fn func(name string) error) error {
+	dir := path.Dir(prefix + "x")
+	if dir != "." {
+		if _, err := r.fullPath(dir); err != nil {
+			return err
+		}
+	}
+	start := r.rootPath(dir)
+	err := filepath.WalkDir(
+		start,
+		func(fullPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if fullPath == start {
+				return nil
+			}
+			rel, err := filepath.Rel(r.root, fullPath)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(rel)
+			if d.IsDir() {
+				if name == kTempDir || !couldHavePrefix(name+"/", prefix) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if r.noSymlinks && d.Type()&fs.ModeSymlink != 0 {
+				return nil
+			}
+			if !strings.HasPrefix(name, prefix) {
+				return nil
+			}
+			return fn(name)
+		})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (r *realFS) Stat(name string) (fs.FileInfo, error) {
+	fullPath, err := r.fullPath(name)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	return fileInfo, nil
+}
+
+func (r *realFS) Touch(name string) error {
+	fullPath, err := r.fullPath(name)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(fullPath, now, now)
+}
+
+// fullPath returns the path on disk of the file called name. fullPath
+// returns an *InvalidPathError if name could escape root, is in the
+// temporary directory, or, if this file system doesn't follow symbolic
+// links, leads through one.
+func (r *realFS) fullPath(name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." || strings.Contains(name, `\`) {
+		return "", &InvalidPathError{Name: name, Reason: "not a valid path"}
+	}
+	if name == kTempDir || strings.HasPrefix(name, kTempDir+"/") {
+		return "", &InvalidPathError{Name: name, Reason: "reserved"}
+	}
+	if r.noSymlinks {
+		if err := r.checkNoSymlinks(name); err != nil {
+			return "", err
+		}
+	}
+	return r.rootPath(name), nil
+}
+
+// checkNoSymlinks returns an *InvalidPathError if any existing part of
+// the path to name is a symbolic link.
+func (r *realFS) checkNoSymlinks(name string) error {
+	current := r.root
+	for _, part := range strings.Split(name, "/") {
+		current = path.Join(current, part)
+		fileInfo, err := os.Lstat(current)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fileInfo.Mode()&fs.ModeSymlink != 0 {
+			return &InvalidPathError{Name: name, Reason: "symbolic link"}
+		}
+	}
+	return nil
+}
+
+// rootPath returns the path on disk of name without checking it.
+func (r *realFS) rootPath(name string) string {
 	return path.Join(r.root, name)
 }
 
+// sweepTempFiles removes temporary files that crashed writes left behind.
+// Other processes may be writing to the same root, so sweepTempFiles
+// removes only temporary files older than kTempFileMaxAge.
+func (r *realFS) sweepTempFiles() {
+	tempDir := r.rootPath(kTempDir)
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-kTempFileMaxAge)
+	for _, entry := range entries {
+		fileInfo, err := entry.Info()
+		if err != nil || !fileInfo.ModTime().Before(cutoff) {
+			continue
+		}
+		os.RemoveAll(path.Join(tempDir, entry.Name()))
+	}
+}
+
+// realFSWriter writes to a temporary file and moves it to its final
+// location on Close.
+type realFSWriter struct {
+	file     *os.File
+	fullPath string
+	done     bool
+}
+
+func (r *realFSWriter) Write(p []byte) (n int, err error) {
+	if r.done {
+		return 0, os.ErrClosed
+	}
+	return r.file.Write(p)
+}
+
+func (r *realFSWriter) Close() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	tempPath := r.file.Name()
+	err := r.file.Sync()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, r.fullPath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	syncDir(path.Dir(r.fullPath))
+	return nil
+}
+
+func (r *realFSWriter) Abort() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	r.file.Close()
+	return os.Remove(r.file.Name())
+}
+
+// syncDir flushes the directory entries of dir to disk so that renames
+// within dir survive a crash.
+func syncDir(dir string) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	file.Sync()
+}
+
+// couldHavePrefix returns true if names starting with dir could start with
+// prefix.
+func couldHavePrefix(dir, prefix string) bool {
+	return strings.HasPrefix(dir, prefix) || strings.HasPrefix(prefix, dir)
+}
+
+type fakeFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (f *fakeFileInfo) Name() string {
+	return f.name
+}
+
+func (f *fakeFileInfo) Size() int64 {
+	return f.size
+}
+
+func (f *fakeFileInfo) Mode() fs.FileMode {
+	return 0600
+}
+
+func (f *fakeFileInfo) ModTime() time.Time {
+	return f.modTime
+}
+
+func (f *fakeFileInfo) IsDir() bool {
+	return false
+}
+
+func (f *fakeFileInfo) Sys() interface{} {
+	return nil
+}
+
 type nilFS struct {
 }
 
@@ -148,6 +630,125 @@ func (n nilFS) Write(name string) (io.WriteCloser, error) {
 	return nil, os.ErrPermission
 }
 
+func (n nilFS) Walk(prefix string, fn func(name string) error) error {
+	return nil
+}
+
+func (n nilFS) Stat(name string) (fs.FileInfo, error) {
+	return nil, os.ErrNotExist
+}
+
+func (n nilFS) Remove(name string) error {
+	return os.ErrNotExist
+}
+
+// Walk calls fn with the name of each file in fileSystem that starts with
+// prefix in lexical order. If fn returns an error, Walk stops and returns
+// that same error. If fileSystem can't enumerate its files, Walk returns
+// ErrNotSupported.
+func Walk(fileSystem FS, prefix string, fn func(name string) error) error {
+	if w, ok := fileSystem.(WalkFS); ok {
+		return w.Walk(prefix, fn)
+	}
+	return ErrNotSupported
+}
+
+// List returns the names of the files in fileSystem that start with prefix
+// in lexical order. If fileSystem can't enumerate its files, List returns
+// ErrNotSupported.
+func List(fileSystem FS, prefix string) ([]string, error) {
+	var result []string
+	err := Walk(fileSystem, prefix, func(name string) error {
+		result = append(result, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Stat returns information on the named file in fileSystem. If
+// fileSystem can't stat its files, Stat reads the file to find its size
+// and reports a zero modification time.
+func Stat(fileSystem FS, name string) (fs.FileInfo, error) {
+	if s, ok := fileSystem.(StatFS); ok {
+		return s.Stat(name)
+	}
+	reader, err := fileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	size, err := io.Copy(io.Discard, reader)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeFileInfo{name: path.Base(name), size: size}, nil
+}
+
+// Remove removes the named file from fileSystem. If fileSystem can't
+// remove files, Remove returns ErrNotSupported.
+func Remove(fileSystem FS, name string) error {
+	if r, ok := fileSystem.(RemoveFS); ok {
+		return r.Remove(name)
+	}
+	return ErrNotSupported
+}
+
+// rename renames oldName to newName within fileSystem. If fileSystem
+// can't rename files, rename copies oldName to newName and then removes
+// oldName if fileSystem can remove files.
+func rename(fileSystem FS, oldName, newName string) error {
+	if r, ok := fileSystem.(RenameFS); ok {
+		return r.Rename(oldName, newName)
+	}
+	if err := copyFile(fileSystem, oldName, newName); err != nil {
+		return err
+	}
+	if r, ok := fileSystem.(RemoveFS); ok {
+		return r.Remove(oldName)
+	}
+	return nil
+}
+
+// abort discards what writer has written so far. writer is the writer
+// that fileSystem returned for name. If writer can't abort, abort closes
+// writer and then removes name.
+func abort(fileSystem FS, name string, writer io.WriteCloser) {
+	if a, ok := writer.(aborter); ok {
+		a.Abort()
+		return
+	}
+	writer.Close()
+	Remove(fileSystem, name)
+}
+
+// touch sets the modification time of name in fileSystem to now if
+// fileSystem supports it.
+func touch(fileSystem FS, name string) {
+	if t, ok := fileSystem.(toucher); ok {
+		t.Touch(name)
+	}
+}
+
+func copyFile(fileSystem FS, oldName, newName string) error {
+	reader, err := fileSystem.Open(oldName)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	writer, err := fileSystem.Write(newName)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		abort(fileSystem, newName, writer)
+		return err
+	}
+	return writer.Close()
+}
+
 type rofs interface {
 
 	// Open opens a file
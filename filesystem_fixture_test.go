@@ -0,0 +1,39 @@
+package attachments_test
+
+import (
+	"testing"
+
+	"github.com/keep94/attachments"
+	"github.com/keep94/attachments/fsfixture"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFSFixture(t *testing.T) {
+	suites := []struct {
+		name string
+		fn   func(t *testing.T, fileSystem attachments.FS)
+	}{
+		{"WriteAndOpen", fsfixture.WriteAndOpen},
+		{"Overwrite", fsfixture.Overwrite},
+		{"Exists", fsfixture.Exists},
+		{"NestedPaths", fsfixture.NestedPaths},
+		{"ConcurrentWriters", fsfixture.ConcurrentWriters},
+		{"WriteAfterClose", fsfixture.WriteAfterClose},
+		{"Abort", fsfixture.Abort},
+		{"Optional", fsfixture.Optional},
+	}
+	for _, suite := range suites {
+		t.Run("realFS/"+suite.name, func(t *testing.T) {
+			fileSystem, err := attachments.NewFS(t.TempDir())
+			require.NoError(t, err)
+			suite.fn(t, fileSystem)
+		})
+		t.Run("fakeFS/"+suite.name, func(t *testing.T) {
+			suite.fn(t, attachments.NewInMemoryFS())
+		})
+	}
+}
+
+func TestFSFixture_NilFS(t *testing.T) {
+	fsfixture.ReadOnly(t, attachments.NilFS())
+}
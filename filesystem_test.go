@@ -1,13 +1,23 @@
 package attachments
 
 import (
+	"errors"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+var (
+	errWrite = errors.New("attachments: write error")
+)
+
 func TestNilFileSystem(t *testing.T) {
 	nfs := NilFS()
 	_, err := nfs.Open("abcd")
@@ -31,3 +41,399 @@ func TestWriteEmptyFile(t *testing.T) {
 	_, err = readFile(fileSystem, "not_exists")
 	assert.Equal(t, os.ErrNotExist, err)
 }
+
+func TestWriteAbort(t *testing.T) {
+	fileSystem := NewInMemoryFS()
+	writer, err := fileSystem.Write("aborted")
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("Hello"))
+	require.NoError(t, err)
+	require.NoError(t, writer.(aborter).Abort())
+	_, err = writer.Write([]byte("Hello"))
+	assert.Equal(t, os.ErrClosed, err)
+	require.NoError(t, writer.Close())
+	assert.False(t, fileSystem.Exists("aborted"))
+}
+
+func TestRealFS(t *testing.T) {
+	root := t.TempDir()
+	fileSystem, err := NewFS(root)
+	require.NoError(t, err)
+	writer, err := fileSystem.Write("a/b/hello.txt")
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("Hello World!"))
+	require.NoError(t, err)
+
+	// File should not appear until writer is closed
+	assert.False(t, fileSystem.Exists("a/b/hello.txt"))
+	require.NoError(t, writer.Close())
+	assert.True(t, fileSystem.Exists("a/b/hello.txt"))
+	assert.False(t, fileSystem.Exists("a/b"))
+	assert.Equal(
+		t, "Hello World!", string(readBytes(fileSystem, "a/b/hello.txt")))
+	_, err = writer.Write([]byte("Hello"))
+	assert.Equal(t, os.ErrClosed, err)
+
+	// An aborted write should leave nothing behind.
+	writer, err = fileSystem.Write("a/b/aborted.txt")
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("Hello"))
+	require.NoError(t, err)
+	require.NoError(t, writer.(aborter).Abort())
+	assert.False(t, fileSystem.Exists("a/b/aborted.txt"))
+	assertNoTempFiles(t, root)
+
+	_, err = readFile(fileSystem, "not_exists")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRealFS_FailedWrite(t *testing.T) {
+	root := t.TempDir()
+	fileSystem, err := NewFS(root)
+	require.NoError(t, err)
+	failFS := &failingFS{FS: fileSystem, failAfter: 5}
+	_, err = copyFileFrom(failFS, "hello.txt", "Hello World!")
+	assert.Equal(t, errWrite, err)
+	assert.False(t, fileSystem.Exists("hello.txt"))
+	assertNoTempFiles(t, root)
+}
+
+func TestNewFS_SweepsTempFiles(t *testing.T) {
+	root := t.TempDir()
+	fileSystem, err := NewFS(root)
+	require.NoError(t, err)
+
+	// Simulate a crash in the middle of a write.
+	writer, err := fileSystem.Write("hello.txt")
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("Hello"))
+	require.NoError(t, err)
+	entries, err := os.ReadDir(filepath.Join(root, kTempDir))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Another instance on the same root leaves writes in progress alone
+	_, err = NewFS(root)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	assert.True(t, fileSystem.Exists("hello.txt"))
+
+	// Simulate a crash in the middle of a write.
+	writer, err = fileSystem.Write("goodbye.txt")
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("Goodbye"))
+	require.NoError(t, err)
+	entries, err = os.ReadDir(filepath.Join(root, kTempDir))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	old := time.Now().Add(-kTempFileMaxAge - time.Hour)
+	require.NoError(t, os.Chtimes(
+		filepath.Join(root, kTempDir, entries[0].Name()), old, old))
+
+	_, err = NewFS(root)
+	require.NoError(t, err)
+	assertNoTempFiles(t, root)
+	assert.False(t, fileSystem.Exists("goodbye.txt"))
+}
+
+func TestNewFS_NotExist(t *testing.T) {
+	_, err := NewFS(filepath.Join(t.TempDir(), "not_exists"))
+	assert.Equal(t, os.ErrNotExist, err)
+}
+
+func TestRealFS_PathTraversal(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	require.NoError(t, os.Mkdir(root, 0700))
+	secret := filepath.Join(parent, "secret")
+	require.NoError(t, os.WriteFile(secret, []byte("Secret"), 0600))
+	fileSystem, err := NewFS(root)
+	require.NoError(t, err)
+	writeString(t, fileSystem, "a/b", "Inside")
+
+	for _, name := range []string{
+		"../secret",
+		"a/../../secret",
+		"..",
+		"/etc/passwd",
+		"",
+		".",
+		"a//b",
+		"a/./b",
+		"a/",
+		"./a/b",
+		`a\..\..\secret`,
+		".tmp",
+		".tmp/write-1",
+	} {
+		_, err := fileSystem.Open(name)
+		assertInvalidPath(t, name, err)
+		_, err = fileSystem.Write(name)
+		assertInvalidPath(t, name, err)
+		assert.False(t, fileSystem.Exists(name), name)
+		_, err = Stat(fileSystem, name)
+		assertInvalidPath(t, name, err)
+		assertInvalidPath(t, name, Remove(fileSystem, name))
+		assertInvalidPath(t, name, rename(fileSystem, "a/b", name))
+		assertInvalidPath(t, name, rename(fileSystem, name, "a/c"))
+		assertInvalidPath(t, name, fileSystem.(toucher).Touch(name))
+	}
+	assert.Error(t, Walk(fileSystem, "../", func(name string) error {
+		return nil
+	}))
+
+	// Nothing escaped and nothing moved
+	contents, err := os.ReadFile(secret)
+	require.NoError(t, err)
+	assert.Equal(t, "Secret", string(contents))
+	entries, err := os.ReadDir(parent)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "Inside", string(readBytes(fileSystem, "a/b")))
+}
+
+func TestRealFS_Symlinks(t *testing.T) {
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret")
+	require.NoError(t, os.WriteFile(secret, []byte("Secret"), 0600))
+	root := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "link")))
+	require.NoError(t, os.Symlink(secret, filepath.Join(root, "filelink")))
+
+	// By default, symbolic links are followed.
+	fileSystem, err := NewFS(root)
+	require.NoError(t, err)
+	assert.Equal(t, "Secret", string(readBytes(fileSystem, "link/secret")))
+	assert.Equal(t, "Secret", string(readBytes(fileSystem, "filelink")))
+
+	fileSystem, err = NewFSWithOptions(root, &FSOptions{NoSymlinks: true})
+	require.NoError(t, err)
+	writeString(t, fileSystem, "a/b", "Inside")
+	for _, name := range []string{"link/secret", "link/new", "filelink"} {
+		_, err := fileSystem.Open(name)
+		assertInvalidPath(t, name, err)
+		_, err = fileSystem.Write(name)
+		assertInvalidPath(t, name, err)
+		assert.False(t, fileSystem.Exists(name), name)
+		_, err = Stat(fileSystem, name)
+		assertInvalidPath(t, name, err)
+		assertInvalidPath(t, name, Remove(fileSystem, name))
+		assertInvalidPath(t, name, rename(fileSystem, "a/b", name))
+		assertInvalidPath(t, name, fileSystem.(toucher).Touch(name))
+	}
+	err = Walk(fileSystem, "link/", func(name string) error { return nil })
+	assertInvalidPath(t, "link", err)
+	names, err := List(fileSystem, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/b"}, names)
+	_, err = os.Stat(filepath.Join(outside, "new"))
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	assert.Equal(t, "Inside", string(readBytes(fileSystem, "a/b")))
+}
+
+func TestEnumeration(t *testing.T) {
+	fileSystem, err := NewFS(t.TempDir())
+	require.NoError(t, err)
+	assertEnumeration(t, fileSystem)
+	assertEnumeration(t, NewInMemoryFS())
+}
+
+func TestEnumeration_NilFS(t *testing.T) {
+	nfs := NilFS()
+	names, err := List(nfs, "")
+	require.NoError(t, err)
+	assert.Empty(t, names)
+	_, err = Stat(nfs, "abcd")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	assert.True(t, errors.Is(Remove(nfs, "abcd"), fs.ErrNotExist))
+}
+
+func TestEnumeration_Fallback(t *testing.T) {
+	fileSystem := NewInMemoryFS()
+	writeString(t, fileSystem, "a/hello.txt", "Hello World!")
+	bfs := basicFS{fileSystem}
+	_, err := List(bfs, "")
+	assert.Equal(t, ErrNotSupported, err)
+	assert.Equal(t, ErrNotSupported, Walk(
+		bfs, "", func(name string) error { return nil }))
+	assert.Equal(t, ErrNotSupported, Remove(bfs, "a/hello.txt"))
+	fileInfo, err := Stat(bfs, "a/hello.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "hello.txt", fileInfo.Name())
+	assert.Equal(t, int64(12), fileInfo.Size())
+	assert.True(t, fileInfo.ModTime().IsZero())
+	_, err = Stat(bfs, "a/goodbye.txt")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func assertEnumeration(t *testing.T, fileSystem FS) {
+	writeString(t, fileSystem, "1/ab/hello.txt", "Hello World!")
+	writeString(t, fileSystem, "1/ab/goodbye.txt", "Goodbye World!")
+	writeString(t, fileSystem, "1/cd/hello.txt", "Hello")
+	writeString(t, fileSystem, "12/ab/hello.txt", "Hello")
+	writeString(t, fileSystem, "2/hello.txt", "Hello")
+
+	names, err := List(fileSystem, "")
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		[]string{
+			"1/ab/goodbye.txt",
+			"1/ab/hello.txt",
+			"1/cd/hello.txt",
+			"12/ab/hello.txt",
+			"2/hello.txt",
+		},
+		names)
+	names, err = List(fileSystem, "1/")
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		[]string{"1/ab/goodbye.txt", "1/ab/hello.txt", "1/cd/hello.txt"},
+		names)
+	names, err = List(fileSystem, "1")
+	require.NoError(t, err)
+	assert.Len(t, names, 4)
+	names, err = List(fileSystem, "1/ab/h")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1/ab/hello.txt"}, names)
+	names, err = List(fileSystem, "3/")
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	// Walk stops on error
+	var visited []string
+	err = Walk(fileSystem, "1/", func(name string) error {
+		visited = append(visited, name)
+		return errWrite
+	})
+	assert.Equal(t, errWrite, err)
+	assert.Equal(t, []string{"1/ab/goodbye.txt"}, visited)
+
+	before := time.Now().Add(-time.Minute)
+	fileInfo, err := Stat(fileSystem, "1/ab/goodbye.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "goodbye.txt", fileInfo.Name())
+	assert.Equal(t, int64(14), fileInfo.Size())
+	assert.False(t, fileInfo.IsDir())
+	assert.True(t, fileInfo.ModTime().After(before))
+	_, err = Stat(fileSystem, "1/ab")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	_, err = Stat(fileSystem, "1/ab/not_exists.txt")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	require.NoError(t, Remove(fileSystem, "1/ab/goodbye.txt"))
+	assert.True(t, errors.Is(
+		Remove(fileSystem, "1/ab/goodbye.txt"), fs.ErrNotExist))
+	names, err = List(fileSystem, "1/ab/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1/ab/hello.txt"}, names)
+}
+
+func TestRenameAndRemove(t *testing.T) {
+	fileSystem, err := NewFS(t.TempDir())
+	require.NoError(t, err)
+	assertRenameAndRemove(t, fileSystem)
+	assertRenameAndRemove(t, NewInMemoryFS())
+}
+
+func TestRenameFallback(t *testing.T) {
+	fileSystem := NewInMemoryFS()
+	writeString(t, fileSystem, "a/old", "Hello World!")
+
+	// Hide Rename and Remove from rename() so that it has to copy.
+	require.NoError(t, rename(basicFS{fileSystem}, "a/old", "b/new"))
+	assert.True(t, fileSystem.Exists("a/old"))
+	assert.Equal(t, "Hello World!", string(readBytes(fileSystem, "b/new")))
+	assert.Equal(t, ErrNotSupported, Remove(basicFS{fileSystem}, "b/new"))
+}
+
+func assertRenameAndRemove(t *testing.T, fileSystem FS) {
+	writeString(t, fileSystem, "a/old", "Hello World!")
+	require.NoError(t, rename(fileSystem, "a/old", "b/c/new"))
+	assert.False(t, fileSystem.Exists("a/old"))
+	assert.Equal(t, "Hello World!", string(readBytes(fileSystem, "b/c/new")))
+	assert.Error(t, rename(fileSystem, "a/old", "b/c/new"))
+	require.NoError(t, Remove(fileSystem, "b/c/new"))
+	assert.False(t, fileSystem.Exists("b/c/new"))
+	assert.Error(t, Remove(fileSystem, "b/c/new"))
+}
+
+func assertInvalidPath(t *testing.T, name string, err error) {
+	t.Helper()
+	var pathErr *InvalidPathError
+	if assert.True(t, errors.As(err, &pathErr), "%q: %v", name, err) {
+		assert.Equal(t, name, pathErr.Name)
+		assert.True(t, errors.Is(err, fs.ErrInvalid))
+	}
+}
+
+func writeString(t *testing.T, fileSystem FS, name, contents string) {
+	writer, err := fileSystem.Write(name)
+	require.NoError(t, err)
+	_, err = writer.Write(([]byte)(contents))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+}
+
+func copyFileFrom(fileSystem FS, name, contents string) (int64, error) {
+	writer, err := fileSystem.Write(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(writer, strings.NewReader(contents))
+	if err != nil {
+		abort(fileSystem, name, writer)
+		return 0, err
+	}
+	return n, writer.Close()
+}
+
+func assertNoTempFiles(t *testing.T, root string) {
+	entries, err := os.ReadDir(filepath.Join(root, kTempDir))
+	if os.IsNotExist(err) {
+		return
+	}
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// failingFS simulates a write that fails part way through. Writers that
+// failingFS returns fail once failAfter bytes are written.
+type failingFS struct {
+	FS
+	failAfter int
+}
+
+func (f *failingFS) Write(name string) (io.WriteCloser, error) {
+	writer, err := f.FS.Write(name)
+	if err != nil {
+		return nil, err
+	}
+	return &failingWriter{WriteCloser: writer, remaining: f.failAfter}, nil
+}
+
+type failingWriter struct {
+	io.WriteCloser
+	remaining int
+}
+
+func (f *failingWriter) Write(p []byte) (n int, err error) {
+	if len(p) <= f.remaining {
+		n, err = f.WriteCloser.Write(p)
+		f.remaining -= n
+		return
+	}
+	n, _ = f.WriteCloser.Write(p[:f.remaining])
+	f.remaining = 0
+	return n, errWrite
+}
+
+func (f *failingWriter) Abort() error {
+	return f.WriteCloser.(aborter).Abort()
+}
+
+// basicFS hides any optional methods of the underlying file system.
+type basicFS struct {
+	FS
+}
@@ -0,0 +1,260 @@
+// Package fsfixture provides test suites to test implementations of
+// attachments.FS.
+package fsfixture
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/keep94/attachments"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// WriteAndOpen tests that files appear only once their writers are
+// closed and that opening them returns what was written.
+func WriteAndOpen(t *testing.T, fileSystem attachments.FS) {
+	writer, err := fileSystem.Write("hello.txt")
+	require.NoError(t, err)
+	_, err = io.WriteString(writer, "Hello ")
+	require.NoError(t, err)
+	_, err = io.WriteString(writer, "World!")
+	require.NoError(t, err)
+	assert.False(t, fileSystem.Exists("hello.txt"))
+	require.NoError(t, writer.Close())
+	assert.True(t, fileSystem.Exists("hello.txt"))
+	assertContents(t, fileSystem, "hello.txt", "Hello World!")
+
+	// Empty files
+	writeString(t, fileSystem, "empty.txt", "")
+	assert.True(t, fileSystem.Exists("empty.txt"))
+	assertContents(t, fileSystem, "empty.txt", "")
+
+	// Closing twice is harmless
+	assert.NoError(t, writer.Close())
+	assertContents(t, fileSystem, "hello.txt", "Hello World!")
+}
+
+// Overwrite tests that writing an existing file replaces its contents.
+func Overwrite(t *testing.T, fileSystem attachments.FS) {
+	writeString(t, fileSystem, "file.txt", "A much longer first version")
+	writeString(t, fileSystem, "file.txt", "Second")
+	assertContents(t, fileSystem, "file.txt", "Second")
+
+	// Until the writer is closed, the old contents remain.
+	writer, err := fileSystem.Write("file.txt")
+	require.NoError(t, err)
+	_, err = io.WriteString(writer, "Third")
+	require.NoError(t, err)
+	assertContents(t, fileSystem, "file.txt", "Second")
+	require.NoError(t, writer.Close())
+	assertContents(t, fileSystem, "file.txt", "Third")
+}
+
+// Exists tests that Exists returns false for missing files and for
+// directories.
+func Exists(t *testing.T, fileSystem attachments.FS) {
+	assert.False(t, fileSystem.Exists("missing.txt"))
+	assert.False(t, fileSystem.Exists("missing/missing.txt"))
+	writeString(t, fileSystem, "a/b/c.txt", "Nested")
+	assert.True(t, fileSystem.Exists("a/b/c.txt"))
+	assert.False(t, fileSystem.Exists("a"))
+	assert.False(t, fileSystem.Exists("a/b"))
+	assert.False(t, fileSystem.Exists("a/b/c"))
+	assert.False(t, fileSystem.Exists("a/b/c.txt/d"))
+	_, err := fileSystem.Open("missing.txt")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	_, err = fileSystem.Open("missing/missing.txt")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+// NestedPaths tests that files can be written at any depth and that
+// files and directories can share a prefix.
+func NestedPaths(t *testing.T, fileSystem attachments.FS) {
+	names := []string{
+		"top.txt",
+		"1/ab/abcdef",
+		"1/ab/abcdeg",
+		"1/ac/acdefg",
+		"2/ab/abcdef",
+		"deep/er/and/deeper/still.txt",
+	}
+	for _, name := range names {
+		writeString(t, fileSystem, name, "Contents of "+name)
+	}
+	for _, name := range names {
+		assert.True(t, fileSystem.Exists(name), name)
+		assertContents(t, fileSystem, name, "Contents of "+name)
+	}
+}
+
+// ConcurrentWriters tests that goroutines can write at the same time and
+// that readers never see a partially written file.
+func ConcurrentWriters(t *testing.T, fileSystem attachments.FS) {
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- write(
+				fileSystem,
+				fmt.Sprintf("own/%d.txt", i),
+				strings.Repeat(fmt.Sprint(i), 10000))
+			errs <- write(
+				fileSystem, "shared.txt", strings.Repeat(fmt.Sprint(i), 10000))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	for i := 0; i < writers; i++ {
+		assertContents(
+			t,
+			fileSystem,
+			fmt.Sprintf("own/%d.txt", i),
+			strings.Repeat(fmt.Sprint(i), 10000))
+	}
+	contents := readString(t, fileSystem, "shared.txt")
+	require.Len(t, contents, 10000)
+	assert.Equal(t, strings.Repeat(contents[:1], 10000), contents)
+}
+
+// WriteAfterClose tests that writing to a closed writer fails with
+// os.ErrClosed and changes nothing.
+func WriteAfterClose(t *testing.T, fileSystem attachments.FS) {
+	writer, err := fileSystem.Write("closed.txt")
+	require.NoError(t, err)
+	_, err = io.WriteString(writer, "Before")
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	_, err = io.WriteString(writer, "After")
+	assert.True(t, errors.Is(err, os.ErrClosed))
+	assertContents(t, fileSystem, "closed.txt", "Before")
+}
+
+// Abort tests that aborting a writer, for writers that support it,
+// leaves nothing behind. Abort does nothing if the writers of fileSystem
+// can't abort.
+func Abort(t *testing.T, fileSystem attachments.FS) {
+	writeString(t, fileSystem, "kept.txt", "Kept")
+	writer, err := fileSystem.Write("kept.txt")
+	require.NoError(t, err)
+	a, ok := writer.(interface{ Abort() error })
+	if !ok {
+		writer.Close()
+		return
+	}
+	_, err = io.WriteString(writer, "Aborted")
+	require.NoError(t, err)
+	require.NoError(t, a.Abort())
+	assertContents(t, fileSystem, "kept.txt", "Kept")
+
+	writer, err = fileSystem.Write("aborted.txt")
+	require.NoError(t, err)
+	require.NoError(t, writer.(interface{ Abort() error }).Abort())
+	assert.False(t, fileSystem.Exists("aborted.txt"))
+	_, err = io.WriteString(writer, "After")
+	assert.True(t, errors.Is(err, os.ErrClosed))
+}
+
+// Optional tests the optional interfaces that fileSystem implements:
+// attachments.WalkFS, attachments.StatFS, attachments.RemoveFS, and
+// attachments.RenameFS.
+func Optional(t *testing.T, fileSystem attachments.FS) {
+	writeString(t, fileSystem, "1/ab/abc", "Hello")
+	writeString(t, fileSystem, "1/ab/abd", "World!")
+	writeString(t, fileSystem, "2/ab/abc", "Other")
+	if _, ok := fileSystem.(attachments.WalkFS); ok {
+		names, err := attachments.List(fileSystem, "1/")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1/ab/abc", "1/ab/abd"}, names)
+		names, err = attachments.List(fileSystem, "")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1/ab/abc", "1/ab/abd", "2/ab/abc"}, names)
+		names, err = attachments.List(fileSystem, "3/")
+		require.NoError(t, err)
+		assert.Empty(t, names)
+	}
+	if s, ok := fileSystem.(attachments.StatFS); ok {
+		info, err := s.Stat("1/ab/abd")
+		require.NoError(t, err)
+		assert.Equal(t, int64(6), info.Size())
+		assert.False(t, info.IsDir())
+		_, err = s.Stat("1/ab/missing")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+		_, err = s.Stat("1/ab")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+	}
+	if r, ok := fileSystem.(attachments.RenameFS); ok {
+		require.NoError(t, r.Rename("1/ab/abc", "3/cd/cde"))
+		assert.False(t, fileSystem.Exists("1/ab/abc"))
+		assertContents(t, fileSystem, "3/cd/cde", "Hello")
+		require.NoError(t, r.Rename("3/cd/cde", "1/ab/abd"))
+		assertContents(t, fileSystem, "1/ab/abd", "Hello")
+	}
+	if r, ok := fileSystem.(attachments.RemoveFS); ok {
+		require.NoError(t, r.Remove("2/ab/abc"))
+		assert.False(t, fileSystem.Exists("2/ab/abc"))
+		err := r.Remove("2/ab/abc")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+	}
+}
+
+// ReadOnly tests a file system that can't be written to such as
+// attachments.NilFS.
+func ReadOnly(t *testing.T, fileSystem attachments.FS) {
+	writer, err := fileSystem.Write("hello.txt")
+	if err == nil {
+		// Some read-only file systems fail only once the write is done.
+		io.WriteString(writer, "Hello")
+		err = writer.Close()
+	}
+	assert.True(t, errors.Is(err, fs.ErrPermission))
+	assert.False(t, fileSystem.Exists("hello.txt"))
+	_, err = fileSystem.Open("hello.txt")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func write(fileSystem attachments.FS, name, contents string) error {
+	writer, err := fileSystem.Write(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(writer, contents); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func writeString(
+	t *testing.T, fileSystem attachments.FS, name, contents string) {
+	t.Helper()
+	require.NoError(t, write(fileSystem, name, contents))
+}
+
+func readString(t *testing.T, fileSystem attachments.FS, name string) string {
+	t.Helper()
+	reader, err := fileSystem.Open(name)
+	require.NoError(t, err)
+	defer reader.Close()
+	contents, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(contents)
+}
+
+func assertContents(
+	t *testing.T, fileSystem attachments.FS, name, expected string) {
+	t.Helper()
+	assert.Equal(t, expected, readString(t, fileSystem, name))
+}
@@ -0,0 +1,303 @@
+package attachments
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/keep94/consume"
+)
+
+const (
+	// DefaultGracePeriod is the grace period CollectGarbage uses when
+	// none is specified.
+	DefaultGracePeriod = 24 * time.Hour
+)
+
+// GCOptions contains options for CollectGarbage.
+type GCOptions struct {
+
+	// CollectGarbage leaves alone blobs modified within GracePeriod so that
+	// it doesn't collect blobs of uploads still in progress. Zero means
+	// DefaultGracePeriod.
+	GracePeriod time.Duration
+
+	// If true, CollectGarbage reports what it would collect without
+	// collecting anything.
+	DryRun bool
+
+	// If true, CollectGarbage moves unreferenced blobs to a quarantine
+	// area, OwnerId/quarantine/Checksum, instead of removing them.
+	Quarantine bool
+}
+
+func (o *GCOptions) gracePeriod() time.Duration {
+	if o == nil || o.GracePeriod == 0 {
+		return DefaultGracePeriod
+	}
+	return o.GracePeriod
+}
+
+func (o *GCOptions) dryRun() bool {
+	return o != nil && o.DryRun
+}
+
+func (o *GCOptions) quarantine() bool {
+	return o != nil && o.Quarantine
+}
+
+// GCReport reports what CollectGarbage found.
+type GCReport struct {
+
+	// The number of blobs examined
+	Scanned int
+
+	// The IDs of the unreferenced blobs collected. In a dry run,
+	// the IDs of the unreferenced blobs that would be collected. Blob IDs
+	// are the checksums of the data unless the owner has a NameKey.
+	Collected []string
+
+	// The total size in bytes of the blobs in Collected
+	CollectedBytes int64
+
+	// The IDs of the unreferenced blobs left alone because they
+	// are within the grace period.
+	Recent []string
+
+	// The paths of leftover staging files collected. In a dry run,
+	// the paths of leftover staging files that would be collected.
+	Staging []string
+}
+
+// CollectGarbage removes the blobs on fileSystem belonging to owner that no
+// entry in store references. Entries marked deleted still reference their
+// blobs since Purge takes care of those. CollectGarbage also removes staging
+// files that uploads which never finished left behind. options may be nil.
+// If owner has a NameKey, CollectGarbage reads all of the owner's entries
+// from store up front to learn which blob names are in use.
+// CollectGarbage stats each unreferenced blob again right before
+// collecting it and leaves it alone if a Write touched it in the meantime.
+// CollectGarbage returns ErrNotSupported if fileSystem can't list and stat
+// its files.
+func CollectGarbage(
+	fileSystem FS,
+	store Store,
+	owner Owner,
+	options *GCOptions) (*GCReport, error) {
+	s, ok := fileSystem.(StatFS)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	deleteStore, ok := store.(DeleteStore)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	tombstoned, err := tombstonedChecksums(deleteStore, owner.Id)
+	if err != nil {
+		return nil, err
+	}
+	var checksums map[string]string
+	if owner.NameKey != nil {
+		checksums, err = checksumsByBlobId(store, owner)
+		if err != nil {
+			return nil, err
+		}
+	}
+	collector := &garbageCollector{
+		checksums:  checksums,
+		fileSystem: fileSystem,
+		statFS:     s,
+		store:      deleteStore,
+		ownerId:    owner.Id,
+		tombstoned: tombstoned,
+		options:    options,
+		cutoff:     time.Now().Add(-options.gracePeriod()),
+		report:     &GCReport{},
+	}
+	err = Walk(fileSystem, fmt.Sprintf("%d/", owner.Id), collector.visit)
+	if err != nil {
+		return nil, err
+	}
+	return collector.report, nil
+}
+
+type garbageCollector struct {
+	checksums  map[string]string
+	fileSystem FS
+	statFS     StatFS
+	store      DeleteStore
+	ownerId    int64
+	tombstoned map[string]bool
+	options    *GCOptions
+	cutoff     time.Time
+	report     *GCReport
+}
+
+func (g *garbageCollector) visit(name string) error {
+	if strings.HasPrefix(name, fmt.Sprintf("%d/staging/", g.ownerId)) {
+		return g.visitStaging(name)
+	}
+	id, ok := pathToId(name, g.ownerId)
+	if !ok {
+		return nil
+	}
+	g.report.Scanned++
+
+	// A Write that dedups against this blob touches it before adding its
+	// entry. Stat before checking references and again right before
+	// collecting so that such a Write is either seen as a reference or as
+	// a change in the modification time.
+	fileInfo, recent, err := g.stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	referenced, err := g.referenced(id)
+	if err != nil {
+		return err
+	}
+	if referenced {
+		return nil
+	}
+	if !recent {
+		recent, err = g.touched(name, fileInfo)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if recent {
+		g.report.Recent = append(g.report.Recent, id)
+		return nil
+	}
+	if err := g.collect(name, id); err != nil {
+		return err
+	}
+	g.report.Collected = append(g.report.Collected, id)
+	g.report.CollectedBytes += fileInfo.Size()
+	return nil
+}
+
+// referenced returns true if an entry references the blob with given ID.
+func (g *garbageCollector) referenced(id string) (bool, error) {
+	checksum := id
+	if g.checksums != nil {
+		var ok bool
+		checksum, ok = g.checksums[id]
+		if !ok {
+			return false, nil
+		}
+	}
+	if g.tombstoned[checksum] {
+		return true, nil
+	}
+	count, err := g.store.CountEntriesByChecksum(nil, g.ownerId, checksum)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (g *garbageCollector) visitStaging(name string) error {
+	_, recent, err := g.stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if recent {
+		return nil
+	}
+	if !g.options.dryRun() {
+		err := Remove(g.fileSystem, name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	g.report.Staging = append(g.report.Staging, name)
+	return nil
+}
+
+// stat returns information on name and whether name is within the
+// grace period.
+func (g *garbageCollector) stat(name string) (fs.FileInfo, bool, error) {
+	fileInfo, err := g.statFS.Stat(name)
+	if err != nil {
+		return nil, false, err
+	}
+	return fileInfo, fileInfo.ModTime().After(g.cutoff), nil
+}
+
+// touched returns true if name was modified since fileInfo was taken.
+func (g *garbageCollector) touched(
+	name string, fileInfo fs.FileInfo) (bool, error) {
+	latest, err := g.statFS.Stat(name)
+	if err != nil {
+		return false, err
+	}
+	return !latest.ModTime().Equal(fileInfo.ModTime()), nil
+}
+
+func (g *garbageCollector) collect(name, id string) error {
+	if g.options.dryRun() {
+		return nil
+	}
+	var err error
+	if g.options.quarantine() {
+		err = rename(g.fileSystem, name, quarantinePath(id, g.ownerId))
+	} else {
+		err = Remove(g.fileSystem, name)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func tombstonedChecksums(
+	store DeleteStore, ownerId int64) (map[string]bool, error) {
+	result := make(map[string]bool)
+	consumer := consume.ConsumerFunc(func(ptr interface{}) {
+		result[ptr.(*Entry).Checksum] = true
+	})
+	if err := store.TombstonedEntries(nil, ownerId, consumer); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// checksumsByBlobId maps the IDs of the blobs that owner's entries
+// reference to their checksums. Since MigrateBlobNames may still be in
+// progress, the returned map includes the IDs the blobs had before they
+// were renamed.
+func checksumsByBlobId(store Store, owner Owner) (map[string]string, error) {
+	checksums, err := referencedChecksums(store, owner.Id)
+	if err != nil {
+		return nil, err
+	}
+	a := &aesFS{Owner: owner}
+	result := make(map[string]string)
+	for _, checksum := range checksums {
+		binaryId, err := hex.DecodeString(checksum)
+		if err != nil {
+			continue
+		}
+		result[a.blobId(binaryId)] = checksum
+		result[checksum] = checksum
+	}
+	return result, nil
+}
+
+// quarantinePath returns where CollectGarbage moves the unreferenced blob
+// with given ID.
+func quarantinePath(id string, ownerId int64) string {
+	return fmt.Sprintf("%d/quarantine/%s", ownerId, id)
+}
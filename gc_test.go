@@ -0,0 +1,196 @@
+package attachments
+
+import (
+	"fmt"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/keep94/toolbox/kdf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	fileSystem, err := NewFS(t.TempDir())
+	require.NoError(t, err)
+	assertCollectGarbage(t, fileSystem)
+	assertCollectGarbage(t, NewInMemoryFS())
+}
+
+func TestCollectGarbage_Quarantine(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	owner := Owner{Id: 1, Key: kdf.Random(32)}
+	orphanId, err := (&aesFS{FileSystem: fakeFs, Owner: owner}).Write(
+		([]byte)("Orphan"))
+	require.NoError(t, err)
+	report, err := CollectGarbage(
+		fakeFs,
+		store,
+		owner,
+		&GCOptions{GracePeriod: time.Nanosecond, Quarantine: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{orphanId}, report.Collected)
+	assert.False(t, fakeFs.Exists(idToPath(orphanId, 1)))
+	assert.True(t, fakeFs.Exists(quarantinePath(orphanId, 1)))
+
+	// Quarantined blobs are not scanned again
+	report, err = CollectGarbage(
+		fakeFs,
+		store,
+		owner,
+		&GCOptions{GracePeriod: time.Nanosecond, Quarantine: true})
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Scanned)
+	assert.Empty(t, report.Collected)
+}
+
+func TestCollectGarbage_NotSupported(t *testing.T) {
+	_, err := CollectGarbage(
+		basicFS{NewInMemoryFS()}, NewInMemoryStore(), Owner{Id: 1}, nil)
+	assert.Equal(t, ErrNotSupported, err)
+}
+
+func TestCollectGarbage_NotDeleteStore(t *testing.T) {
+	_, err := CollectGarbage(
+		NewInMemoryFS(), plainStore{NewInMemoryStore()}, Owner{Id: 1}, nil)
+	assert.Equal(t, ErrNotSupported, err)
+}
+
+func TestCollectGarbage_DBError(t *testing.T) {
+	_, err := CollectGarbage(NewInMemoryFS(), errorStore{}, Owner{Id: 1}, nil)
+	assert.Equal(t, errDatabase, err)
+}
+
+func TestCollectGarbage_WriteDuringGC(t *testing.T) {
+	owner := Owner{Id: 1, Key: kdf.Random(32)}
+	fakeFs := &statHookFS{fakeFS: NewInMemoryFS().(*fakeFS)}
+	rawFs := &aesFS{FileSystem: fakeFs, Owner: owner}
+	orphanId, err := rawFs.Write(([]byte)("Orphan"))
+	require.NoError(t, err)
+
+	// A Write of the same contents dedups against the blob right after
+	// GC stats it but before the Write adds its entry.
+	fakeFs.afterStat = func() {
+		fakeFs.afterStat = nil
+		_, err := rawFs.Write(([]byte)("Orphan"))
+		require.NoError(t, err)
+	}
+	report, err := CollectGarbage(
+		fakeFs,
+		NewInMemoryStore(),
+		owner,
+		&GCOptions{GracePeriod: time.Nanosecond})
+	require.NoError(t, err)
+	assert.Empty(t, report.Collected)
+	assert.Equal(t, []string{orphanId}, report.Recent)
+	assert.True(t, fakeFs.Exists(idToPath(orphanId, 1)))
+
+	// Once nothing touches the blob, GC collects it.
+	report, err = CollectGarbage(
+		fakeFs,
+		NewInMemoryStore(),
+		owner,
+		&GCOptions{GracePeriod: time.Nanosecond})
+	require.NoError(t, err)
+	assert.Equal(t, []string{orphanId}, report.Collected)
+	assert.False(t, fakeFs.Exists(idToPath(orphanId, 1)))
+}
+
+func assertCollectGarbage(t *testing.T, fileSystem FS) {
+	store := NewInMemoryStore()
+	owner := Owner{Id: 1, Key: kdf.Random(32)}
+	immutableFs := NewImmutableFS(fileSystem, store, owner)
+	otherFs := NewImmutableFS(fileSystem, store, Owner{Id: 2})
+	rawFs := &aesFS{FileSystem: fileSystem, Owner: owner}
+
+	helloId, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	goodbyeId, err := immutableFs.Write(
+		"goodbye.txt", ([]byte)("Goodbye World!"))
+	require.NoError(t, err)
+	_, err = otherFs.Write("orphan.txt", ([]byte)("Orphan"))
+	require.NoError(t, err)
+	require.NoError(t, immutableFs.Delete(goodbyeId))
+
+	// Simulate blob written without an entry
+	orphanId, err := rawFs.Write(([]byte)("Orphan"))
+	require.NoError(t, err)
+
+	// Simulate an upload that never finished
+	stagingName, err := stagingPath(1)
+	require.NoError(t, err)
+	writeString(t, fileSystem, stagingName, "Partial")
+
+	// Everything is within the grace period
+	report, err := CollectGarbage(fileSystem, store, owner, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Scanned)
+	assert.Empty(t, report.Collected)
+	assert.Equal(t, []string{orphanId}, report.Recent)
+	assert.Empty(t, report.Staging)
+
+	// Dry run
+	orphanInfo, err := Stat(fileSystem, idToPath(orphanId, 1))
+	require.NoError(t, err)
+	report, err = CollectGarbage(
+		fileSystem,
+		store,
+		owner,
+		&GCOptions{GracePeriod: time.Nanosecond, DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Scanned)
+	assert.Equal(t, []string{orphanId}, report.Collected)
+	assert.Equal(t, orphanInfo.Size(), report.CollectedBytes)
+	assert.Empty(t, report.Recent)
+	assert.Equal(t, []string{stagingName}, report.Staging)
+	assert.True(t, fileSystem.Exists(idToPath(orphanId, 1)))
+	assert.True(t, fileSystem.Exists(stagingName))
+
+	// For real
+	report, err = CollectGarbage(
+		fileSystem, store, owner, &GCOptions{GracePeriod: time.Nanosecond})
+	require.NoError(t, err)
+	assert.Equal(t, []string{orphanId}, report.Collected)
+	assert.Equal(t, []string{stagingName}, report.Staging)
+	assert.False(t, fileSystem.Exists(idToPath(orphanId, 1)))
+	assert.False(t, fileSystem.Exists(stagingName))
+
+	// Referenced blobs and blobs of other owners are untouched
+	contents, err := fs.ReadFile(
+		immutableFs, fmt.Sprintf("%d/hello.txt", helloId))
+	require.NoError(t, err)
+	assert.Equal(t, "Hello World!", string(contents))
+	contents, err = fs.ReadFile(otherFs, "3/orphan.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "Orphan", string(contents))
+
+	// Deleted entries still reference their blobs until purged. Purge
+	// keeps deleted entries whose blobs are within its grace period.
+	require.NoError(t, immutableFs.Purge())
+	assert.True(
+		t, fileSystem.Exists(idToPath(checksumOf("Goodbye World!"), 1)))
+	report, err = CollectGarbage(
+		fileSystem, store, owner, &GCOptions{GracePeriod: time.Nanosecond})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Scanned)
+	assert.Empty(t, report.Collected)
+	require.NoError(t, newPurgingImmutableFS(fileSystem, store, owner).Purge())
+	assert.False(
+		t, fileSystem.Exists(idToPath(checksumOf("Goodbye World!"), 1)))
+}
+
+// statHookFS calls afterStat, if set, each time Stat returns.
+type statHookFS struct {
+	*fakeFS
+	afterStat func()
+}
+
+func (f *statHookFS) Stat(name string) (fs.FileInfo, error) {
+	fileInfo, err := f.fakeFS.Stat(name)
+	if f.afterStat != nil {
+		f.afterStat()
+	}
+	return fileInfo, err
+}
@@ -0,0 +1,480 @@
+package attachments
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// Encrypted blobs are stored in the following format. All integers are
+// big endian.
+//
+//	magic (8 bytes) kMagic
+//	version (1 byte) kGCMVersion or kEnvelopeVersion
+//	chunk size (4 bytes) number of plaintext bytes in each full chunk
+//	key id (8 bytes) identifies the owner key, see keyId()
+//
+// In version kGCMVersion the header continues with
+//
+//	salt (16 bytes) random bytes used to derive the content key from the
+//	    owner key, see blobKey()
+//
+// In version kEnvelopeVersion the header continues with
+//
+//	wrapped key (kWrappedKeySize bytes) the random content key of the
+//	    blob sealed with the owner key, see wrapKey()
+//
+// The chunks follow the header. Each chunk is the plaintext sealed with
+// AES-GCM under the content key. The additional data is the entire header
+// in version kGCMVersion but only the magic, version, and chunk size in
+// version kEnvelopeVersion so that the content key can be rewrapped with a
+// different owner key without touching the chunks. The nonce of each chunk
+// is the zero based chunk number in the first 8 bytes followed by 3 zero
+// bytes followed by 1 for the final chunk or 0 otherwise. All chunks but
+// the final chunk hold exactly chunk size bytes of plaintext. The final
+// chunk holds fewer, possibly zero, bytes. This way truncating,
+// reordering, or tampering with chunks causes reads to fail.
+//
+// Blobs written before this format existed are encrypted with AES-CFB and
+// have no header.
+const (
+	kMagic              = "\x8fATTACH\n"
+	kGCMVersion         = 1
+	kEnvelopeVersion    = 2
+	kChunkSize          = 64 * 1024
+	kKeyIdSize          = 8
+	kSaltSize           = 16
+	kNonceSize          = 12
+	kDataKeySize        = 32
+	kTagSize            = 16
+	kWrappedKeySize     = kNonceSize + kDataKeySize + kTagSize
+	kPrefixSize         = len(kMagic) + 1 + 4 + kKeyIdSize
+	kHeaderSize         = kPrefixSize + kSaltSize
+	kEnvelopeHeaderSize = kPrefixSize + kWrappedKeySize
+	kMaxChunkLen        = 16 * 1024 * 1024
+)
+
+var (
+	// Indicates that stored data is corrupt or was tampered with.
+	ErrCorrupt = errors.New("attachments: Data corrupt or tampered with")
+
+	// Indicates that stored data was encrypted with a different key.
+	ErrWrongKey = errors.New("attachments: Wrong encryption key")
+)
+
+// blobHeader represents the header of an encrypted blob.
+type blobHeader struct {
+	Version    byte
+	ChunkSize  uint32
+	KeyId      [kKeyIdSize]byte
+	Salt       [kSaltSize]byte
+	WrappedKey [kWrappedKeySize]byte
+}
+
+// size returns the size of the marshalled header.
+func (h *blobHeader) size() int {
+	if h.Version == kEnvelopeVersion {
+		return kEnvelopeHeaderSize
+	}
+	return kHeaderSize
+}
+
+func (h *blobHeader) marshal() []byte {
+	result := make([]byte, 0, h.size())
+	result = append(result, kMagic...)
+	result = append(result, h.Version)
+	var chunkSize [4]byte
+	binary.BigEndian.PutUint32(chunkSize[:], h.ChunkSize)
+	result = append(result, chunkSize[:]...)
+	result = append(result, h.KeyId[:]...)
+	if h.Version == kEnvelopeVersion {
+		return append(result, h.WrappedKey[:]...)
+	}
+	return append(result, h.Salt[:]...)
+}
+
+func (h *blobHeader) unmarshal(data []byte) error {
+	if len(data) < kPrefixSize || !hasMagic(data) {
+		return ErrCorrupt
+	}
+	h.Version = data[len(kMagic)]
+	if h.Version != kGCMVersion && h.Version != kEnvelopeVersion {
+		return ErrCorrupt
+	}
+	if len(data) != h.size() {
+		return ErrCorrupt
+	}
+	data = data[len(kMagic)+1:]
+	h.ChunkSize = binary.BigEndian.Uint32(data[:4])
+	if h.ChunkSize == 0 || h.ChunkSize > kMaxChunkLen {
+		return ErrCorrupt
+	}
+	copy(h.KeyId[:], data[4:4+kKeyIdSize])
+	if h.Version == kEnvelopeVersion {
+		copy(h.WrappedKey[:], data[4+kKeyIdSize:])
+	} else {
+		copy(h.Salt[:], data[4+kKeyIdSize:])
+	}
+	return nil
+}
+
+// readBlobHeader reads a header from reader. readBlobHeader returns the
+// header along with its marshalled form. If reader doesn't start with a
+// valid header, readBlobHeader returns ErrCorrupt.
+func readBlobHeader(reader io.Reader) (*blobHeader, []byte, error) {
+	headerBytes := make([]byte, kPrefixSize, kEnvelopeHeaderSize)
+	if _, err := io.ReadFull(reader, headerBytes); err != nil {
+		return nil, nil, eofToCorrupt(err)
+	}
+	var header blobHeader
+	header.Version = headerBytes[len(kMagic)]
+	headerBytes = headerBytes[:header.size()]
+	if _, err := io.ReadFull(reader, headerBytes[kPrefixSize:]); err != nil {
+		return nil, nil, eofToCorrupt(err)
+	}
+	if err := header.unmarshal(headerBytes); err != nil {
+		return nil, nil, err
+	}
+	return &header, headerBytes, nil
+}
+
+// blobSize returns the size of a complete blob with this header that holds
+// plainSize bytes of plaintext. Every blob ends with a final chunk which
+// may be empty.
+func (h *blobHeader) blobSize(plainSize int64) int64 {
+	chunks := plainSize/int64(h.ChunkSize) + 1
+	return int64(h.size()) + plainSize + chunks*kTagSize
+}
+
+// additionalData returns the additional data for the chunks of a blob.
+// headerBytes is the marshalled form of h.
+func (h *blobHeader) additionalData(headerBytes []byte) []byte {
+	if h.Version == kEnvelopeVersion {
+		return headerBytes[:len(kMagic)+1+4]
+	}
+	return headerBytes
+}
+
+// contentKey returns the key that encrypts the chunks of a blob. key is
+// the owner key.
+func (h *blobHeader) contentKey(key []byte) ([]byte, error) {
+	if h.Version == kEnvelopeVersion {
+		return unwrapKey(key, h.WrappedKey[:])
+	}
+	return blobKey(key, h.Salt[:]), nil
+}
+
+// newAEAD returns the AEAD that decrypts the chunks of a blob using
+// whichever of keys the blob was encrypted with. newAEAD returns
+// ErrWrongKey if the blob was encrypted with none of keys.
+func (h *blobHeader) newAEAD(keys [][]byte) (cipher.AEAD, error) {
+	key := findKey(h.KeyId, keys)
+	if key == nil {
+		return nil, ErrWrongKey
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	contentKey, err := h.contentKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return newContentAEAD(contentKey)
+}
+
+func eofToCorrupt(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrCorrupt
+	}
+	return err
+}
+
+// hasMagic returns true if data starts with kMagic.
+func hasMagic(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(kMagic))
+}
+
+// keyId returns the id of an owner key as stored in blob headers.
+func keyId(key []byte) [kKeyIdSize]byte {
+	var result [kKeyIdSize]byte
+	copy(result[:], hmacSum(key, "attachments key id"))
+	return result
+}
+
+// findKey returns the key among keys with given id or nil if there is none.
+func findKey(id [kKeyIdSize]byte, keys [][]byte) []byte {
+	for _, key := range keys {
+		if keyId(key) == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// blobKey derives the key for a single blob from the owner key and the
+// salt in the blob header. The blob key is the same length as key.
+func blobKey(key []byte, salt []byte) []byte {
+	return hmacSum(key, "attachments blob key", salt)[:len(key)]
+}
+
+// wrapKey seals dataKey with the owner key so that it can be stored in a
+// blob header.
+func wrapKey(key, dataKey []byte) ([]byte, error) {
+	aead, err := newWrapAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(kNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+// unwrapKey is the inverse of wrapKey.
+func unwrapKey(key, wrappedKey []byte) ([]byte, error) {
+	aead, err := newWrapAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := aead.Open(
+		nil, wrappedKey[:kNonceSize], wrappedKey[kNonceSize:], nil)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return dataKey, nil
+}
+
+func newWrapAEAD(key []byte) (cipher.AEAD, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(
+		hmacSum(key, "attachments wrap key")[:len(key)])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func hmacSum(key []byte, label string, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func newContentAEAD(contentKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(counter uint64, final bool) []byte {
+	result := make([]byte, kNonceSize)
+	binary.BigEndian.PutUint64(result, counter)
+	if final {
+		result[kNonceSize-1] = 1
+	}
+	return result
+}
+
+// gcmWriter encrypts what is written to it in the GCM format.
+type gcmWriter struct {
+	writer  io.WriteCloser
+	aead    cipher.AEAD
+	aad     []byte
+	buffer  []byte
+	sealed  []byte
+	counter uint64
+	closed  bool
+}
+
+// newGCMWriter returns a writer that encrypts what is written to it using
+// key and writes the result to writer. If envelope is true, the returned
+// writer encrypts with a random content key that it stores wrapped with
+// key in the header. Closing the returned writer closes writer.
+func newGCMWriter(
+	writer io.WriteCloser, key []byte, envelope bool) (*gcmWriter, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	header := blobHeader{
+		Version:   kGCMVersion,
+		ChunkSize: kChunkSize,
+		KeyId:     keyId(key),
+	}
+	var contentKey []byte
+	if envelope {
+		header.Version = kEnvelopeVersion
+		var err error
+		contentKey, err = randomBytes(kDataKeySize)
+		if err != nil {
+			return nil, err
+		}
+		wrappedKey, err := wrapKey(key, contentKey)
+		if err != nil {
+			return nil, err
+		}
+		copy(header.WrappedKey[:], wrappedKey)
+	} else {
+		salt, err := randomBytes(kSaltSize)
+		if err != nil {
+			return nil, err
+		}
+		copy(header.Salt[:], salt)
+		contentKey = blobKey(key, salt)
+	}
+	aead, err := newContentAEAD(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	headerBytes := header.marshal()
+	if _, err := writer.Write(headerBytes); err != nil {
+		return nil, err
+	}
+	return &gcmWriter{
+		writer: writer,
+		aead:   aead,
+		aad:    header.additionalData(headerBytes),
+		buffer: make([]byte, 0, kChunkSize),
+	}, nil
+}
+
+func (g *gcmWriter) Write(p []byte) (n int, err error) {
+	if g.closed {
+		return 0, os.ErrClosed
+	}
+	for len(p) > 0 {
+		count := copy(g.buffer[len(g.buffer):cap(g.buffer)], p)
+		g.buffer = g.buffer[:len(g.buffer)+count]
+		p = p[count:]
+		n += count
+		if len(g.buffer) == cap(g.buffer) {
+			if err := g.flush(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the final chunk and closes the underlying writer. If
+// writing the final chunk fails, Close aborts the underlying writer if it
+// can rather than committing truncated data.
+func (g *gcmWriter) Close() error {
+	if g.closed {
+		return nil
+	}
+	if err := g.finish(); err != nil {
+		if a, ok := g.writer.(aborter); ok {
+			a.Abort()
+		} else {
+			g.writer.Close()
+		}
+		return err
+	}
+	return g.writer.Close()
+}
+
+// finish writes the final chunk without closing the underlying writer.
+// The caller must then close or abort the underlying writer.
+func (g *gcmWriter) finish() error {
+	if g.closed {
+		return os.ErrClosed
+	}
+	g.closed = true
+	return g.flush(true)
+}
+
+func (g *gcmWriter) flush(final bool) error {
+	g.sealed = g.aead.Seal(
+		g.sealed[:0], chunkNonce(g.counter, final), g.buffer, g.aad)
+	g.counter++
+	g.buffer = g.buffer[:0]
+	_, err := g.writer.Write(g.sealed)
+	return err
+}
+
+// gcmReader decrypts data in the GCM format.
+type gcmReader struct {
+	reader  io.Reader
+	aead    cipher.AEAD
+	aad     []byte
+	buffer  []byte
+	plain   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+// newGCMReader returns a reader that decrypts the data in reader using
+// whichever of keys the data was encrypted with. newGCMReader returns
+// ErrWrongKey if the data in reader was encrypted with none of keys.
+func newGCMReader(reader io.Reader, keys ...[]byte) (*gcmReader, error) {
+	header, headerBytes, err := readBlobHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := header.newAEAD(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmReader{
+		reader: reader,
+		aead:   aead,
+		aad:    header.additionalData(headerBytes),
+		buffer: make([]byte, int(header.ChunkSize)+aead.Overhead()),
+	}, nil
+}
+
+func (g *gcmReader) Read(p []byte) (n int, err error) {
+	for len(g.plain) == 0 {
+		if g.err != nil {
+			return 0, g.err
+		}
+		g.err = g.readChunk()
+	}
+	n = copy(p, g.plain)
+	g.plain = g.plain[n:]
+	return n, nil
+}
+
+func (g *gcmReader) readChunk() error {
+	if g.done {
+		// Make sure nothing follows the final chunk
+		var extra [1]byte
+		n, err := io.ReadFull(g.reader, extra[:])
+		if n > 0 {
+			return ErrCorrupt
+		}
+		if err != io.EOF {
+			return err
+		}
+		return io.EOF
+	}
+	n, err := io.ReadFull(g.reader, g.buffer)
+	final := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !final {
+		return err
+	}
+	plain, err := g.aead.Open(
+		g.buffer[:0], chunkNonce(g.counter, final), g.buffer[:n], g.aad)
+	if err != nil {
+		return ErrCorrupt
+	}
+	g.counter++
+	g.plain = plain
+	g.done = final
+	return nil
+}
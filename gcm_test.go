@@ -0,0 +1,174 @@
+package attachments
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/keep94/toolbox/kdf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGCM(t *testing.T) {
+	assertGCM(t, false, kHeaderSize)
+	assertGCM(t, true, kEnvelopeHeaderSize)
+}
+
+func TestGCM_Envelope(t *testing.T) {
+	key1 := kdf.Random(32)
+	key2 := kdf.Random(16)
+	contents := kdf.Random(kChunkSize + 10)
+	encrypted := gcmEncryptEnvelope(t, key1, contents)
+	assert.Equal(t, byte(kEnvelopeVersion), encrypted[len(kMagic)])
+
+	// Rewrapping the data key with a different owner key leaves the
+	// chunks alone.
+	header, headerBytes, err := readBlobHeader(bytes.NewReader(encrypted))
+	require.NoError(t, err)
+	dataKey, err := header.contentKey(key1)
+	require.NoError(t, err)
+	header.KeyId = keyId(key2)
+	wrappedKey, err := wrapKey(key2, dataKey)
+	require.NoError(t, err)
+	copy(header.WrappedKey[:], wrappedKey)
+	rewrapped := append(header.marshal(), encrypted[len(headerBytes):]...)
+	decrypted, err := gcmDecrypt(key2, rewrapped)
+	require.NoError(t, err)
+	assert.Equal(t, contents, decrypted)
+	_, err = gcmDecrypt(key1, rewrapped)
+	assert.Equal(t, ErrWrongKey, err)
+
+	// Tampering with the wrapped key
+	encrypted[kEnvelopeHeaderSize-1] ^= 1
+	_, err = gcmDecrypt(key1, encrypted)
+	assert.Equal(t, ErrCorrupt, err)
+}
+
+func TestGCM_DifferentEachTime(t *testing.T) {
+	key := kdf.Random(16)
+	contents := []byte("Hello World!")
+	assert.NotEqual(
+		t, gcmEncrypt(t, key, contents), gcmEncrypt(t, key, contents))
+}
+
+func TestGCM_WrongKey(t *testing.T) {
+	encrypted := gcmEncrypt(t, kdf.Random(32), []byte("Hello World!"))
+	_, err := gcmDecrypt(kdf.Random(32), encrypted)
+	assert.Equal(t, ErrWrongKey, err)
+}
+
+func TestGCM_BadKeySize(t *testing.T) {
+	_, err := newGCMWriter(
+		nopWriteCloser{&bytes.Buffer{}}, kdf.Random(25), false)
+	assert.Error(t, err)
+	_, err = newGCMWriter(
+		nopWriteCloser{&bytes.Buffer{}}, kdf.Random(25), true)
+	assert.Error(t, err)
+}
+
+func TestGCM_Tampering(t *testing.T) {
+	key := kdf.Random(32)
+	contents := kdf.Random(kChunkSize + 10)
+	encrypted := gcmEncrypt(t, key, contents)
+
+	// Tampering with the header
+	for _, index := range []int{0, len(kMagic), len(kMagic) + 2, kHeaderSize - 1} {
+		tampered := append([]byte(nil), encrypted...)
+		tampered[index] ^= 1
+		_, err := gcmDecrypt(key, tampered)
+		assert.Error(t, err)
+	}
+
+	// Truncating
+	for _, size := range []int{0, 5, kHeaderSize, kHeaderSize + 10, len(encrypted) - 1} {
+		_, err := gcmDecrypt(key, encrypted[:size])
+		assert.Equal(t, ErrCorrupt, err)
+	}
+
+	// Trailing data
+	extended := append(append([]byte(nil), encrypted...), 0)
+	_, err := gcmDecrypt(key, extended)
+	assert.Equal(t, ErrCorrupt, err)
+
+	// Dropping the final chunk
+	_, err = gcmDecrypt(key, encrypted[:kHeaderSize+kChunkSize+16])
+	assert.Equal(t, ErrCorrupt, err)
+}
+
+func TestGCM_ReadPartial(t *testing.T) {
+	key := kdf.Random(32)
+	contents := kdf.Random(2*kChunkSize + 10)
+	encrypted := gcmEncrypt(t, key, contents)
+
+	// Tamper with the final chunk. Data before it should still be
+	// readable, but we should get an error instead of EOF at the end.
+	encrypted[len(encrypted)-1] ^= 1
+	reader, err := newGCMReader(bytes.NewReader(encrypted), key)
+	require.NoError(t, err)
+	decrypted := make([]byte, 2*kChunkSize)
+	_, err = io.ReadFull(reader, decrypted)
+	require.NoError(t, err)
+	assert.Equal(t, contents[:2*kChunkSize], decrypted)
+	_, err = reader.Read(decrypted)
+	assert.Equal(t, ErrCorrupt, err)
+}
+
+func assertGCM(t *testing.T, envelope bool, headerSize int) {
+	key := kdf.Random(32)
+	sizes := []int{
+		0, 1, kChunkSize - 1, kChunkSize, kChunkSize + 1, 3 * kChunkSize}
+	for _, size := range sizes {
+		contents := kdf.Random(size)
+		encrypted := gcmEncryptWith(t, key, contents, envelope)
+		assert.Len(
+			t, encrypted, headerSize+size+(size/kChunkSize+1)*16)
+		decrypted, err := gcmDecrypt(key, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, contents, decrypted)
+	}
+}
+
+func gcmEncrypt(t *testing.T, key, contents []byte) []byte {
+	return gcmEncryptWith(t, key, contents, false)
+}
+
+func gcmEncryptEnvelope(t *testing.T, key, contents []byte) []byte {
+	return gcmEncryptWith(t, key, contents, true)
+}
+
+func gcmEncryptWith(
+	t *testing.T, key, contents []byte, envelope bool) []byte {
+	var buffer bytes.Buffer
+	writer, err := newGCMWriter(nopWriteCloser{&buffer}, key, envelope)
+	require.NoError(t, err)
+
+	// Write in odd sized pieces to exercise buffering
+	for len(contents) > 0 {
+		n := 1000
+		if n > len(contents) {
+			n = len(contents)
+		}
+		_, err := writer.Write(contents[:n])
+		require.NoError(t, err)
+		contents = contents[n:]
+	}
+	require.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func gcmDecrypt(key, encrypted []byte) ([]byte, error) {
+	reader, err := newGCMReader(bytes.NewReader(encrypted), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (n nopWriteCloser) Close() error {
+	return nil
+}
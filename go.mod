@@ -1,9 +1,19 @@
 module github.com/keep94/attachments
 
-go 1.16
+go 1.18
 
 require (
+	github.com/keep94/consume v0.5.0
 	github.com/keep94/gosqlite v1.0.0
 	github.com/keep94/toolbox v0.5.1
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/text v0.16.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -1,21 +1,32 @@
 package attachments
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/keep94/attachments/internal/idlist"
+	"github.com/keep94/consume"
 	"github.com/keep94/toolbox/db"
 )
 
 var (
 	// Indicates that the Id does not exist in the database.
 	ErrNoSuchId = errors.New("attachments: No such Id")
+
+	// Indicates that the contents of a file don't match its checksum or
+	// size.
+	ErrIntegrity = errors.New(
+		"attachments: Contents do not match checksum or size")
 )
 
 // Entry represents a file entry
@@ -65,28 +76,199 @@ type Store interface {
 	AddEntry(t db.Transaction, entry *Entry) error
 
 	// EntryById retrieves the record with given id and ownerId storing it in
-	// entry. EntryById returns ErrNoSuchId if no record found.
+	// entry. EntryById returns ErrNoSuchId if no record found or if the
+	// record is marked deleted.
 	EntryById(t db.Transaction, id, ownerId int64, entry *Entry) error
+
+	// ListEntries fetches the records of given owner that are not marked
+	// deleted sorted by order and passes them to consumer. If after is
+	// non-nil, ListEntries fetches only the records that come after it
+	// in order. after need not be a record in the datastore. ListEntries
+	// returns ErrInvalidOrder if order isn't valid.
+	ListEntries(
+		t db.Transaction,
+		ownerId int64,
+		order Order,
+		after *Entry,
+		consumer consume.Consumer) error
+}
+
+// DeleteStore is a Store that can delete records. ImmutableFS.Delete,
+// ImmutableFS.Purge, and CollectGarbage return ErrNotSupported if their
+// Store isn't a DeleteStore.
+type DeleteStore interface {
+	Store
+
+	// TombstoneEntry marks the record with given id and ownerId as deleted.
+	// TombstoneEntry returns ErrNoSuchId if no record found or if the record
+	// is already marked deleted.
+	TombstoneEntry(t db.Transaction, id, ownerId int64) error
+
+	// TombstonedEntries fetches the records of given owner that are marked
+	// deleted ordered by id and passes them to consumer.
+	TombstonedEntries(
+		t db.Transaction, ownerId int64, consumer consume.Consumer) error
+
+	// DeleteEntry permanently removes the record with given id and ownerId
+	// whether or not it is marked deleted. DeleteEntry returns ErrNoSuchId
+	// if no record found.
+	DeleteEntry(t db.Transaction, id, ownerId int64) error
+
+	// CountEntriesByChecksum returns the number of records of given owner
+	// with given checksum that are not marked deleted.
+	CountEntriesByChecksum(
+		t db.Transaction, ownerId int64, checksum string) (int, error)
+}
+
+// OwnerStore is a Store that can fetch all the records of an owner in a
+// single query.
+type OwnerStore interface {
+	Store
+
+	// EntriesByOwner fetches the records of given owner that are not
+	// marked deleted ordered by id and passes them to consumer.
+	EntriesByOwner(
+		t db.Transaction, ownerId int64, consumer consume.Consumer) error
+}
+
+// EntriesByOwner fetches the records of given owner from store as
+// described in OwnerStore. If store isn't an OwnerStore, EntriesByOwner
+// calls ListEntries sorting by id.
+func EntriesByOwner(
+	t db.Transaction,
+	store Store,
+	ownerId int64,
+	consumer consume.Consumer) error {
+	if o, ok := store.(OwnerStore); ok {
+		return o.EntriesByOwner(t, ownerId, consumer)
+	}
+	return store.ListEntries(t, ownerId, Order{}, nil, consumer)
+}
+
+// BatchStore is a Store that can fetch several records at once.
+type BatchStore interface {
+	Store
+
+	// EntriesByIds fetches the records of given owner with given ids that
+	// are not marked deleted ordered by id and passes them to consumer.
+	// EntriesByIds skips ids that have no such record. ids may be in any
+	// order and may contain duplicates.
+	EntriesByIds(
+		t db.Transaction,
+		ids []int64,
+		ownerId int64,
+		consumer consume.Consumer) error
+}
+
+// EntriesByIds fetches the records of given owner with given ids from
+// store as described in BatchStore. If store isn't a BatchStore,
+// EntriesByIds calls EntryById once for each distinct id.
+func EntriesByIds(
+	t db.Transaction,
+	store Store,
+	ids []int64,
+	ownerId int64,
+	consumer consume.Consumer) error {
+	if b, ok := store.(BatchStore); ok {
+		return b.EntriesByIds(t, ids, ownerId, consumer)
+	}
+	for _, id := range idlist.Sorted(ids) {
+		if !consumer.CanConsume() {
+			break
+		}
+		var entry Entry
+		err := store.EntryById(t, id, ownerId, &entry)
+		if err == ErrNoSuchId {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		consumer.Consume(&entry)
+	}
+	return nil
 }
 
 // ImmutableFS represents an immutable file system featuring AES-256
-// encryption. Note that ImmutableFS implements io/fs.FS
+// encryption. Note that ImmutableFS implements io/fs.FS, io/fs.ReadDirFS,
+// and io/fs.StatFS. The root directory contains a directory for each file
+// named after the file's Id, and each such directory contains just that
+// file.
 type ImmutableFS interface {
 
 	// Open opens the named file. name is of the form EntryId/EntryName e.g
-	// "12345/document.pdf"
+	// "12345/document.pdf". Reading the returned file fails with
+	// ErrIntegrity instead of returning io.EOF at the end if the contents
+	// don't match the file's checksum and size. The returned file also
+	// implements io.Seeker and io.ReaderAt. Only reads from start to
+	// finish are checked against the checksum, so once the file is read
+	// out of order, only encrypted contents in the current format are
+	// protected from tampering. Open also opens the root directory, ".",
+	// and the directories named after Ids e.g "12345".
 	Open(name string) (fs.File, error)
 
+	// ReadDir reads the named directory and returns its entries sorted by
+	// name.
+	ReadDir(name string) ([]fs.DirEntry, error)
+
+	// Stat returns a FileInfo describing the named file or directory.
+	// Stat gets everything it needs from the Store without reading the
+	// file's contents. For files, the Sys method of the returned FileInfo
+	// returns the file's *Entry. This is also true of the FileInfo that
+	// the Stat method of an opened file returns.
+	Stat(name string) (fs.FileInfo, error)
+
 	// Write writes a new file. name is the file name e.g "document.pdf."
-	// Write returns the Id of the new file, e.g 12345. If this instance
-	// is read-only, Write returns fs.ErrPermission.
+	// Write returns the Id of the new file, e.g 12345. Write stores name
+	// as normalized by this instance's NamePolicy and returns an
+	// *InvalidNameError without writing anything if the NamePolicy
+	// refuses name. If this instance is read-only, Write returns
+	// fs.ErrPermission.
 	Write(name string, contents []byte) (int64, error)
 
+	// WriteFrom works like Write except that it reads the contents of the
+	// new file from reader. WriteFrom uses a bounded amount of memory no
+	// matter how large the file is. If this instance is read-only,
+	// WriteFrom returns fs.ErrPermission.
+	WriteFrom(name string, reader io.Reader) (int64, error)
+
 	// List returns the files with given ids ordered by id.
 	// If an id has no file associated with it, the slice returned will not
 	// have an Entry for that id.
 	List(t db.Transaction, ids map[int64]bool) ([]*Entry, error)
 
+	// ListPage returns a page of all the files sorted according to
+	// options. To get the next page, pass the returned NextCursor in
+	// options. nil options means the first DefaultPageSize files sorted by
+	// id. ListPage returns ErrInvalidCursor if the cursor in options is
+	// malformed or came from a page with a different order.
+	ListPage(t db.Transaction, options *PageOptions) (*Page, error)
+
+	// Delete marks the file with given id as deleted. Deleted files
+	// disappear from Open and List right away, but their contents remain
+	// on the underlying file system until Purge is called. Delete returns
+	// ErrNoSuchId if there is no file with given id or ErrNotSupported if
+	// the Store isn't a DeleteStore. If this instance is read-only, Delete
+	// returns fs.ErrPermission.
+	Delete(id int64) error
+
+	// Purge permanently removes all the files marked deleted. Purge also
+	// removes the contents of each such file from the underlying file
+	// system unless another file that is not deleted has the same
+	// contents. Purge keeps files marked deleted whose contents were
+	// written within the purge grace period, so a later Purge finishes
+	// removing them. A Write of the same contents in progress refreshes
+	// that period, so Purge can run while files are being written. Purge
+	// returns ErrNotSupported if the Store isn't a DeleteStore. If this
+	// instance is read-only, Purge returns fs.ErrPermission.
+	Purge() error
+
+	// Verify reads the file with given id in its entirety and checks that
+	// its contents match its checksum and size. Verify returns
+	// ErrIntegrity if they don't or ErrNoSuchId if there is no file with
+	// given id.
+	Verify(id int64) error
+
 	// ReadOnly returns true if this instance is read-only.
 	ReadOnly() bool
 
@@ -97,14 +279,56 @@ type ImmutableFS interface {
 // fileSystem is where the contents of files from all owners are stored.
 // store is where file meta data from all owners are stored such as size
 // and timestamp. owner specifies the file owner. The returned instance
-// will store and retrieve files only for that owner.
+// will store and retrieve files only for that owner. If owner has a
+// KeyProvider, the returned instance fetches the owner's keys from it as
+// needed rather than holding on to them.
 func NewImmutableFS(fileSystem FS, store Store, owner Owner) ImmutableFS {
+	return NewImmutableFSWithOptions(fileSystem, store, owner, nil)
+}
+
+// ImmutableFSOptions contains options for NewImmutableFSWithOptions.
+type ImmutableFSOptions struct {
+
+	// How Write and WriteFrom validate and normalize file names. nil means
+	// the default NamePolicy.
+	NamePolicy *NamePolicy
+
+	// Purge leaves alone contents written within PurgeGracePeriod because
+	// a Write of the same contents may be about to use them. A later Purge
+	// removes such contents. Zero means DefaultGracePeriod.
+	PurgeGracePeriod time.Duration
+}
+
+func (o *ImmutableFSOptions) namePolicy() *NamePolicy {
+	if o == nil {
+		return nil
+	}
+	return o.NamePolicy
+}
+
+func (o *ImmutableFSOptions) purgeGracePeriod() time.Duration {
+	if o == nil || o.PurgeGracePeriod == 0 {
+		return DefaultGracePeriod
+	}
+	return o.PurgeGracePeriod
+}
+
+// NewImmutableFSWithOptions works like NewImmutableFS but allows the
+// caller to specify options. nil options means the defaults that
+// NewImmutableFS uses.
+func NewImmutableFSWithOptions(
+	fileSystem FS,
+	store Store,
+	owner Owner,
+	options *ImmutableFSOptions) ImmutableFS {
 	return &immutableFS{
 		Store: store,
 		aesFS: aesFS{
 			FileSystem: fileSystem,
 			Owner:      owner,
 		},
+		namePolicy:       options.namePolicy(),
+		purgeGracePeriod: options.purgeGracePeriod(),
 	}
 }
 
@@ -120,37 +344,137 @@ func ReadOnly(fileSystem ImmutableFS) ImmutableFS {
 type immutableFS struct {
 	Store
 	aesFS
+	namePolicy       *NamePolicy
+	purgeGracePeriod time.Duration
 }
 
 func (f *immutableFS) Open(name string) (fs.File, error) {
 	pathErr := &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
-	id, baseName, ok := parsePath(name)
-	if !ok {
+	entry, isDir, err := f.lookup(name)
+	if err != nil {
+		return nil, withOp(err, "open")
+	}
+	if isDir {
+		entries, err := f.readDir(name, entry)
+		if err != nil {
+			return nil, withOp(err, "open")
+		}
+		return &dirFile{
+			name: name, info: newDirInfo(entry), entries: entries}, nil
+	}
+	readCloser, err := f.aesFS.Open(entry.Checksum)
+	if errors.Is(err, fs.ErrNotExist) {
 		return nil, pathErr
 	}
-	var entry Entry
-	err := f.EntryById(nil, id, f.Owner.Id, &entry)
 	if err != nil {
-		return nil, pathErr
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
 	}
-	if baseName != entry.Name {
-		return nil, pathErr
+	return &immutableFile{
+		reader: newVerifyingReader(readCloser, entry),
+		closer: readCloser,
+		entry:  entry,
+		aesFS:  &f.aesFS,
+	}, nil
+}
+
+func (f *immutableFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, isDir, err := f.lookup(name)
+	if err != nil {
+		return nil, withOp(err, "readdir")
 	}
-	readCloser, err := f.aesFS.Open(entry.Checksum)
+	if !isDir {
+		return nil, &fs.PathError{
+			Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return f.readDir(name, entry)
+}
+
+func (f *immutableFS) Stat(name string) (fs.FileInfo, error) {
+	entry, isDir, err := f.lookup(name)
 	if err != nil {
-		return nil, pathErr
+		return nil, withOp(err, "stat")
+	}
+	if isDir {
+		return newDirInfo(entry), nil
+	}
+	return fileInfo{entry: entry}, nil
+}
+
+// lookup finds the entry for the file or directory called name. For the
+// root directory, lookup returns a nil entry. The Op of the *fs.PathError
+// that lookup returns is blank.
+func (f *immutableFS) lookup(name string) (
+	entry *Entry, isDir bool, err error) {
+	if name == "." {
+		return nil, true, nil
+	}
+	notExist := &fs.PathError{Path: name, Err: fs.ErrNotExist}
+	id, baseName, ok := parsePath(name)
+	if !ok {
+		return nil, false, notExist
+	}
+	var result Entry
+	if err := f.EntryById(nil, id, f.Owner.Id, &result); err != nil {
+		return nil, false, notExist
+	}
+	if baseName != "" && baseName != result.Name {
+		return nil, false, notExist
+	}
+	return &result, baseName == "", nil
+}
+
+// readDir returns the contents of the directory called name. entry is
+// what lookup returned for name.
+func (f *immutableFS) readDir(
+	name string, entry *Entry) ([]fs.DirEntry, error) {
+	if entry != nil {
+		return []fs.DirEntry{dirEntry{fileInfo{entry: entry}}}, nil
+	}
+	var entries []*Entry
+	err := EntriesByOwner(
+		nil, f.Store, f.Owner.Id, consume.AppendPtrsTo(&entries))
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	result := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, dirEntry{newDirInfo(entry)})
 	}
-	return &immutableFile{ReadCloser: readCloser, entry: &entry}, nil
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result, nil
 }
 
 func (f *immutableFS) Write(name string, contents []byte) (int64, error) {
+	name, err := f.namePolicy.Normalize(name)
+	if err != nil {
+		return 0, err
+	}
 	checksum, err := f.aesFS.Write(contents)
 	if err != nil {
 		return 0, err
 	}
+	return f.addEntry(name, int64(len(contents)), checksum)
+}
+
+func (f *immutableFS) WriteFrom(name string, reader io.Reader) (int64, error) {
+	name, err := f.namePolicy.Normalize(name)
+	if err != nil {
+		return 0, err
+	}
+	checksum, size, err := f.aesFS.WriteFrom(reader)
+	if err != nil {
+		return 0, err
+	}
+	return f.addEntry(name, size, checksum)
+}
+
+func (f *immutableFS) addEntry(
+	name string, size int64, checksum string) (int64, error) {
 	entry := Entry{
 		Name:     name,
-		Size:     int64(len(contents)),
+		Size:     size,
 		Ts:       time.Now().Unix(),
 		OwnerId:  f.Owner.Id,
 		Checksum: checksum,
@@ -163,24 +487,126 @@ func (f *immutableFS) Write(name string, contents []byte) (int64, error) {
 
 func (f *immutableFS) List(
 	t db.Transaction, ids map[int64]bool) ([]*Entry, error) {
-	var result []*Entry
+	idList := make([]int64, 0, len(ids))
 	for id, ok := range ids {
-		if !ok {
-			continue
+		if ok {
+			idList = append(idList, id)
 		}
-		var entry Entry
-		err := f.EntryById(t, id, f.Owner.Id, &entry)
-		if err == ErrNoSuchId {
+	}
+	var result []*Entry
+	err := EntriesByIds(
+		t, f.Store, idList, f.Owner.Id, consume.AppendPtrsTo(&result))
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (f *immutableFS) ListPage(
+	t db.Transaction, options *PageOptions) (*Page, error) {
+	return listPage(t, f.Store, f.Owner.Id, options)
+}
+
+func (f *immutableFS) Delete(id int64) error {
+	store, ok := f.Store.(DeleteStore)
+	if !ok {
+		return ErrNotSupported
+	}
+	return store.TombstoneEntry(nil, id, f.Owner.Id)
+}
+
+func (f *immutableFS) Purge() error {
+	store, ok := f.Store.(DeleteStore)
+	if !ok {
+		return ErrNotSupported
+	}
+	var entries []*Entry
+	err := store.TombstonedEntries(
+		nil, f.Owner.Id, consume.AppendPtrsTo(&entries))
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-f.purgeGracePeriod)
+	for _, entry := range entries {
+		done, err := f.purgeContents(store, entry.Checksum, cutoff)
+		if err != nil {
+			return err
+		}
+		if !done {
 			continue
 		}
+		err = store.DeleteEntry(nil, entry.Id, f.Owner.Id)
+		if err != nil && err != ErrNoSuchId {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeContents removes the contents with given checksum unless a file
+// not marked deleted has them. purgeContents returns false if it leaves
+// the contents alone because they were written after cutoff or while
+// purgeContents was running. A Write that dedups against the contents
+// touches them before adding its entry, so purgeContents stats the
+// contents before counting entries and again right before removing them.
+func (f *immutableFS) purgeContents(
+	store DeleteStore, checksum string, cutoff time.Time) (bool, error) {
+	name, _, err := f.aesFS.resolve(checksum)
+	if err != nil {
+		return false, err
+	}
+	s, canStat := f.aesFS.FileSystem.(StatFS)
+	var fileInfo fs.FileInfo
+	if canStat {
+		fileInfo, err = s.Stat(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return true, nil
+		}
 		if err != nil {
-			return nil, err
+			return false, err
 		}
-		result = append(result, &entry)
 	}
-	sort.Slice(
-		result, func(i, j int) bool { return result[i].Id < result[j].Id })
-	return result, nil
+	count, err := store.CountEntriesByChecksum(nil, f.Owner.Id, checksum)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return true, nil
+	}
+	if canStat {
+		if fileInfo.ModTime().After(cutoff) {
+			return false, nil
+		}
+		latest, err := s.Stat(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !latest.ModTime().Equal(fileInfo.ModTime()) {
+			return false, nil
+		}
+	}
+	err = Remove(f.aesFS.FileSystem, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
+
+func (f *immutableFS) Verify(id int64) error {
+	var entry Entry
+	if err := f.EntryById(nil, id, f.Owner.Id, &entry); err != nil {
+		return err
+	}
+	readCloser, err := f.aesFS.Open(entry.Checksum)
+	if err != nil {
+		return err
+	}
+	defer readCloser.Close()
+	_, err = io.Copy(io.Discard, newVerifyingReader(readCloser, &entry))
+	return err
 }
 
 func (f *immutableFS) ReadOnly() bool {
@@ -199,34 +625,197 @@ func (f *roImmutableFS) Write(
 	return 0, fs.ErrPermission
 }
 
+func (f *roImmutableFS) WriteFrom(
+	name string, reader io.Reader) (int64, error) {
+	return 0, fs.ErrPermission
+}
+
+func (f *roImmutableFS) Delete(id int64) error {
+	return fs.ErrPermission
+}
+
+func (f *roImmutableFS) Purge() error {
+	return fs.ErrPermission
+}
+
 func (f *roImmutableFS) ReadOnly() bool {
 	return true
 }
 
+// parsePath parses name of the form EntryId/EntryName or just EntryId.
+// If name is just EntryId, baseName is empty.
 func parsePath(name string) (id int64, baseName string, ok bool) {
 	if !fs.ValidPath(name) {
 		return
 	}
 	parts := strings.Split(name, "/")
-	if len(parts) != 2 {
+	if len(parts) > 2 {
 		return
 	}
 	fileId, err := strconv.ParseInt(parts[0], 10, 64)
-	if err != nil {
+	if err != nil || strconv.FormatInt(fileId, 10) != parts[0] {
 		return
 	}
+	if len(parts) == 1 {
+		return fileId, "", true
+	}
 	return fileId, parts[1], true
 }
 
+// withOp returns err with its Op set to op if err is an *fs.PathError.
+func withOp(err error, op string) error {
+	if pathErr, ok := err.(*fs.PathError); ok {
+		return &fs.PathError{Op: op, Path: pathErr.Path, Err: pathErr.Err}
+	}
+	return err
+}
+
+// verifyingReader checks that what it reads matches the checksum and
+// size of an entry.
+type verifyingReader struct {
+	reader io.Reader
+	entry  *Entry
+	hash   hash.Hash
+	size   int64
+}
+
+func newVerifyingReader(reader io.Reader, entry *Entry) *verifyingReader {
+	return &verifyingReader{reader: reader, entry: entry, hash: sha256.New()}
+}
+
+func (v *verifyingReader) Read(p []byte) (n int, err error) {
+	n, err = v.reader.Read(p)
+	v.hash.Write(p[:n])
+	v.size += int64(n)
+	if v.size > v.entry.Size {
+		return n, ErrIntegrity
+	}
+	if err == io.EOF {
+		if v.size != v.entry.Size {
+			return n, ErrIntegrity
+		}
+		if hex.EncodeToString(v.hash.Sum(nil)) != v.entry.Checksum {
+			return n, ErrIntegrity
+		}
+	}
+	return n, err
+}
+
+// immutableFile is a file opened from an ImmutableFS. Reads that pick up
+// where the previous Read left off, starting at the beginning of the file,
+// go through a verifyingReader. Once a Seek moves somewhere else, Read
+// works like ReadAt which decrypts just what is asked for and so can't
+// check the contents against the checksum. Seeking back to where the
+// verified reads left off resumes them.
 type immutableFile struct {
-	io.ReadCloser
-	entry *Entry
+	reader *verifyingReader
+	closer io.Closer
+	entry  *Entry
+	aesFS  *aesFS
+
+	// How far reader has read
+	pos int64
+
+	// Where the next Read starts
+	offset int64
+
+	// Protects readerAt and readerAtCloser which ReadAt opens as needed
+	lock           sync.Mutex
+	readerAt       io.ReaderAt
+	readerAtCloser io.Closer
+}
+
+func (f *immutableFile) Read(p []byte) (int, error) {
+	if f.offset == f.pos {
+		n, err := f.reader.Read(p)
+		f.pos += int64(n)
+		f.offset = f.pos
+		return n, err
+	}
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads len(p) bytes starting at off. ReadAt returns ErrIntegrity
+// if the stored contents are shorter than the file's size.
+func (f *immutableFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if off >= f.entry.Size {
+		return 0, io.EOF
+	}
+	readerAt, err := f.openReaderAt()
+	if err != nil {
+		return 0, err
+	}
+	want := p
+	if remaining := f.entry.Size - off; int64(len(want)) > remaining {
+		want = want[:remaining]
+	}
+	n, err := readerAt.ReadAt(want, off)
+	if n < len(want) {
+		if err == nil || err == io.EOF {
+			err = ErrIntegrity
+		}
+		return n, err
+	}
+	if len(want) < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *immutableFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.entry.Size
+	default:
+		return 0, errors.New("attachments: Invalid whence")
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *immutableFile) Close() error {
+	err := f.closer.Close()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.readerAtCloser != nil {
+		if closeErr := f.readerAtCloser.Close(); err == nil {
+			err = closeErr
+		}
+		f.readerAt = nil
+		f.readerAtCloser = nil
+	}
+	return err
 }
 
 func (f *immutableFile) Stat() (fs.FileInfo, error) {
 	return fileInfo{entry: f.entry}, nil
 }
 
+func (f *immutableFile) openReaderAt() (io.ReaderAt, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.readerAt == nil {
+		readerAt, closer, err := f.aesFS.openReaderAt(f.entry.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		f.readerAt = readerAt
+		f.readerAtCloser = closer
+	}
+	return f.readerAt, nil
+}
+
 type fileInfo struct {
 	entry *Entry
 }
@@ -252,5 +841,105 @@ func (f fileInfo) IsDir() bool {
 }
 
 func (f fileInfo) Sys() interface{} {
+	return f.entry
+}
+
+// dirInfo describes a directory. The root directory is called "." and
+// has the zero time. The other directories take the timestamp of the file
+// in them.
+type dirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+// newDirInfo returns the dirInfo for the directory holding entry. If
+// entry is nil, newDirInfo returns the dirInfo for the root directory.
+func newDirInfo(entry *Entry) dirInfo {
+	if entry == nil {
+		return dirInfo{name: "."}
+	}
+	return dirInfo{
+		name:    strconv.FormatInt(entry.Id, 10),
+		modTime: time.Unix(entry.Ts, 0),
+	}
+}
+
+func (d dirInfo) Name() string {
+	return d.name
+}
+
+func (d dirInfo) Size() int64 {
+	return 0
+}
+
+func (d dirInfo) Mode() fs.FileMode {
+	return fs.ModeDir | 0500
+}
+
+func (d dirInfo) ModTime() time.Time {
+	return d.modTime
+}
+
+func (d dirInfo) IsDir() bool {
+	return true
+}
+
+func (d dirInfo) Sys() interface{} {
+	return nil
+}
+
+type dirEntry struct {
+	info fs.FileInfo
+}
+
+func (d dirEntry) Name() string {
+	return d.info.Name()
+}
+
+func (d dirEntry) IsDir() bool {
+	return d.info.IsDir()
+}
+
+func (d dirEntry) Type() fs.FileMode {
+	return d.info.Mode().Type()
+}
+
+func (d dirEntry) Info() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+// dirFile is an open directory.
+type dirFile struct {
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dirFile) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
+
+func (d *dirFile) Close() error {
 	return nil
 }
@@ -1,11 +1,21 @@
 package attachments
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 	"time"
 
+	"github.com/keep94/consume"
 	"github.com/keep94/toolbox/db"
 	"github.com/keep94/toolbox/kdf"
 	"github.com/stretchr/testify/assert"
@@ -14,11 +24,12 @@ import (
 
 var (
 	errDatabase = errors.New("attachments: database error")
+	errRead     = errors.New("attachments: read error")
 )
 
 func TestImmutableFS(t *testing.T) {
 	fakeFs := NewInMemoryFS()
-	store := newFakeStore()
+	store := NewInMemoryStore()
 	immutableFs1 := NewImmutableFS(fakeFs, store, Owner{Id: 1})
 	immutableFs2 := NewImmutableFS(
 		fakeFs, store, Owner{Id: 2, Key: kdf.Random(32)})
@@ -139,12 +150,274 @@ func TestImmutableFS(t *testing.T) {
 	assert.Equal(t, int64(12), fileInfo.Size())
 	assert.Equal(t, fs.FileMode(0400), fileInfo.Mode())
 	assert.False(t, fileInfo.IsDir())
-	assert.Nil(t, fileInfo.Sys())
+	entry, ok := fileInfo.Sys().(*Entry)
+	require.True(t, ok)
+	assert.Equal(t, int64(3), entry.Id)
+	assert.Equal(t, "hello2.txt", entry.Name)
 
 	// Assert that timestamp is reasonably current
 	assert.Less(t, time.Now().Sub(fileInfo.ModTime()), 5*time.Second)
 }
 
+func TestImmutableFS_WriteFrom(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	immutableFs := NewImmutableFS(
+		fakeFs, store, Owner{Id: 1, Key: kdf.Random(32)})
+	bigContents := kdf.Random(1000000)
+	id, err := immutableFs.WriteFrom("big.bin", bytes.NewReader(bigContents))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), id)
+
+	// Same contents via Write should be deduped
+	id, err = immutableFs.Write("big_again.bin", bigContents)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), id)
+	assert.Equal(t, 1, numFiles(fakeFs))
+
+	contents, err := fs.ReadFile(immutableFs, "1/big.bin")
+	require.NoError(t, err)
+	assert.Equal(t, bigContents, contents)
+	contents, err = fs.ReadFile(immutableFs, "2/big_again.bin")
+	require.NoError(t, err)
+	assert.Equal(t, bigContents, contents)
+
+	files, err := immutableFs.List(nil, map[int64]bool{1: true})
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, int64(1000000), files[0].Size)
+
+	// Contents previously written via Write should be deduped too
+	_, err = immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	id, err = immutableFs.WriteFrom(
+		"hello_again.txt", strings.NewReader("Hello World!"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), id)
+	assert.Equal(t, 2, numFiles(fakeFs))
+	contents, err = fs.ReadFile(immutableFs, "4/hello_again.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "Hello World!", string(contents))
+}
+
+func TestImmutableFS_WriteFromError(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	immutableFs := NewImmutableFS(
+		fakeFs, store, Owner{Id: 1, Key: kdf.Random(32)})
+	reader := io.MultiReader(
+		strings.NewReader("Hello World!"), iotest.ErrReader(errRead))
+	_, err := immutableFs.WriteFrom("hello.txt", reader)
+	assert.Equal(t, errRead, err)
+
+	// Nothing should be left behind
+	assert.Equal(t, 0, numFiles(fakeFs))
+	_, err = immutableFs.Open("1/hello.txt")
+	assert.Error(t, err)
+}
+
+func TestImmutableFS_InvalidName(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	immutableFs := NewImmutableFS(
+		fakeFs, store, Owner{Id: 1, Key: kdf.Random(32)})
+	for _, name := range []string{"", ".", "..", "a/b.txt", "a\x00b.txt"} {
+		_, err := immutableFs.Write(name, ([]byte)("Hello World!"))
+		var nameErr *InvalidNameError
+		assert.True(t, errors.As(err, &nameErr))
+		_, err = immutableFs.WriteFrom(
+			name, strings.NewReader("Hello World!"))
+		assert.True(t, errors.Is(err, fs.ErrInvalid))
+	}
+
+	// Nothing should be written
+	assert.Equal(t, 0, numFiles(fakeFs))
+	entries, err := immutableFs.ReadDir(".")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Names are stored in NFC so that they can be opened.
+	id, err := immutableFs.Write("cafe\u0301.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	files, err := immutableFs.List(nil, map[int64]bool{id: true})
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "caf\u00e9.txt", files[0].Name)
+	contents, err := fs.ReadFile(immutableFs, files[0].Path())
+	require.NoError(t, err)
+	assert.Equal(t, "Hello World!", string(contents))
+}
+
+func TestImmutableFS_NamePolicy(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	immutableFs := NewImmutableFSWithOptions(
+		fakeFs,
+		store,
+		Owner{Id: 1, Key: kdf.Random(32)},
+		&ImmutableFSOptions{
+			NamePolicy: &NamePolicy{MaxLength: 9, Replacement: "-"},
+		})
+	id, err := immutableFs.WriteFrom(
+		"a/b\tc.txt", strings.NewReader("Hello World!"))
+	require.NoError(t, err)
+	contents, err := fs.ReadFile(immutableFs, fmt.Sprintf("%d/a-b-c.txt", id))
+	require.NoError(t, err)
+	assert.Equal(t, "Hello World!", string(contents))
+
+	_, err = immutableFs.Write("abcde.txt!", ([]byte)("Hello World!"))
+	assert.True(t, errors.Is(err, fs.ErrInvalid))
+}
+
+func TestImmutableFS_Delete(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	immutableFs := newPurgingImmutableFS(
+		fakeFs, store, Owner{Id: 1, Key: kdf.Random(32)})
+	otherFs := NewImmutableFS(fakeFs, store, Owner{Id: 2})
+	helloId, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	helloAgainId, err := immutableFs.Write(
+		"hello_again.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	goodbyeId, err := immutableFs.Write(
+		"goodbye.txt", ([]byte)("Goodbye World!"))
+	require.NoError(t, err)
+	otherId, err := otherFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, numFiles(fakeFs))
+
+	require.NoError(t, immutableFs.Delete(helloId))
+	require.NoError(t, immutableFs.Delete(goodbyeId))
+	assert.Equal(t, ErrNoSuchId, immutableFs.Delete(helloId))
+	assert.Equal(t, ErrNoSuchId, immutableFs.Delete(otherId))
+
+	// Deleted files disappear right away
+	_, err = immutableFs.Open("1/hello.txt")
+	assert.Equal(
+		t,
+		&fs.PathError{Op: "open", Path: "1/hello.txt", Err: fs.ErrNotExist},
+		err)
+	entries, err := immutableFs.List(
+		nil, map[int64]bool{helloId: true, helloAgainId: true, goodbyeId: true})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, helloAgainId, entries[0].Id)
+
+	// but their contents don't until we purge
+	assert.Equal(t, 3, numFiles(fakeFs))
+	require.NoError(t, immutableFs.Purge())
+
+	// Contents of goodbye.txt gone, but hello_again.txt still has the
+	// hello world contents.
+	assert.Equal(t, 2, numFiles(fakeFs))
+	contents, err := fs.ReadFile(immutableFs, "2/hello_again.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "Hello World!", string(contents))
+	contents, err = fs.ReadFile(otherFs, "4/hello.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "Hello World!", string(contents))
+
+	// Purging again is harmless
+	require.NoError(t, immutableFs.Purge())
+	assert.Equal(t, 2, numFiles(fakeFs))
+
+	require.NoError(t, immutableFs.Delete(helloAgainId))
+	require.NoError(t, immutableFs.Purge())
+	assert.Equal(t, 1, numFiles(fakeFs))
+	_, err = fs.ReadFile(immutableFs, "2/hello_again.txt")
+	assert.Error(t, err)
+	contents, err = fs.ReadFile(otherFs, "4/hello.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "Hello World!", string(contents))
+}
+
+func TestImmutableFS_PurgeDuringWrite(t *testing.T) {
+	root := t.TempDir()
+	fileSystem, err := NewFS(root)
+	require.NoError(t, err)
+	owner := Owner{Id: 1, Key: kdf.Random(32)}
+	store := NewInMemoryStore()
+	immutableFs := NewImmutableFS(fileSystem, store, owner)
+	blobName := filepath.Join(
+		root, idToPath(checksumOf("Hello World!"), 1))
+	backdate := func() {
+		old := time.Now().Add(-DefaultGracePeriod - time.Hour)
+		require.NoError(t, os.Chtimes(blobName, old, old))
+	}
+	helloId, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	require.NoError(t, immutableFs.Delete(helloId))
+	backdate()
+
+	// A Write of the same contents dedups against the blob but hasn't
+	// added its entry yet.
+	rawFs := &aesFS{FileSystem: fileSystem, Owner: owner}
+	_, err = rawFs.Write(([]byte)("Hello World!"))
+	require.NoError(t, err)
+	require.NoError(t, immutableFs.Purge())
+	_, err = os.Stat(blobName)
+	assert.NoError(t, err)
+
+	// Purge keeps the deleted entry so that it can try again later.
+	assert.Equal(t, 1, numTombstoned(t, store))
+
+	// Once nothing touches the blob, Purge removes it.
+	helloId, err = immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	require.NoError(t, immutableFs.Delete(helloId))
+	backdate()
+	require.NoError(t, immutableFs.Purge())
+	_, err = os.Stat(blobName)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 0, numTombstoned(t, store))
+}
+
+func TestImmutableFS_PurgeRace(t *testing.T) {
+	fakeFs := &statHookFS{fakeFS: NewInMemoryFS().(*fakeFS)}
+	store := NewInMemoryStore()
+	owner := Owner{Id: 1, Key: kdf.Random(32)}
+	immutableFs := newPurgingImmutableFS(fakeFs, store, owner)
+	helloId, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	require.NoError(t, immutableFs.Delete(helloId))
+
+	// A Write of the same contents dedups against the blob right after
+	// Purge stats it but before the Write adds its entry.
+	rawFs := &aesFS{FileSystem: fakeFs, Owner: owner}
+	fakeFs.afterStat = func() {
+		fakeFs.afterStat = nil
+		_, err := rawFs.Write(([]byte)("Hello World!"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, immutableFs.Purge())
+	assert.True(t, fakeFs.Exists(idToPath(checksumOf("Hello World!"), 1)))
+	assert.Equal(t, 1, numTombstoned(t, store))
+
+	require.NoError(t, immutableFs.Purge())
+	assert.False(t, fakeFs.Exists(idToPath(checksumOf("Hello World!"), 1)))
+	assert.Equal(t, 0, numTombstoned(t, store))
+}
+
+func TestImmutableFS_NotDeleteStore(t *testing.T) {
+	store := NewInMemoryStore()
+	fakeFs := NewInMemoryFS()
+	id, err := NewImmutableFS(fakeFs, store, Owner{Id: 1}).Write(
+		"hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	immutableFs := NewImmutableFS(fakeFs, plainStore{store}, Owner{Id: 1})
+	assert.Equal(t, ErrNotSupported, immutableFs.Delete(id))
+	assert.Equal(t, ErrNotSupported, immutableFs.Purge())
+	assertReadFile(
+		t, immutableFs, fmt.Sprintf("%d/hello.txt", id), "Hello World!")
+}
+
+func TestImmutableFS_PurgeError(t *testing.T) {
+	immutableFs := NewImmutableFS(NewInMemoryFS(), errorStore{}, Owner{Id: 1})
+	assert.Equal(t, errDatabase, immutableFs.Delete(1))
+	assert.Equal(t, errDatabase, immutableFs.Purge())
+}
+
 func TestImmutableFS_ListError(t *testing.T) {
 	fileSystem := NewImmutableFS(NewInMemoryFS(), errorStore{}, Owner{Id: 1})
 	_, err := fileSystem.List(nil, map[int64]bool{1: true})
@@ -152,20 +425,20 @@ func TestImmutableFS_ListError(t *testing.T) {
 }
 
 func TestImmutableFS_WriteError(t *testing.T) {
-	immutableFs := NewImmutableFS(NilFS(), newFakeStore(), Owner{Id: 1})
+	immutableFs := NewImmutableFS(NilFS(), NewInMemoryStore(), Owner{Id: 1})
 	_, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
 	assert.Error(t, err)
 }
 
 func TestImmutableFS_ReadError(t *testing.T) {
-	// Prime fakeStore so that we can test error reading filesystem
-	fakeStore := newFakeStore()
-	immutableFs := NewImmutableFS(NewInMemoryFS(), fakeStore, Owner{Id: 1})
+	// Prime store so that we can test error reading filesystem
+	store := NewInMemoryStore()
+	immutableFs := NewImmutableFS(NewInMemoryFS(), store, Owner{Id: 1})
 	_, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
 	require.NoError(t, err)
 
 	// Now do our real test
-	immutableFs = NewImmutableFS(NilFS(), fakeStore, Owner{Id: 1})
+	immutableFs = NewImmutableFS(NilFS(), store, Owner{Id: 1})
 
 	// Should get an error reading
 	_, err = immutableFs.Open("1/hello.txt")
@@ -183,7 +456,7 @@ func TestImmutableFS_DBErrorOnWrite(t *testing.T) {
 
 func TestImmutableFS_DBErrorOnRead(t *testing.T) {
 	immutableFs := NewImmutableFS(
-		NewInMemoryFS(), newFakeStore(), Owner{Id: 1})
+		NewInMemoryFS(), NewInMemoryStore(), Owner{Id: 1})
 
 	// Should get an error reading
 	_, err := immutableFs.Open("1/hello.txt")
@@ -195,7 +468,7 @@ func TestImmutableFS_DBErrorOnRead(t *testing.T) {
 
 func TestImmutableFS_ReadOnly(t *testing.T) {
 	immutableFs := NewImmutableFS(
-		NewInMemoryFS(), newFakeStore(), Owner{Id: 1})
+		NewInMemoryFS(), NewInMemoryStore(), Owner{Id: 1})
 	assert.False(t, immutableFs.ReadOnly())
 	readOnlyFs := ReadOnly(immutableFs)
 	assert.True(t, readOnlyFs.ReadOnly())
@@ -213,11 +486,18 @@ func TestImmutableFS_ReadOnly(t *testing.T) {
 
 	_, err = readOnlyFs.Write("goodbye.txt", ([]byte)("Goodbye World!"))
 	assert.Equal(t, fs.ErrPermission, err)
+	_, err = readOnlyFs.WriteFrom(
+		"goodbye.txt", strings.NewReader("Goodbye World!"))
+	assert.Equal(t, fs.ErrPermission, err)
+	assert.Equal(t, fs.ErrPermission, readOnlyFs.Delete(files[0].Id))
+	assert.Equal(t, fs.ErrPermission, readOnlyFs.Purge())
+	_, err = fs.ReadFile(readOnlyFs, files[0].Path())
+	assert.NoError(t, err)
 }
 
 func TestImmutableFS_WrongKeySize(t *testing.T) {
 	owner := Owner{Id: 1, Key: kdf.Random(25)}
-	immutableFs := NewImmutableFS(NewInMemoryFS(), newFakeStore(), owner)
+	immutableFs := NewImmutableFS(NewInMemoryFS(), NewInMemoryStore(), owner)
 	_, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
 	assert.Error(t, err)
 }
@@ -225,7 +505,7 @@ func TestImmutableFS_WrongKeySize(t *testing.T) {
 func TestImmutableFS_WrongKeySizeRead(t *testing.T) {
 	owner := Owner{Id: 1}
 	fakeFs := NewInMemoryFS()
-	store := newFakeStore()
+	store := NewInMemoryStore()
 	immutableFs := NewImmutableFS(fakeFs, store, owner)
 	owner.Key = kdf.Random(25)
 	badKeyFs := NewImmutableFS(fakeFs, store, owner)
@@ -235,6 +515,279 @@ func TestImmutableFS_WrongKeySizeRead(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestImmutableFS_WrongKey(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	immutableFs := NewImmutableFS(
+		fakeFs, store, Owner{Id: 1, Key: kdf.Random(32)})
+	wrongKeyFs := NewImmutableFS(
+		fakeFs, store, Owner{Id: 1, Key: kdf.Random(32)})
+	_, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	_, err = fs.ReadFile(wrongKeyFs, "1/hello.txt")
+	assert.Equal(
+		t,
+		&fs.PathError{Op: "open", Path: "1/hello.txt", Err: ErrWrongKey},
+		err)
+}
+
+func TestImmutableFS_Integrity(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	immutableFs := NewImmutableFS(fakeFs, NewInMemoryStore(), Owner{Id: 1})
+	helloId, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	helloName := fmt.Sprintf("%d/hello.txt", helloId)
+	blobName := idToPath(checksumOf("Hello World!"), 1)
+	assert.NoError(t, immutableFs.Verify(helloId))
+	assert.Equal(t, ErrNoSuchId, immutableFs.Verify(999))
+
+	// Bit rot
+	writeString(t, fakeFs, blobName, "Hello World?")
+	_, err = fs.ReadFile(immutableFs, helloName)
+	assert.Equal(t, ErrIntegrity, err)
+	assert.Equal(t, ErrIntegrity, immutableFs.Verify(helloId))
+
+	// Truncated
+	writeString(t, fakeFs, blobName, "Hello")
+	_, err = fs.ReadFile(immutableFs, helloName)
+	assert.Equal(t, ErrIntegrity, err)
+
+	// Too long
+	writeString(t, fakeFs, blobName, "Hello World!!")
+	_, err = fs.ReadFile(immutableFs, helloName)
+	assert.Equal(t, ErrIntegrity, err)
+	assert.Equal(t, ErrIntegrity, ReadOnly(immutableFs).Verify(helloId))
+
+	// Missing
+	require.NoError(t, Remove(fakeFs, blobName))
+	assert.True(
+		t, errors.Is(immutableFs.Verify(helloId), fs.ErrNotExist))
+
+	// Data read before the end is still handed out
+	writeString(t, fakeFs, blobName, "Hello World?")
+	file, err := immutableFs.Open(helloName)
+	require.NoError(t, err)
+	defer file.Close()
+	contents := make([]byte, 5)
+	_, err = io.ReadFull(file, contents)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", string(contents))
+}
+
+func TestImmutableFS_IntegrityLegacyWrongKey(t *testing.T) {
+	// The legacy format isn't authenticated so reading it with the wrong
+	// key produces garbage that only the checksum catches.
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	owner := Owner{Id: 1, Key: kdf.Random(32)}
+	checksum := writeLegacyBlob(
+		t, &aesFS{FileSystem: fakeFs, Owner: owner}, ([]byte)("Legacy"))
+	entry := Entry{Name: "legacy.txt", Size: 6, OwnerId: 1, Checksum: checksum}
+	require.NoError(t, store.AddEntry(nil, &entry))
+	assert.NoError(t, NewImmutableFS(fakeFs, store, owner).Verify(entry.Id))
+	owner.Key = kdf.Random(32)
+	assert.Equal(
+		t, ErrIntegrity, NewImmutableFS(fakeFs, store, owner).Verify(entry.Id))
+}
+
+func TestImmutableFS_FSTest(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	immutableFs := NewImmutableFS(
+		fakeFs, store, Owner{Id: 1, Key: kdf.Random(32)})
+	var expected []string
+	for i := 1; i <= 11; i++ {
+		name := fmt.Sprintf("file%d.txt", i)
+		id, err := immutableFs.Write(name, ([]byte)(strings.Repeat("x", i)))
+		require.NoError(t, err)
+		expected = append(expected, fmt.Sprintf("%d/%s", id, name))
+	}
+	_, err := NewImmutableFS(fakeFs, store, Owner{Id: 2}).Write(
+		"other.txt", ([]byte)("Other"))
+	require.NoError(t, err)
+	require.NoError(t, immutableFs.Delete(3))
+	require.NoError(t, fstest.TestFS(immutableFs, expected[3:]...))
+	require.NoError(t, fstest.TestFS(ReadOnly(immutableFs), expected[3:]...))
+
+	// Directories are sorted by name, not by id
+	entries, err := immutableFs.ReadDir(".")
+	require.NoError(t, err)
+	require.Len(t, entries, 10)
+	assert.Equal(t, "1", entries[0].Name())
+	assert.Equal(t, "10", entries[1].Name())
+	assert.True(t, entries[0].IsDir())
+
+	entries, err = immutableFs.ReadDir("5")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "file5.txt", entries[0].Name())
+	assert.False(t, entries[0].IsDir())
+
+	// Deleted files and files of other owners don't exist
+	_, err = immutableFs.ReadDir("3")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	_, err = immutableFs.Stat("12")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	_, err = immutableFs.Stat("05/file5.txt")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	// Files aren't directories
+	_, err = immutableFs.ReadDir("5/file5.txt")
+	assert.Error(t, err)
+
+	// Stat doesn't read the contents
+	files, err := immutableFs.List(nil, map[int64]bool{5: true})
+	require.NoError(t, err)
+	require.NoError(
+		t, Remove(fakeFs, idToPath(files[0].Checksum, files[0].OwnerId)))
+	info, err := immutableFs.Stat("5/file5.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "file5.txt", info.Name())
+	assert.Equal(t, int64(5), info.Size())
+	assert.False(t, info.IsDir())
+	info, err = immutableFs.Stat("5")
+	require.NoError(t, err)
+	assert.Equal(t, "5", info.Name())
+	assert.True(t, info.IsDir())
+	assert.Equal(t, files[0].Ts, info.ModTime().Unix())
+}
+
+func TestImmutableFS_ReadDirError(t *testing.T) {
+	immutableFs := NewImmutableFS(NewInMemoryFS(), errorStore{}, Owner{Id: 1})
+	_, err := immutableFs.ReadDir(".")
+	assert.True(t, errors.Is(err, errDatabase))
+	_, err = immutableFs.Open(".")
+	assert.True(t, errors.Is(err, errDatabase))
+}
+
+func TestImmutableFS_ListPage(t *testing.T) {
+	store := NewInMemoryStore()
+	immutableFs := NewImmutableFS(NewInMemoryFS(), store, Owner{Id: 1})
+	for _, name := range []string{"e.txt", "b.txt", "d.txt", "a.txt", "c.txt"} {
+		_, err := immutableFs.Write(name, ([]byte)(name))
+		require.NoError(t, err)
+	}
+	_, err := NewImmutableFS(NewInMemoryFS(), store, Owner{Id: 2}).Write(
+		"other.txt", ([]byte)("Other"))
+	require.NoError(t, err)
+	require.NoError(t, immutableFs.Delete(3))
+
+	page, err := immutableFs.ListPage(nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2", "4", "5"}, pageIds(page))
+	assert.Empty(t, page.NextCursor)
+
+	options := &PageOptions{Order: Order{SortBy: SortByName}, Limit: 2}
+	page, err = immutableFs.ListPage(nil, options)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"4", "2"}, pageIds(page))
+	require.NotEmpty(t, page.NextCursor)
+	options.Cursor = page.NextCursor
+	page, err = immutableFs.ListPage(nil, options)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"5", "1"}, pageIds(page))
+	assert.Empty(t, page.NextCursor)
+
+	// Cursors only work with the order they came from
+	options.Cursor = ""
+	page, err = immutableFs.ListPage(nil, options)
+	require.NoError(t, err)
+	_, err = immutableFs.ListPage(
+		nil,
+		&PageOptions{
+			Order: Order{SortBy: SortBySize}, Cursor: page.NextCursor})
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = immutableFs.ListPage(nil, &PageOptions{Cursor: "garbage!"})
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = immutableFs.ListPage(nil, &PageOptions{Order: Order{SortBy: 7}})
+	assert.Equal(t, ErrInvalidOrder, err)
+
+	// Read-only instances can list too
+	page, err = ReadOnly(immutableFs).ListPage(
+		nil, &PageOptions{Order: Order{Descending: true}, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"5"}, pageIds(page))
+}
+
+func TestImmutableFS_ListPageError(t *testing.T) {
+	immutableFs := NewImmutableFS(NewInMemoryFS(), errorStore{}, Owner{Id: 1})
+	_, err := immutableFs.ListPage(nil, nil)
+	assert.Equal(t, errDatabase, err)
+}
+
+func TestImmutableFS_ListBatch(t *testing.T) {
+	store := &batchStore{Store: NewInMemoryStore()}
+	immutableFs := NewImmutableFS(NewInMemoryFS(), store, Owner{Id: 1})
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		_, err := immutableFs.Write(name, ([]byte)(name))
+		require.NoError(t, err)
+	}
+	entries, err := immutableFs.List(
+		nil, map[int64]bool{3: true, 1: true, 2: false, 4: true})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "1/a.txt", entries[0].Path())
+	assert.Equal(t, "3/c.txt", entries[1].Path())
+	assert.Equal(t, 1, store.batchCalls)
+	assert.Zero(t, store.entryByIdCalls)
+}
+
+func TestEntriesByIds_Fallback(t *testing.T) {
+	store := NewInMemoryStore()
+	immutableFs := NewImmutableFS(NewInMemoryFS(), store, Owner{Id: 1})
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		_, err := immutableFs.Write(name, ([]byte)(name))
+		require.NoError(t, err)
+	}
+	var entries []Entry
+	require.NoError(
+		t,
+		EntriesByIds(
+			nil,
+			store,
+			[]int64{3, 9, 1, 3},
+			1,
+			consume.AppendTo(&entries)))
+	require.Len(t, entries, 2)
+	assert.Equal(t, "1/a.txt", entries[0].Path())
+	assert.Equal(t, "3/c.txt", entries[1].Path())
+	assert.Equal(
+		t,
+		errDatabase,
+		EntriesByIds(
+			nil, errorStore{}, []int64{1}, 1, consume.AppendTo(&entries)))
+}
+
+func TestEntriesByOwner_Fallback(t *testing.T) {
+	store := NewInMemoryStore()
+	immutableFs := NewImmutableFS(NewInMemoryFS(), store, Owner{Id: 1})
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		_, err := immutableFs.Write(name, ([]byte)(name))
+		require.NoError(t, err)
+	}
+	require.NoError(t, immutableFs.Delete(2))
+	var entries []Entry
+	require.NoError(
+		t,
+		EntriesByOwner(
+			nil, plainStore{store}, 1, consume.AppendTo(&entries)))
+	require.Len(t, entries, 2)
+	assert.Equal(t, "1/a.txt", entries[0].Path())
+	assert.Equal(t, "3/c.txt", entries[1].Path())
+
+	// ImmutableFS works with stores that aren't OwnerStores
+	immutableFs = NewImmutableFS(
+		NewInMemoryFS(), plainStore{store}, Owner{Id: 1})
+	dirEntries, err := immutableFs.ReadDir(".")
+	require.NoError(t, err)
+	assert.Len(t, dirEntries, 2)
+	assert.Equal(
+		t,
+		errDatabase,
+		EntriesByOwner(
+			nil, plainStore{errorStore{}}, 1, consume.AppendTo(&entries)))
+}
+
 func TestEntry_FormatTime(t *testing.T) {
 	atime := time.Date(2022, 3, 1, 16, 43, 54, 0, time.Local)
 	entry := Entry{Ts: atime.Unix()}
@@ -278,29 +831,90 @@ func (errorStore) AddEntry(t db.Transaction, entry *Entry) error {
 	return errDatabase
 }
 
-type fakeStore []Entry
+func (errorStore) TombstoneEntry(t db.Transaction, id, ownerId int64) error {
+	return errDatabase
+}
+
+func (errorStore) EntriesByOwner(
+	t db.Transaction, ownerId int64, consumer consume.Consumer) error {
+	return errDatabase
+}
+
+func (errorStore) ListEntries(
+	t db.Transaction,
+	ownerId int64,
+	order Order,
+	after *Entry,
+	consumer consume.Consumer) error {
+	return errDatabase
+}
+
+func (errorStore) TombstonedEntries(
+	t db.Transaction, ownerId int64, consumer consume.Consumer) error {
+	return errDatabase
+}
+
+func (errorStore) DeleteEntry(t db.Transaction, id, ownerId int64) error {
+	return errDatabase
+}
+
+func (errorStore) CountEntriesByChecksum(
+	t db.Transaction, ownerId int64, checksum string) (int, error) {
+	return 0, errDatabase
+}
 
-func newFakeStore() Store {
-	var store fakeStore
-	return &store
+// plainStore hides the optional methods of the Store it wraps.
+type plainStore struct {
+	Store
 }
 
-func (f *fakeStore) AddEntry(t db.Transaction, entry *Entry) error {
-	newId := int64(len(*f)) + 1
-	entry.Id = newId
-	*f = append(*f, *entry)
-	return nil
+// batchStore is a BatchStore that counts how it is called.
+type batchStore struct {
+	Store
+	batchCalls     int
+	entryByIdCalls int
 }
 
-func (f fakeStore) EntryById(
+func (b *batchStore) EntryById(
 	t db.Transaction, id, ownerId int64, entry *Entry) error {
-	index := int(id - 1)
-	if index < 0 || index >= len(f) {
-		return ErrNoSuchId
-	}
-	if ownerId != f[index].OwnerId {
-		return ErrNoSuchId
+	b.entryByIdCalls++
+	return b.Store.EntryById(t, id, ownerId, entry)
+}
+
+func (b *batchStore) EntriesByIds(
+	t db.Transaction,
+	ids []int64,
+	ownerId int64,
+	consumer consume.Consumer) error {
+	b.batchCalls++
+	return EntriesByIds(t, b.Store, ids, ownerId, consumer)
+}
+
+// newPurgingImmutableFS returns an ImmutableFS whose Purge removes
+// contents right away.
+func newPurgingImmutableFS(
+	fileSystem FS, store Store, owner Owner) ImmutableFS {
+	return NewImmutableFSWithOptions(
+		fileSystem,
+		store,
+		owner,
+		&ImmutableFSOptions{PurgeGracePeriod: time.Nanosecond})
+}
+
+// numTombstoned returns the number of entries of owner 1 in store marked
+// deleted.
+func numTombstoned(t *testing.T, store DeleteStore) int {
+	t.Helper()
+	var entries []Entry
+	require.NoError(
+		t, store.TombstonedEntries(nil, 1, consume.AppendTo(&entries)))
+	return len(entries)
+}
+
+func pageIds(page *Page) []string {
+	var result []string
+	for _, entry := range page.Entries {
+		result = append(result, strconv.FormatInt(entry.Id, 10))
 	}
-	*entry = f[index]
-	return nil
+	return result
 }
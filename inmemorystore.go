@@ -0,0 +1,261 @@
+package attachments
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/keep94/attachments/internal/idlist"
+	"github.com/keep94/consume"
+	"github.com/keep94/toolbox/db"
+)
+
+var (
+	errForeignTransaction = errors.New(
+		"attachments: Transaction not from this InMemoryStore's Do")
+)
+
+// InMemoryStore is a Store that keeps its records in memory. Like the
+// sqlite Store, InMemoryStore assigns ids starting at 1 and never reuses
+// the id of a deleted record. InMemoryStore can be used with multiple
+// goroutines. InMemoryStore also implements DeleteStore, OwnerStore,
+// BatchStore and db.Doer. The only non-nil db.Transaction that
+// InMemoryStore methods accept is the one that Do passes to its action.
+type InMemoryStore struct {
+	lock    sync.Mutex
+	entries []inMemoryEntry
+	lastId  int64
+}
+
+// NewInMemoryStore returns a new, empty InMemoryStore.
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{}
+}
+
+// Do runs action in a single transaction. If action returns an error, Do
+// undoes all the changes that action made and returns that same error.
+// While action runs, other goroutines wait to use this store. action must
+// pass the transaction it gets to every call it makes on this store.
+// Calling this store with a nil transaction from within action deadlocks.
+func (s *InMemoryStore) Do(action db.Action) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entries := make([]inMemoryEntry, len(s.entries))
+	copy(entries, s.entries)
+	lastId := s.lastId
+	t := &inMemoryTransaction{store: s}
+	err := action(t)
+	t.done = true
+	if err != nil {
+		s.entries = entries
+		s.lastId = lastId
+	}
+	return err
+}
+
+func (s *InMemoryStore) AddEntry(t db.Transaction, entry *Entry) error {
+	return s.do(t, func() error {
+		s.lastId++
+		entry.Id = s.lastId
+		s.entries = append(s.entries, inMemoryEntry{Entry: *entry})
+		return nil
+	})
+}
+
+func (s *InMemoryStore) EntryById(
+	t db.Transaction, id, ownerId int64, entry *Entry) error {
+	return s.do(t, func() error {
+		found, ok := s.find(id, ownerId)
+		if !ok || found.tombstoned {
+			return ErrNoSuchId
+		}
+		*entry = found.Entry
+		return nil
+	})
+}
+
+func (s *InMemoryStore) EntriesByIds(
+	t db.Transaction,
+	ids []int64,
+	ownerId int64,
+	consumer consume.Consumer) error {
+	var entries []Entry
+	err := s.do(t, func() error {
+		for _, id := range idlist.Sorted(ids) {
+			found, ok := s.find(id, ownerId)
+			if ok && !found.tombstoned {
+				entries = append(entries, found.Entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	consumeEntries(entries, consumer)
+	return nil
+}
+
+func (s *InMemoryStore) TombstoneEntry(
+	t db.Transaction, id, ownerId int64) error {
+	return s.do(t, func() error {
+		found, ok := s.find(id, ownerId)
+		if !ok || found.tombstoned {
+			return ErrNoSuchId
+		}
+		found.tombstoned = true
+		return nil
+	})
+}
+
+func (s *InMemoryStore) EntriesByOwner(
+	t db.Transaction, ownerId int64, consumer consume.Consumer) error {
+	entries, err := s.byOwner(t, ownerId, false)
+	if err != nil {
+		return err
+	}
+	consumeEntries(entries, consumer)
+	return nil
+}
+
+func (s *InMemoryStore) ListEntries(
+	t db.Transaction,
+	ownerId int64,
+	order Order,
+	after *Entry,
+	consumer consume.Consumer) error {
+	if !order.Valid() {
+		return ErrInvalidOrder
+	}
+	entries, err := s.byOwner(t, ownerId, false)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return order.Less(&entries[i], &entries[j])
+	})
+	if after != nil {
+		start := sort.Search(len(entries), func(i int) bool {
+			return order.Less(after, &entries[i])
+		})
+		entries = entries[start:]
+	}
+	consumeEntries(entries, consumer)
+	return nil
+}
+
+func (s *InMemoryStore) TombstonedEntries(
+	t db.Transaction, ownerId int64, consumer consume.Consumer) error {
+	entries, err := s.byOwner(t, ownerId, true)
+	if err != nil {
+		return err
+	}
+	consumeEntries(entries, consumer)
+	return nil
+}
+
+func (s *InMemoryStore) DeleteEntry(t db.Transaction, id, ownerId int64) error {
+	return s.do(t, func() error {
+		index, ok := s.index(id, ownerId)
+		if !ok {
+			return ErrNoSuchId
+		}
+		s.entries = append(s.entries[:index], s.entries[index+1:]...)
+		return nil
+	})
+}
+
+func (s *InMemoryStore) CountEntriesByChecksum(
+	t db.Transaction, ownerId int64, checksum string) (int, error) {
+	result := 0
+	err := s.do(t, func() error {
+		for i := range s.entries {
+			entry := &s.entries[i]
+			if entry.tombstoned || entry.OwnerId != ownerId {
+				continue
+			}
+			if entry.Checksum == checksum {
+				result++
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// do runs f on behalf of t and returns what f returns. If t is nil, do
+// runs f while holding the lock. Otherwise, t must be the transaction of
+// a Do call still in progress on this store which already holds the lock.
+// If it isn't, do returns an error without running f.
+func (s *InMemoryStore) do(t db.Transaction, f func() error) error {
+	if t == nil {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return f()
+	}
+	tx, ok := t.(*inMemoryTransaction)
+	if !ok || tx.store != s || tx.done {
+		return errForeignTransaction
+	}
+	return f()
+}
+
+// index returns the index of the entry with given id and owner.
+func (s *InMemoryStore) index(id, ownerId int64) (int, bool) {
+	index := sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].Id >= id
+	})
+	if index == len(s.entries) || s.entries[index].Id != id {
+		return 0, false
+	}
+	if s.entries[index].OwnerId != ownerId {
+		return 0, false
+	}
+	return index, true
+}
+
+// find returns the entry with given id and owner.
+func (s *InMemoryStore) find(id, ownerId int64) (*inMemoryEntry, bool) {
+	index, ok := s.index(id, ownerId)
+	if !ok {
+		return nil, false
+	}
+	return &s.entries[index], true
+}
+
+// byOwner returns copies of the entries of given owner ordered by id.
+func (s *InMemoryStore) byOwner(
+	t db.Transaction, ownerId int64, tombstoned bool) ([]Entry, error) {
+	var result []Entry
+	err := s.do(t, func() error {
+		for i := range s.entries {
+			entry := &s.entries[i]
+			if entry.OwnerId == ownerId && entry.tombstoned == tombstoned {
+				result = append(result, entry.Entry)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// consumeEntries passes entries to consumer until consumer can't consume
+// any more.
+func consumeEntries(entries []Entry, consumer consume.Consumer) {
+	for i := range entries {
+		if !consumer.CanConsume() {
+			return
+		}
+		consumer.Consume(&entries[i])
+	}
+}
+
+type inMemoryEntry struct {
+	Entry
+	tombstoned bool
+}
+
+type inMemoryTransaction struct {
+	store *InMemoryStore
+	done  bool
+}
@@ -0,0 +1,131 @@
+package attachments_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/keep94/attachments"
+	"github.com/keep94/attachments/attachmentsdb/fixture"
+	"github.com/keep94/toolbox/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryStore_EntryById(t *testing.T) {
+	fixture.EntryById(t, attachments.NewInMemoryStore())
+}
+
+func TestInMemoryStore_TombstoneEntry(t *testing.T) {
+	fixture.TombstoneEntry(t, attachments.NewInMemoryStore())
+}
+
+func TestInMemoryStore_EntriesByOwner(t *testing.T) {
+	fixture.EntriesByOwner(t, attachments.NewInMemoryStore())
+}
+
+func TestInMemoryStore_ListEntries(t *testing.T) {
+	fixture.ListEntries(t, attachments.NewInMemoryStore())
+}
+
+func TestInMemoryStore_EntriesByIds(t *testing.T) {
+	fixture.EntriesByIds(t, attachments.NewInMemoryStore())
+}
+
+func TestInMemoryStore_DeleteEntry(t *testing.T) {
+	fixture.DeleteEntry(t, attachments.NewInMemoryStore())
+}
+
+func TestInMemoryStore_Do(t *testing.T) {
+	store := attachments.NewInMemoryStore()
+	first := attachments.Entry{Name: "first", OwnerId: 1, Checksum: "1234"}
+	require.NoError(t, store.AddEntry(nil, &first))
+
+	errRollback := errors.New("rollback")
+	var second attachments.Entry
+	err := store.Do(func(t db.Transaction) error {
+		second = attachments.Entry{Name: "second", OwnerId: 1, Checksum: "1234"}
+		if err := store.AddEntry(t, &second); err != nil {
+			return err
+		}
+		if err := store.TombstoneEntry(t, first.Id, 1); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err)
+	var fetched attachments.Entry
+	require.NoError(t, store.EntryById(nil, first.Id, 1, &fetched))
+	assert.Equal(
+		t,
+		attachments.ErrNoSuchId,
+		store.EntryById(nil, second.Id, 1, &fetched))
+
+	err = store.Do(func(t db.Transaction) error {
+		return store.TombstoneEntry(t, first.Id, 1)
+	})
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		attachments.ErrNoSuchId,
+		store.EntryById(nil, first.Id, 1, &fetched))
+}
+
+func TestInMemoryStore_ForeignTransaction(t *testing.T) {
+	store := attachments.NewInMemoryStore()
+	other := attachments.NewInMemoryStore()
+	entry := attachments.Entry{Name: "name", OwnerId: 1, Checksum: "1234"}
+	assert.Error(t, store.AddEntry("not a transaction", &entry))
+	var finished db.Transaction
+	err := other.Do(func(t db.Transaction) error {
+		finished = t
+		return store.AddEntry(t, &entry)
+	})
+	assert.Error(t, err)
+	_, err = other.CountEntriesByChecksum(finished, 1, "1234")
+	assert.Error(t, err)
+	count, err := store.CountEntriesByChecksum(nil, 1, "1234")
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestInMemoryStore_Concurrent(t *testing.T) {
+	store := attachments.NewInMemoryStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				entry := attachments.Entry{
+					Name:     fmt.Sprintf("%d-%d", i, j),
+					OwnerId:  1,
+					Checksum: "1234",
+				}
+				store.AddEntry(nil, &entry)
+				store.CountEntriesByChecksum(nil, 1, "1234")
+			}
+		}(i)
+	}
+	wg.Wait()
+	count, err := store.CountEntriesByChecksum(nil, 1, "1234")
+	require.NoError(t, err)
+	assert.Equal(t, 500, count)
+}
+
+func TestInMemoryStore_ImmutableFS(t *testing.T) {
+	immutableFs := attachments.NewImmutableFS(
+		attachments.NewInMemoryFS(),
+		attachments.NewInMemoryStore(),
+		attachments.Owner{Id: 1})
+	id, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	contents, err := immutableFs.Open(fmt.Sprintf("%d/hello.txt", id))
+	require.NoError(t, err)
+	contents.Close()
+	require.NoError(t, immutableFs.Delete(id))
+	require.NoError(t, immutableFs.Purge())
+	_, err = immutableFs.Open(fmt.Sprintf("%d/hello.txt", id))
+	assert.Error(t, err)
+}
@@ -0,0 +1,20 @@
+// Package idlist works with lists of entry ids.
+package idlist
+
+import (
+	"sort"
+)
+
+// Sorted returns the distinct ids in ids sorted.
+func Sorted(ids []int64) []int64 {
+	result := make([]int64, 0, len(ids))
+	seen := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
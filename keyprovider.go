@@ -0,0 +1,227 @@
+package attachments
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/keep94/toolbox/kdf"
+)
+
+const (
+	// PassphraseReps is the number of repetitions that the KeyProvider
+	// that NewPassphraseKeyProvider returns uses to derive each key.
+	PassphraseReps = 10000
+)
+
+var (
+	// Indicates that a KeyProvider has no such key.
+	ErrNoSuchKey = errors.New("attachments: No such key")
+)
+
+// KeyProvider provides the encryption keys of owners. Each owner may have
+// several keys, each with its own version. The key with the highest
+// version is the current key which encrypts what the owner writes. Keys
+// with lower versions are old keys which stay around so that data
+// encrypted with them remains readable until RotateKey re-encrypts it.
+// Implementations must be safe to use with multiple goroutines.
+type KeyProvider interface {
+
+	// Versions returns the versions of the keys of given owner from
+	// newest to oldest. If the owner has no keys, Versions returns
+	// ErrNoSuchKey.
+	Versions(ownerId int64) ([]int, error)
+
+	// Key returns the key with given version of given owner. If there is
+	// no such key, Key returns ErrNoSuchKey.
+	Key(ownerId int64, version int) ([]byte, error)
+}
+
+// withKeys returns a copy of this owner with Key and OldKeys populated from
+// KeyProvider. If KeyProvider is nil, withKeys returns this owner as is.
+func (o Owner) withKeys() (Owner, error) {
+	if o.KeyProvider == nil {
+		return o, nil
+	}
+	versions, err := o.KeyProvider.Versions(o.Id)
+	if err != nil {
+		return Owner{}, err
+	}
+	if len(versions) == 0 {
+		return Owner{}, ErrNoSuchKey
+	}
+	keys := make([][]byte, len(versions))
+	for i, version := range versions {
+		keys[i], err = o.KeyProvider.Key(o.Id, version)
+		if err != nil {
+			return Owner{}, err
+		}
+	}
+	result := o
+	result.Key = keys[0]
+	result.OldKeys = keys[1:]
+	result.KeyProvider = nil
+	return result, nil
+}
+
+// KeyRing is an in memory KeyProvider. KeyRing is also what
+// ReadKeyRing returns for file based key rings. The zero value is
+// an empty KeyRing ready to use.
+type KeyRing struct {
+	mutex sync.Mutex
+	keys  map[int64]map[int][]byte
+}
+
+// NewKeyRing returns a new, empty KeyRing.
+func NewKeyRing() *KeyRing {
+	return &KeyRing{}
+}
+
+// ReadKeyRing reads a KeyRing from the file at path. Each line of the
+// file is of the form
+//
+//	ownerId version key
+//
+// where key is hexadecimal. Blank lines and lines starting with # are
+// ignored. Since the file holds raw keys, only the process using them
+// should be able to read it.
+func ReadKeyRing(path string) (*KeyRing, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	result := NewKeyRing()
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := result.addLine(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Add adds a key with given version for given owner replacing any
+// existing key with that same version.
+func (k *KeyRing) Add(ownerId int64, version int, key []byte) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.keys == nil {
+		k.keys = make(map[int64]map[int][]byte)
+	}
+	if k.keys[ownerId] == nil {
+		k.keys[ownerId] = make(map[int][]byte)
+	}
+	k.keys[ownerId][version] = append([]byte(nil), key...)
+}
+
+// Versions returns the versions of the keys of given owner from newest
+// to oldest.
+func (k *KeyRing) Versions(ownerId int64) ([]int, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	keys := k.keys[ownerId]
+	if len(keys) == 0 {
+		return nil, ErrNoSuchKey
+	}
+	result := make([]int, 0, len(keys))
+	for version := range keys {
+		result = append(result, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(result)))
+	return result, nil
+}
+
+// Key returns the key with given version of given owner.
+func (k *KeyRing) Key(ownerId int64, version int) ([]byte, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	key, ok := k.keys[ownerId][version]
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	return append([]byte(nil), key...), nil
+}
+
+func (k *KeyRing) addLine(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return errors.New("expected ownerId, version, and key")
+	}
+	ownerId, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	version, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return err
+	}
+	key, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return err
+	}
+	k.Add(ownerId, version, key)
+	return nil
+}
+
+// NewPassphraseKeyProvider returns a KeyProvider that derives the keys
+// of every owner from passphrases. passphrases maps each version to the
+// passphrase for that version. Each owner gets different keys from the
+// same passphrase. The returned KeyProvider caches the keys it derives
+// since deriving them is deliberately slow.
+func NewPassphraseKeyProvider(passphrases map[int]string) KeyProvider {
+	versions := make([]int, 0, len(passphrases))
+	copied := make(map[int]string, len(passphrases))
+	for version, passphrase := range passphrases {
+		versions = append(versions, version)
+		copied[version] = passphrase
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+	return &passphraseKeyProvider{
+		passphrases: copied,
+		versions:    versions,
+		cache:       NewKeyRing(),
+	}
+}
+
+type passphraseKeyProvider struct {
+	passphrases map[int]string
+	versions    []int
+	cache       *KeyRing
+}
+
+func (p *passphraseKeyProvider) Versions(ownerId int64) ([]int, error) {
+	if len(p.versions) == 0 {
+		return nil, ErrNoSuchKey
+	}
+	return append([]int(nil), p.versions...), nil
+}
+
+func (p *passphraseKeyProvider) Key(ownerId int64, version int) ([]byte, error) {
+	if key, err := p.cache.Key(ownerId, version); err == nil {
+		return key, nil
+	}
+	passphrase, ok := p.passphrases[version]
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	salt := fmt.Sprintf("attachments owner key %d %d", ownerId, version)
+	key := kdf.KDF([]byte(passphrase), []byte(salt), PassphraseReps)
+	p.cache.Add(ownerId, version, key)
+	return key, nil
+}
@@ -0,0 +1,151 @@
+package attachments
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keep94/toolbox/kdf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRing(t *testing.T) {
+	keyRing := NewKeyRing()
+	_, err := keyRing.Versions(1)
+	assert.Equal(t, ErrNoSuchKey, err)
+	key1 := kdf.Random(32)
+	key2 := kdf.Random(32)
+	keyRing.Add(1, 1, key1)
+	keyRing.Add(1, 3, key2)
+	keyRing.Add(2, 1, key2)
+	versions, err := keyRing.Versions(1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{3, 1}, versions)
+	key, err := keyRing.Key(1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, key2, key)
+	_, err = keyRing.Key(1, 2)
+	assert.Equal(t, ErrNoSuchKey, err)
+	_, err = keyRing.Key(3, 1)
+	assert.Equal(t, ErrNoSuchKey, err)
+
+	// Zero value is ready to use
+	var zero KeyRing
+	_, err = zero.Key(1, 1)
+	assert.Equal(t, ErrNoSuchKey, err)
+	zero.Add(1, 1, key1)
+	key, err = zero.Key(1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, key1, key)
+}
+
+func TestReadKeyRing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring")
+	contents := "# ownerId version key\n\n" +
+		"1 1 000102030405060708090a0b0c0d0e0f\n" +
+		"  1 2 0f0e0d0c0b0a09080706050403020100  \n"
+	require.NoError(t, os.WriteFile(path, ([]byte)(contents), 0600))
+	keyRing, err := ReadKeyRing(path)
+	require.NoError(t, err)
+	versions, err := keyRing.Versions(1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 1}, versions)
+	key, err := keyRing.Key(1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, key)
+
+	require.NoError(t, os.WriteFile(path, ([]byte)("1 1\n"), 0600))
+	_, err = ReadKeyRing(path)
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(path, ([]byte)("1 x 00\n"), 0600))
+	_, err = ReadKeyRing(path)
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(path, ([]byte)("1 1 xyz\n"), 0600))
+	_, err = ReadKeyRing(path)
+	assert.Error(t, err)
+	_, err = ReadKeyRing(filepath.Join(t.TempDir(), "missing"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPassphraseKeyProvider(t *testing.T) {
+	provider := NewPassphraseKeyProvider(
+		map[int]string{1: "open sesame", 2: "abracadabra"})
+	versions, err := provider.Versions(7)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 1}, versions)
+	key1, err := provider.Key(1, 2)
+	require.NoError(t, err)
+	assert.Len(t, key1, 32)
+	key2, err := provider.Key(2, 2)
+	require.NoError(t, err)
+	assert.NotEqual(t, key1, key2)
+	key3, err := provider.Key(1, 1)
+	require.NoError(t, err)
+	assert.NotEqual(t, key1, key3)
+	_, err = provider.Key(1, 3)
+	assert.Equal(t, ErrNoSuchKey, err)
+
+	// Same passphrase gives same keys
+	again, err := NewPassphraseKeyProvider(
+		map[int]string{2: "abracadabra"}).Key(1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, key1, again)
+
+	_, err = NewPassphraseKeyProvider(nil).Versions(1)
+	assert.Equal(t, ErrNoSuchKey, err)
+}
+
+func TestImmutableFS_KeyProvider(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	keyRing := NewKeyRing()
+	key1 := kdf.Random(32)
+	keyRing.Add(1, 1, key1)
+	owner := Owner{Id: 1, KeyProvider: keyRing}
+	immutableFs := NewImmutableFS(fakeFs, store, owner)
+	helloId, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	helloName := fmt.Sprintf("%d/hello.txt", helloId)
+	assertReadFile(t, immutableFs, helloName, "Hello World!")
+
+	// Encrypted with the key from the provider
+	assertReadFile(
+		t, NewImmutableFS(fakeFs, store, Owner{Id: 1, Key: key1}),
+		helloName, "Hello World!")
+
+	// Adding a new version keeps old data readable and new data gets
+	// the new key.
+	key2 := kdf.Random(32)
+	keyRing.Add(1, 2, key2)
+	goodbyeId, err := immutableFs.Write(
+		"goodbye.txt", ([]byte)("Goodbye World!"))
+	require.NoError(t, err)
+	goodbyeName := fmt.Sprintf("%d/goodbye.txt", goodbyeId)
+	assertReadFile(t, immutableFs, helloName, "Hello World!")
+	assertReadFile(
+		t, NewImmutableFS(fakeFs, store, Owner{Id: 1, Key: key2}),
+		goodbyeName, "Goodbye World!")
+
+	// Rotation uses the newest key
+	report, err := RotateKey(fakeFs, store, owner)
+	require.NoError(t, err)
+	assert.Len(t, report.Rotated, 1)
+	assert.Len(t, report.Current, 1)
+	assertReadFile(
+		t, NewImmutableFS(fakeFs, store, Owner{Id: 1, Key: key2}),
+		helloName, "Hello World!")
+
+	// Owners without keys get errors rather than unencrypted data
+	otherFs := NewImmutableFS(
+		fakeFs, store, Owner{Id: 2, KeyProvider: keyRing})
+	_, err = otherFs.Write("hello.txt", ([]byte)("Hello World!"))
+	assert.Equal(t, ErrNoSuchKey, err)
+	_, err = fs.ReadFile(
+		NewImmutableFS(fakeFs, store, Owner{Id: 1, KeyProvider: NewKeyRing()}),
+		helloName)
+	assert.ErrorIs(t, err, ErrNoSuchKey)
+}
@@ -0,0 +1,275 @@
+// Package kms provides an attachments.KeyProvider that keeps owner keys
+// wrapped by a key management service along with a local stand-in for
+// such a service.
+//
+// The protocol is JSON over HTTP. To wrap data, clients POST
+//
+//	{"keyName": "...", "context": "...", "data": "<base64>"}
+//
+// to /wrap. To unwrap data, clients POST the same to /unwrap. context is
+// optional. The service authenticates it along with the data, so
+// unwrapping fails unless it has the same context as wrapping. The
+// service responds with
+//
+//	{"data": "<base64>"}
+//
+// On error, the service responds with a non 200 status and a plain text
+// message.
+package kms
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/keep94/attachments"
+)
+
+const (
+	kMaxRequestSize = 64 * 1024
+)
+
+var (
+	// Indicates that the service has no key with the requested name.
+	ErrNoSuchKey = errors.New("kms: No such key")
+
+	// Indicates that the service could not unwrap data.
+	ErrUnwrap = errors.New("kms: Unable to unwrap")
+)
+
+type request struct {
+	KeyName string `json:"keyName"`
+	Context string `json:"context,omitempty"`
+	Data    []byte `json:"data"`
+}
+
+type response struct {
+	Data []byte `json:"data"`
+}
+
+// Server is a local stand-in for a key management service. Server keeps
+// its master keys in memory, so it is only suitable for tests and
+// development.
+type Server struct {
+	mutex sync.Mutex
+	keys  map[string]cipher.AEAD
+}
+
+// NewServer returns a new Server with no master keys.
+func NewServer() *Server {
+	return &Server{keys: make(map[string]cipher.AEAD)}
+}
+
+// AddKey adds a master key. key must be a valid AES key.
+func (s *Server) AddKey(name string, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys[name] = aead
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req request
+	decoder := json.NewDecoder(io.LimitReader(r.Body, kMaxRequestSize))
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	aead, ok := s.key(req.KeyName)
+	if !ok {
+		http.Error(w, ErrNoSuchKey.Error(), http.StatusNotFound)
+		return
+	}
+	var resp response
+	switch r.URL.Path {
+	case "/wrap":
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Data = aead.Seal(nonce, nonce, req.Data, req.additionalData())
+	case "/unwrap":
+		nonceSize := aead.NonceSize()
+		if len(req.Data) < nonceSize {
+			http.Error(w, ErrUnwrap.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := aead.Open(
+			nil,
+			req.Data[:nonceSize],
+			req.Data[nonceSize:],
+			req.additionalData())
+		if err != nil {
+			http.Error(w, ErrUnwrap.Error(), http.StatusBadRequest)
+			return
+		}
+		resp.Data = data
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// additionalData returns the data that wrapping authenticates along with
+// the wrapped data.
+func (r *request) additionalData() []byte {
+	return []byte(fmt.Sprintf("%d:%s%s", len(r.KeyName), r.KeyName, r.Context))
+}
+
+func (s *Server) key(name string) (cipher.AEAD, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	aead, ok := s.keys[name]
+	return aead, ok
+}
+
+// Client talks to a key management service.
+type Client struct {
+
+	// The base URL of the service e.g "http://localhost:8080"
+	URL string
+
+	// The HTTP client to use. nil means http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// Wrap wraps data with the master key called keyName.
+func (c *Client) Wrap(keyName string, data []byte) ([]byte, error) {
+	return c.call("/wrap", keyName, "", data)
+}
+
+// Unwrap unwraps data with the master key called keyName.
+func (c *Client) Unwrap(keyName string, data []byte) ([]byte, error) {
+	return c.call("/unwrap", keyName, "", data)
+}
+
+// WrapKey wraps the key of given owner and version with the master key
+// called keyName for use with NewKeyProvider. The wrapped key is bound to
+// ownerId and version, so the KeyProvider fails to unwrap it if it is
+// stored under a different owner or version.
+func (c *Client) WrapKey(
+	keyName string, ownerId int64, version int, key []byte) ([]byte, error) {
+	return c.call("/wrap", keyName, keyContext(ownerId, version), key)
+}
+
+func (c *Client) unwrapKey(
+	keyName string,
+	ownerId int64,
+	version int,
+	wrappedKey []byte) ([]byte, error) {
+	return c.call(
+		"/unwrap", keyName, keyContext(ownerId, version), wrappedKey)
+}
+
+func (c *Client) call(
+	path, keyName, context string, data []byte) ([]byte, error) {
+	body, err := json.Marshal(
+		&request{KeyName: keyName, Context: context, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Post(
+		strings.TrimSuffix(c.URL, "/")+path,
+		"application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	reader := io.LimitReader(resp.Body, kMaxRequestSize)
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(reader)
+		switch strings.TrimSpace(string(message)) {
+		case ErrNoSuchKey.Error():
+			return nil, ErrNoSuchKey
+		case ErrUnwrap.Error():
+			return nil, ErrUnwrap
+		}
+		return nil, fmt.Errorf(
+			"kms: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	var result response
+	if err := json.NewDecoder(reader).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
+
+// NewKeyProvider returns a KeyProvider whose keys are the keys in
+// wrappedKeys unwrapped by client with the master key called keyName.
+// wrappedKeys is typically an attachments.KeyRing read from a file
+// which is safe to store since the keys in it are wrapped. The keys in
+// wrappedKeys must come from client.WrapKey with the same owner and
+// version they are stored under. The returned KeyProvider caches the keys
+// it unwraps.
+func NewKeyProvider(
+	client *Client,
+	keyName string,
+	wrappedKeys attachments.KeyProvider) attachments.KeyProvider {
+	return &keyProvider{
+		client:      client,
+		keyName:     keyName,
+		wrappedKeys: wrappedKeys,
+		cache:       attachments.NewKeyRing(),
+	}
+}
+
+type keyProvider struct {
+	client      *Client
+	keyName     string
+	wrappedKeys attachments.KeyProvider
+	cache       *attachments.KeyRing
+}
+
+// keyContext returns the context that binds a wrapped key to its owner
+// and version.
+func keyContext(ownerId int64, version int) string {
+	return fmt.Sprintf("owner=%d;version=%d", ownerId, version)
+}
+
+func (k *keyProvider) Versions(ownerId int64) ([]int, error) {
+	return k.wrappedKeys.Versions(ownerId)
+}
+
+func (k *keyProvider) Key(ownerId int64, version int) ([]byte, error) {
+	if key, err := k.cache.Key(ownerId, version); err == nil {
+		return key, nil
+	}
+	wrappedKey, err := k.wrappedKeys.Key(ownerId, version)
+	if err != nil {
+		return nil, err
+	}
+	key, err := k.client.unwrapKey(k.keyName, ownerId, version, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	k.cache.Add(ownerId, version, key)
+	return key, nil
+}
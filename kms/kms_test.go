@@ -0,0 +1,110 @@
+package kms_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/keep94/attachments"
+	"github.com/keep94/attachments/kms"
+	"github.com/keep94/toolbox/kdf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	server := kms.NewServer()
+	require.NoError(t, server.AddKey("master", kdf.Random(32)))
+	require.NoError(t, server.AddKey("other", kdf.Random(32)))
+	assert.Error(t, server.AddKey("bad", kdf.Random(25)))
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	client := &kms.Client{URL: httpServer.URL}
+
+	key := kdf.Random(32)
+	wrapped, err := client.Wrap("master", key)
+	require.NoError(t, err)
+	assert.NotEqual(t, key, wrapped)
+	unwrapped, err := client.Unwrap("master", wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	_, err = client.Unwrap("other", wrapped)
+	assert.Equal(t, kms.ErrUnwrap, err)
+	_, err = client.Unwrap("missing", wrapped)
+	assert.Equal(t, kms.ErrNoSuchKey, err)
+	_, err = client.Wrap("missing", key)
+	assert.Equal(t, kms.ErrNoSuchKey, err)
+	wrapped[len(wrapped)-1] ^= 1
+	_, err = client.Unwrap("master", wrapped)
+	assert.Equal(t, kms.ErrUnwrap, err)
+	_, err = client.Unwrap("master", wrapped[:3])
+	assert.Equal(t, kms.ErrUnwrap, err)
+
+	_, err = (&kms.Client{URL: httpServer.URL + "/nowhere"}).Wrap("master", key)
+	assert.Error(t, err)
+	resp, err := http.Get(httpServer.URL + "/wrap")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp, err = http.Post(
+		httpServer.URL+"/wrap", "application/json", strings.NewReader("{"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestKeyProvider(t *testing.T) {
+	server := kms.NewServer()
+	require.NoError(t, server.AddKey("master", kdf.Random(32)))
+	httpServer := httptest.NewServer(server)
+	client := &kms.Client{URL: httpServer.URL}
+
+	key1 := kdf.Random(32)
+	key2 := kdf.Random(16)
+	wrappedKeys := attachments.NewKeyRing()
+	wrapped1, err := client.WrapKey("master", 1, 1, key1)
+	require.NoError(t, err)
+	wrappedKeys.Add(1, 1, wrapped1)
+	wrapped, err := client.WrapKey("master", 1, 2, key2)
+	require.NoError(t, err)
+	wrappedKeys.Add(1, 2, wrapped)
+
+	provider := kms.NewKeyProvider(client, "master", wrappedKeys)
+	versions, err := provider.Versions(1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 1}, versions)
+	key, err := provider.Key(1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, key1, key)
+	key, err = provider.Key(1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, key2, key)
+	_, err = provider.Key(2, 1)
+	assert.Equal(t, attachments.ErrNoSuchKey, err)
+
+	// Wrapped keys moved to another owner or version don't unwrap
+	wrappedKeys.Add(2, 1, wrapped1)
+	_, err = provider.Key(2, 1)
+	assert.Equal(t, kms.ErrUnwrap, err)
+	wrappedKeys.Add(1, 4, wrapped1)
+	_, err = provider.Key(1, 4)
+	assert.Equal(t, kms.ErrUnwrap, err)
+	plainWrapped, err := client.Wrap("master", key1)
+	require.NoError(t, err)
+	wrappedKeys.Add(1, 5, plainWrapped)
+	_, err = provider.Key(1, 5)
+	assert.Equal(t, kms.ErrUnwrap, err)
+
+	// Keys are cached once unwrapped
+	httpServer.Close()
+	key, err = provider.Key(1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, key2, key)
+
+	// Keys that aren't cached fail while the service is down
+	wrappedKeys.Add(1, 3, wrapped)
+	_, err = provider.Key(1, 3)
+	assert.Error(t, err)
+}
@@ -0,0 +1,192 @@
+package attachments
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+
+	"github.com/keep94/consume"
+)
+
+// MigrateReport reports what MigrateBlobNames did.
+type MigrateReport struct {
+
+	// The number of distinct checksums examined
+	Scanned int
+
+	// The checksums of the blobs renamed
+	Migrated []string
+
+	// The checksums of the blobs left alone because they are corrupt or
+	// because none of the owner's keys could decrypt them.
+	Failed []string
+}
+
+// MigrateBlobNames renames the blobs on fileSystem that owner's entries in
+// store reference from their plain checksums to the names that
+// owner.NameKey derives. Blobs in the legacy format, which can't be
+// decrypted without knowing their checksum, are re-encrypted in the
+// current format along the way. Since each blob is renamed in a single
+// step and an ImmutableFS whose owner has a NameKey falls back to plain
+// names, the owner's files stay readable throughout. If MigrateBlobNames
+// fails or the process crashes, running it again picks up where it left
+// off. Unreferenced blobs are not renamed; CollectGarbage removes them
+// once owner has a NameKey.
+func MigrateBlobNames(
+	fileSystem FS, store Store, owner Owner) (*MigrateReport, error) {
+	if owner.NameKey == nil {
+		return nil, errors.New("attachments: Owner has no NameKey")
+	}
+	owner, err := owner.withKeys()
+	if err != nil {
+		return nil, err
+	}
+	checksums, err := referencedChecksums(store, owner.Id)
+	if err != nil {
+		return nil, err
+	}
+	migrator := &blobNameMigrator{
+		aesFS:  &aesFS{FileSystem: fileSystem, Owner: owner},
+		report: &MigrateReport{},
+	}
+	for _, checksum := range checksums {
+		if err := migrator.migrate(checksum); err != nil {
+			return nil, err
+		}
+	}
+	return migrator.report, nil
+}
+
+type blobNameMigrator struct {
+	aesFS  *aesFS
+	report *MigrateReport
+}
+
+func (b *blobNameMigrator) migrate(checksum string) error {
+	name, err := b.aesFS.blobPath(checksum)
+	if err != nil {
+		// Not a checksum that Write produced
+		return nil
+	}
+	b.report.Scanned++
+	fileSystem := b.aesFS.FileSystem
+	plainName := idToPath(checksum, b.aesFS.Owner.Id)
+	if !fileSystem.Exists(plainName) {
+		return nil
+	}
+	if fileSystem.Exists(name) {
+		// A crash happened after the blob was copied but before the
+		// plain name was removed, or a later write stored the same data
+		// again.
+		err = Remove(fileSystem, plainName)
+	} else {
+		err = b.rename(checksum, plainName, name)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err == ErrCorrupt || err == ErrWrongKey {
+		b.report.Failed = append(b.report.Failed, checksum)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b.report.Migrated = append(b.report.Migrated, checksum)
+	return nil
+}
+
+// rename moves the blob at plainName to name converting it to the current
+// format if it is in the legacy format.
+func (b *blobNameMigrator) rename(checksum, plainName, name string) error {
+	legacy, err := b.isLegacy(plainName)
+	if err != nil {
+		return err
+	}
+	fileSystem := b.aesFS.FileSystem
+	if !legacy {
+		return rename(fileSystem, plainName, name)
+	}
+	stagingName, err := stagingPath(b.aesFS.Owner.Id)
+	if err != nil {
+		return err
+	}
+	err = b.convert(checksum, plainName, stagingName)
+	if err == nil {
+		err = rename(fileSystem, stagingName, name)
+	}
+	if err != nil {
+		Remove(fileSystem, stagingName)
+		return err
+	}
+	return Remove(fileSystem, plainName)
+}
+
+// convert writes the legacy blob at plainName to stagingName in the
+// current format. convert returns ErrCorrupt if the blob doesn't decrypt
+// to data with given checksum.
+func (b *blobNameMigrator) convert(
+	checksum, plainName, stagingName string) error {
+	binaryId, err := hex.DecodeString(checksum)
+	if err != nil {
+		return err
+	}
+	reader, err := b.aesFS.openBlob(plainName, binaryId)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	_, err = b.aesFS.write(stagingName, io.TeeReader(reader, hash))
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != checksum {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// isLegacy returns true if the blob at name is encrypted in the legacy
+// format.
+func (b *blobNameMigrator) isLegacy(name string) (bool, error) {
+	if !b.aesFS.Owner.encrypted() {
+		return false, nil
+	}
+	reader, err := b.aesFS.FileSystem.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	magic, _ := bufio.NewReader(reader).Peek(len(kMagic))
+	return !hasMagic(magic), nil
+}
+
+// referencedChecksums returns the distinct checksums of the entries of
+// given owner including those marked deleted. If store isn't a
+// DeleteStore, no entries are marked deleted.
+func referencedChecksums(store Store, ownerId int64) ([]string, error) {
+	var result []string
+	seen := make(map[string]bool)
+	consumer := consume.ConsumerFunc(func(ptr interface{}) {
+		checksum := ptr.(*Entry).Checksum
+		if !seen[checksum] {
+			seen[checksum] = true
+			result = append(result, checksum)
+		}
+	})
+	if err := EntriesByOwner(nil, store, ownerId, consumer); err != nil {
+		return nil, err
+	}
+	d, ok := store.(DeleteStore)
+	if !ok {
+		return result, nil
+	}
+	if err := d.TombstonedEntries(nil, ownerId, consumer); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
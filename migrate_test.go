@@ -0,0 +1,182 @@
+package attachments
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keep94/toolbox/kdf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameKey(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	owner := Owner{Id: 1, Key: kdf.Random(32), NameKey: kdf.Random(32)}
+	immutableFs := newPurgingImmutableFS(fakeFs, store, owner)
+	helloId, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	helloName := fmt.Sprintf("%d/hello.txt", helloId)
+	assertReadFile(t, immutableFs, helloName, "Hello World!")
+
+	// The entry has the plain checksum, but the blob name doesn't reveal it
+	var entry Entry
+	require.NoError(t, store.EntryById(nil, helloId, 1, &entry))
+	assert.Equal(t, checksumOf("Hello World!"), entry.Checksum)
+	names, err := List(fakeFs, "")
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	id, ok := pathToId(names[0], 1)
+	require.True(t, ok)
+	assert.NotEqual(t, entry.Checksum, id)
+
+	// Other owners get different names for the same data
+	otherOwner := Owner{Id: 2, Key: kdf.Random(32), NameKey: kdf.Random(32)}
+	_, err = NewImmutableFS(fakeFs, store, otherOwner).Write(
+		"hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	names, err = List(fakeFs, "2/")
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	otherId, ok := pathToId(names[0], 2)
+	require.True(t, ok)
+	assert.NotEqual(t, id, otherId)
+
+	// Dedup still works
+	_, err = immutableFs.WriteFrom(
+		"hello2.txt", strings.NewReader("Hello World!"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, numFiles(fakeFs))
+
+	// Delete and purge find the blob
+	require.NoError(t, immutableFs.Delete(helloId))
+	require.NoError(t, immutableFs.Purge())
+	assert.Equal(t, 2, numFiles(fakeFs))
+	entries, err := immutableFs.List(nil, map[int64]bool{3: true})
+	require.NoError(t, err)
+	require.NoError(t, immutableFs.Delete(entries[0].Id))
+	require.NoError(t, immutableFs.Purge())
+	assert.Equal(t, 1, numFiles(fakeFs))
+
+	// Key rotation works with derived names
+	goodbyeId, err := immutableFs.Write(
+		"goodbye.txt", ([]byte)("Goodbye World!"))
+	require.NoError(t, err)
+	rotatedOwner := owner
+	rotatedOwner.Key = kdf.Random(32)
+	rotatedOwner.OldKeys = [][]byte{owner.Key}
+	report, err := RotateKey(fakeFs, store, rotatedOwner)
+	require.NoError(t, err)
+	assert.Len(t, report.Rotated, 1)
+	assert.Empty(t, report.Failed)
+	rotatedOwner.OldKeys = nil
+	assertReadFile(
+		t,
+		NewImmutableFS(fakeFs, store, rotatedOwner),
+		fmt.Sprintf("%d/goodbye.txt", goodbyeId),
+		"Goodbye World!")
+}
+
+func TestMigrateBlobNames(t *testing.T) {
+	fileSystem, err := NewFS(t.TempDir())
+	require.NoError(t, err)
+	assertMigrateBlobNames(t, fileSystem)
+	assertMigrateBlobNames(t, NewInMemoryFS())
+}
+
+func TestMigrateBlobNames_NoNameKey(t *testing.T) {
+	_, err := MigrateBlobNames(
+		NewInMemoryFS(), NewInMemoryStore(), Owner{Id: 1, Key: kdf.Random(32)})
+	assert.Error(t, err)
+}
+
+func TestMigrateBlobNames_DBError(t *testing.T) {
+	_, err := MigrateBlobNames(
+		NewInMemoryFS(), errorStore{}, Owner{Id: 1, NameKey: kdf.Random(32)})
+	assert.Equal(t, errDatabase, err)
+}
+
+func assertMigrateBlobNames(t *testing.T, fileSystem FS) {
+	store := NewInMemoryStore()
+	oldOwner := Owner{Id: 1, Key: kdf.Random(32)}
+	immutableFs := NewImmutableFS(fileSystem, store, oldOwner)
+	helloId, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	goodbyeId, err := immutableFs.Write(
+		"goodbye.txt", ([]byte)("Goodbye World!"))
+	require.NoError(t, err)
+	require.NoError(t, immutableFs.Delete(goodbyeId))
+	legacyChecksum := writeLegacyBlob(
+		t,
+		&aesFS{FileSystem: fileSystem, Owner: oldOwner},
+		([]byte)("Legacy"))
+	legacyEntry := Entry{
+		Name: "legacy.txt", Size: 6, OwnerId: 1, Checksum: legacyChecksum}
+	require.NoError(t, store.AddEntry(nil, &legacyEntry))
+	orphanId, err := (&aesFS{FileSystem: fileSystem, Owner: oldOwner}).Write(
+		([]byte)("Orphan"))
+	require.NoError(t, err)
+
+	// Before migration, files are still readable
+	owner := oldOwner
+	owner.NameKey = kdf.Random(32)
+	keyedFs := newPurgingImmutableFS(fileSystem, store, owner)
+	helloName := fmt.Sprintf("%d/hello.txt", helloId)
+	legacyName := fmt.Sprintf("%d/legacy.txt", legacyEntry.Id)
+	assertReadFile(t, keyedFs, helloName, "Hello World!")
+	assertReadFile(t, keyedFs, legacyName, "Legacy")
+
+	// Nor does GC collect blobs with plain names
+	report, err := CollectGarbage(
+		fileSystem,
+		store,
+		owner,
+		&GCOptions{GracePeriod: time.Nanosecond, DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{orphanId}, report.Collected)
+
+	migrateReport, err := MigrateBlobNames(fileSystem, store, owner)
+	require.NoError(t, err)
+	assert.Equal(t, 3, migrateReport.Scanned)
+	assert.ElementsMatch(
+		t,
+		[]string{
+			checksumOf("Hello World!"),
+			checksumOf("Goodbye World!"),
+			legacyChecksum,
+		},
+		migrateReport.Migrated)
+	assert.Empty(t, migrateReport.Failed)
+	assert.False(
+		t, fileSystem.Exists(idToPath(checksumOf("Hello World!"), 1)))
+	assert.False(t, fileSystem.Exists(idToPath(legacyChecksum, 1)))
+
+	// Legacy blobs are converted along the way
+	legacyPath, err := (&aesFS{Owner: owner}).blobPath(legacyChecksum)
+	require.NoError(t, err)
+	assert.True(t, hasMagic(readBytes(fileSystem, legacyPath)))
+
+	assertReadFile(t, keyedFs, helloName, "Hello World!")
+	assertReadFile(t, keyedFs, legacyName, "Legacy")
+
+	// Running again does nothing
+	migrateReport, err = MigrateBlobNames(fileSystem, store, owner)
+	require.NoError(t, err)
+	assert.Empty(t, migrateReport.Migrated)
+
+	// Now GC collects only the orphan
+	report, err = CollectGarbage(
+		fileSystem, store, owner, &GCOptions{GracePeriod: time.Nanosecond})
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Scanned)
+	assert.Equal(t, []string{orphanId}, report.Collected)
+	assertReadFile(t, keyedFs, helloName, "Hello World!")
+
+	// Purge removes the blob of the deleted entry
+	require.NoError(t, keyedFs.Purge())
+	names, err := List(fileSystem, "1/")
+	require.NoError(t, err)
+	assert.Len(t, names, 2)
+}
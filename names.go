@@ -0,0 +1,126 @@
+package attachments
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// DefaultMaxNameLength is the longest file name in bytes that
+	// ImmutableFS accepts when NamePolicy doesn't say.
+	DefaultMaxNameLength = 255
+)
+
+// InvalidNameError is returned when ImmutableFS refuses a file name.
+// errors.Is(err, fs.ErrInvalid) returns true for InvalidNameError.
+type InvalidNameError struct {
+
+	// The name refused
+	Name string
+
+	// Why the name was refused
+	Reason string
+}
+
+func (e *InvalidNameError) Error() string {
+	return fmt.Sprintf("attachments: invalid name %q: %s", e.Name, e.Reason)
+}
+
+func (e *InvalidNameError) Is(target error) bool {
+	return target == fs.ErrInvalid
+}
+
+// NamePolicy says how ImmutableFS validates and normalizes the names of
+// new files. Whatever the policy, names are converted to Unicode NFC, and
+// a name can't be empty, ".", or "..". Path separators, '/' and '\',
+// control characters, and invalid UTF-8 are never stored; the policy
+// decides whether they are replaced or refused. A nil *NamePolicy means
+// the default policy which refuses them.
+type NamePolicy struct {
+
+	// The longest name allowed in bytes after normalization. Zero means
+	// DefaultMaxNameLength.
+	MaxLength int
+
+	// If non-empty, each path separator, control character, and invalid
+	// UTF-8 sequence is replaced with Replacement instead of the name
+	// being refused. If Replacement itself contains such characters,
+	// names are refused as if Replacement were empty.
+	Replacement string
+}
+
+func (p *NamePolicy) maxLength() int {
+	if p == nil || p.MaxLength == 0 {
+		return DefaultMaxNameLength
+	}
+	return p.MaxLength
+}
+
+func (p *NamePolicy) replacement() string {
+	if p == nil {
+		return ""
+	}
+	return p.Replacement
+}
+
+// Normalize returns name as this policy would store it. If this policy
+// refuses name, Normalize returns an *InvalidNameError.
+func (p *NamePolicy) Normalize(name string) (string, error) {
+	result, ok := replaceInvalid(name, p.replacement())
+	if !ok {
+		return "", &InvalidNameError{
+			Name:   name,
+			Reason: "contains a path separator, control character, or invalid UTF-8",
+		}
+	}
+	result = norm.NFC.String(result)
+	switch result {
+	case "":
+		return "", &InvalidNameError{Name: name, Reason: "empty"}
+	case ".", "..":
+		return "", &InvalidNameError{Name: name, Reason: "reserved"}
+	}
+	if len(result) > p.maxLength() {
+		return "", &InvalidNameError{
+			Name:   name,
+			Reason: fmt.Sprintf("longer than %d bytes", p.maxLength()),
+		}
+	}
+	return result, nil
+}
+
+// replaceInvalid replaces each path separator, control character, and
+// invalid UTF-8 sequence in name with replacement. replaceInvalid returns
+// false if it finds one of these and replacement is empty or contains one
+// of these itself.
+func replaceInvalid(name, replacement string) (string, bool) {
+	if replacement != "" {
+		if _, ok := replaceInvalid(replacement, ""); !ok {
+			replacement = ""
+		}
+	}
+	var sb strings.Builder
+	for len(name) > 0 {
+		r, size := utf8.DecodeRuneInString(name)
+		if (r == utf8.RuneError && size == 1) || invalidNameRune(r) {
+			if replacement == "" {
+				return "", false
+			}
+			sb.WriteString(replacement)
+		} else {
+			sb.WriteString(name[:size])
+		}
+		name = name[size:]
+	}
+	return sb.String(), true
+}
+
+// invalidNameRune returns true if r can't appear in a file name.
+func invalidNameRune(r rune) bool {
+	return r == '/' || r == '\\' || unicode.IsControl(r)
+}
@@ -0,0 +1,71 @@
+package attachments
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamePolicy_Normalize(t *testing.T) {
+	var policy *NamePolicy
+	assertName(t, policy, "document.pdf", "document.pdf")
+	assertName(t, policy, "caf\u00e9.txt", "caf\u00e9.txt")
+	assertName(t, policy, "cafe\u0301.txt", "caf\u00e9.txt")
+	assertName(t, policy, "..txt", "..txt")
+	assertName(t, policy, "a\ufffdb", "a\ufffdb")
+	assertName(t, policy, strings.Repeat("a", 255), strings.Repeat("a", 255))
+	assertInvalidName(t, policy, "")
+	assertInvalidName(t, policy, ".")
+	assertInvalidName(t, policy, "..")
+	assertInvalidName(t, policy, "a/b.txt")
+	assertInvalidName(t, policy, `a\b.txt`)
+	assertInvalidName(t, policy, "a\nb.txt")
+	assertInvalidName(t, policy, "a\x00b.txt")
+	assertInvalidName(t, policy, "a\x7fb.txt")
+	assertInvalidName(t, policy, "a\u0085b.txt")
+	assertInvalidName(t, policy, "a\xffb.txt")
+	assertInvalidName(t, policy, strings.Repeat("a", 256))
+
+	// 3 bytes decomposed but 2 bytes composed
+	assertName(
+		t,
+		policy,
+		strings.Repeat("a", 253)+"e\u0301",
+		strings.Repeat("a", 253)+"\u00e9")
+}
+
+func TestNamePolicy_Replacement(t *testing.T) {
+	policy := &NamePolicy{MaxLength: 10, Replacement: "_"}
+	assertName(t, policy, "a/b\\c\td", "a_b_c_d")
+	assertName(t, policy, "a\xff\xfeb", "a__b")
+	assertName(t, policy, "/", "_")
+	assertInvalidName(t, policy, "..")
+	assertInvalidName(t, policy, "")
+	assertInvalidName(t, policy, "abcdefghijk")
+
+	// Replacement with invalid characters refuses instead
+	policy = &NamePolicy{Replacement: "/"}
+	assertInvalidName(t, policy, "a/b")
+	assertName(t, policy, "ab", "ab")
+}
+
+func assertName(t *testing.T, policy *NamePolicy, name, expected string) {
+	t.Helper()
+	actual, err := policy.Normalize(name)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func assertInvalidName(t *testing.T, policy *NamePolicy, name string) {
+	t.Helper()
+	_, err := policy.Normalize(name)
+	assert.True(t, errors.Is(err, fs.ErrInvalid))
+	var nameErr *InvalidNameError
+	if assert.True(t, errors.As(err, &nameErr)) {
+		assert.Equal(t, name, nameErr.Name)
+	}
+}
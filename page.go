@@ -0,0 +1,195 @@
+package attachments
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/keep94/consume"
+	"github.com/keep94/toolbox/db"
+)
+
+const (
+	// DefaultPageSize is the number of files ListPage returns when
+	// PageOptions doesn't say.
+	DefaultPageSize = 50
+)
+
+var (
+	// Indicates that a cursor is malformed or was issued for a different
+	// sort order.
+	ErrInvalidCursor = errors.New("attachments: Invalid cursor")
+
+	// Indicates that an Order has an unknown SortBy.
+	ErrInvalidOrder = errors.New("attachments: Invalid order")
+)
+
+// SortBy specifies the field by which to sort files.
+type SortBy int
+
+const (
+	SortById SortBy = iota
+	SortByName
+	SortBySize
+	SortByTs
+)
+
+// Order specifies how to sort files. Files that compare equal on the
+// SortBy field are sorted by Id in the same direction. Names compare
+// byte by byte.
+type Order struct {
+	SortBy     SortBy
+	Descending bool
+}
+
+// Valid returns true if o has a known SortBy.
+func (o Order) Valid() bool {
+	return o.SortBy >= SortById && o.SortBy <= SortByTs
+}
+
+// Less returns true if e1 comes before e2 in this order.
+func (o Order) Less(e1, e2 *Entry) bool {
+	if o.Descending {
+		e1, e2 = e2, e1
+	}
+	switch o.SortBy {
+	case SortByName:
+		if e1.Name != e2.Name {
+			return e1.Name < e2.Name
+		}
+	case SortBySize:
+		if e1.Size != e2.Size {
+			return e1.Size < e2.Size
+		}
+	case SortByTs:
+		if e1.Ts != e2.Ts {
+			return e1.Ts < e2.Ts
+		}
+	}
+	return e1.Id < e2.Id
+}
+
+// PageOptions contains options for ListPage.
+type PageOptions struct {
+
+	// How to sort the files
+	Order Order
+
+	// The maximum number of files to return. Zero means DefaultPageSize.
+	Limit int
+
+	// The NextCursor of the previous page. Empty means the first page.
+	// Cursor must have come from a page with the same Order.
+	Cursor string
+}
+
+func (p *PageOptions) order() Order {
+	if p == nil {
+		return Order{}
+	}
+	return p.Order
+}
+
+func (p *PageOptions) limit() int {
+	if p == nil || p.Limit <= 0 {
+		return DefaultPageSize
+	}
+	return p.Limit
+}
+
+func (p *PageOptions) cursor() string {
+	if p == nil {
+		return ""
+	}
+	return p.Cursor
+}
+
+// Page is a page of files.
+type Page struct {
+
+	// The files in this page
+	Entries []*Entry
+
+	// The cursor for the next page. Empty if this is the last page.
+	NextCursor string
+}
+
+// cursor is what an encoded cursor string holds: the order and the
+// fields of the last entry in a page that any order needs.
+type cursor struct {
+	SortBy     SortBy `json:"o"`
+	Descending bool   `json:"d,omitempty"`
+	Id         int64  `json:"i"`
+	Name       string `json:"n,omitempty"`
+	Size       int64  `json:"s,omitempty"`
+	Ts         int64  `json:"t,omitempty"`
+}
+
+func encodeCursor(order Order, entry *Entry) string {
+	encoded, err := json.Marshal(&cursor{
+		SortBy:     order.SortBy,
+		Descending: order.Descending,
+		Id:         entry.Id,
+		Name:       entry.Name,
+		Size:       entry.Size,
+		Ts:         entry.Ts,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// decodeCursor returns the entry that encoded marks the position after.
+// decodeCursor returns ErrInvalidCursor if encoded is malformed or
+// wasn't issued for order.
+func decodeCursor(order Order, encoded string) (*Entry, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(decoded, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.SortBy != order.SortBy || c.Descending != order.Descending {
+		return nil, ErrInvalidCursor
+	}
+	return &Entry{Id: c.Id, Name: c.Name, Size: c.Size, Ts: c.Ts}, nil
+}
+
+// listPage returns a page of the files of given owner in store.
+func listPage(
+	t db.Transaction,
+	store Store,
+	ownerId int64,
+	options *PageOptions) (*Page, error) {
+	order := options.order()
+	if !order.Valid() {
+		return nil, ErrInvalidOrder
+	}
+	var after *Entry
+	if encoded := options.cursor(); encoded != "" {
+		var err error
+		after, err = decodeCursor(order, encoded)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var entries []Entry
+	var morePages bool
+	consumer := consume.Page(0, options.limit(), &entries, &morePages)
+	err := store.ListEntries(t, ownerId, order, after, consumer)
+	if err != nil {
+		return nil, err
+	}
+	consumer.Finalize()
+	result := &Page{Entries: make([]*Entry, len(entries))}
+	for i := range entries {
+		result.Entries[i] = &entries[i]
+	}
+	if morePages {
+		result.NextCursor = encodeCursor(order, &entries[len(entries)-1])
+	}
+	return result, nil
+}
@@ -0,0 +1,251 @@
+package attachments
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	errNegativeOffset = errors.New("attachments: Negative offset")
+)
+
+// openReaderAt returns an io.ReaderAt that reads the plaintext of the data
+// with given checksum at any offset. Unlike the reader from Open, the
+// returned io.ReaderAt can't tell whether the data matches checksum. When
+// done, the caller must close the returned io.Closer. If the readers of
+// the underlying file system don't implement io.ReaderAt, each ReadAt
+// reads the data from the start.
+func (a *aesFS) openReaderAt(
+	checksum string) (io.ReaderAt, io.Closer, error) {
+	a, err := a.withKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	name, binaryId, err := a.resolve(checksum)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := a.FileSystem.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	readerAt, ok := reader.(io.ReaderAt)
+	if !ok {
+		reader.Close()
+		return &reopeningReaderAt{
+			open: func() (io.ReadCloser, error) {
+				return a.openBlob(name, binaryId)
+			},
+		}, nopCloser{}, nil
+	}
+	if !a.Owner.encrypted() {
+		return readerAt, reader, nil
+	}
+	decReaderAt, err := a.addDecryptionAt(readerAt, binaryId)
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+	return decReaderAt, reader, nil
+}
+
+// addDecryptionAt works like addDecryption but for an io.ReaderAt.
+func (a *aesFS) addDecryptionAt(
+	readerAt io.ReaderAt, binaryId []byte) (io.ReaderAt, error) {
+	magic := make([]byte, len(kMagic))
+	n, err := readerAt.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if hasMagic(magic[:n]) {
+		return newGCMReaderAt(readerAt, a.Owner.keys()...)
+	}
+	key := a.Owner.legacyKey()
+	if key == nil {
+		return readerAt, nil
+	}
+	if binaryId == nil {
+		return nil, ErrCorrupt
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cfbReaderAt{
+		readerAt: readerAt, block: block, iv: iv(binaryId, a.Owner.Id)}, nil
+}
+
+// gcmReaderAt decrypts data in the GCM format at any offset by decrypting
+// just the chunks holding the bytes asked for. Each chunk is still
+// authenticated, but gcmReaderAt can't detect chunks missing from the
+// end of the data. gcmReaderAt keeps the last chunk it decrypted so that
+// small reads in a row don't decrypt the same chunk over and over.
+type gcmReaderAt struct {
+	readerAt   io.ReaderAt
+	aead       cipher.AEAD
+	aad        []byte
+	headerSize int64
+	chunkSize  int64
+
+	// Protects the fields below
+	lock   sync.Mutex
+	buffer []byte
+	plain  []byte
+	final  bool
+	index  int64
+}
+
+// newGCMReaderAt works like newGCMReader but for an io.ReaderAt.
+func newGCMReaderAt(
+	readerAt io.ReaderAt, keys ...[]byte) (*gcmReaderAt, error) {
+	header, headerBytes, err := readBlobHeader(
+		io.NewSectionReader(readerAt, 0, int64(kEnvelopeHeaderSize)))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := header.newAEAD(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmReaderAt{
+		readerAt:   readerAt,
+		aead:       aead,
+		aad:        header.additionalData(headerBytes),
+		headerSize: int64(len(headerBytes)),
+		chunkSize:  int64(header.ChunkSize),
+		buffer:     make([]byte, int(header.ChunkSize)+aead.Overhead()),
+		index:      -1,
+	}, nil
+}
+
+func (g *gcmReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / g.chunkSize
+		if err := g.readChunk(index); err != nil {
+			return n, err
+		}
+		skip := pos - index*g.chunkSize
+		if skip >= int64(len(g.plain)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], g.plain[skip:])
+		if g.final && n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// readChunk decrypts the chunk with given zero based index into g.plain
+// unless it is already there. readChunk returns io.EOF if there is no such
+// chunk.
+func (g *gcmReaderAt) readChunk(index int64) error {
+	if index == g.index {
+		return nil
+	}
+	g.index = -1
+	n, err := g.readerAt.ReadAt(
+		g.buffer, g.headerSize+index*int64(len(g.buffer)))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n == 0 {
+		return io.EOF
+	}
+	final := n < len(g.buffer)
+	plain, err := g.aead.Open(
+		g.buffer[:0], chunkNonce(uint64(index), final), g.buffer[:n], g.aad)
+	if err != nil {
+		return ErrCorrupt
+	}
+	g.plain = plain
+	g.final = final
+	g.index = index
+	return nil
+}
+
+// cfbReaderAt decrypts data in the legacy AES-CFB format at any offset.
+// In CFB mode, each block of ciphertext is the IV for the next, so
+// decrypting can start at any block.
+type cfbReaderAt struct {
+	readerAt io.ReaderAt
+	block    cipher.Block
+	iv       []byte
+}
+
+func (c *cfbReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	blockSize := int64(c.block.BlockSize())
+	start := off - off%blockSize
+	iv := c.iv
+	if start > 0 {
+		iv = make([]byte, blockSize)
+		n, err := c.readerAt.ReadAt(iv, start-blockSize)
+		if n < len(iv) {
+			if err == nil || err == io.EOF {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+	}
+	skip := off - start
+	buffer := make([]byte, skip+int64(len(p)))
+	count, err := c.readerAt.ReadAt(buffer, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if int64(count) <= skip {
+		return 0, io.EOF
+	}
+	buffer = buffer[:count]
+	cipher.NewCFBDecrypter(c.block, iv).XORKeyStream(buffer, buffer)
+	n := copy(p, buffer[skip:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// reopeningReaderAt reads data at an offset by opening the data again and
+// reading up to that offset. reopeningReaderAt is for file systems whose
+// readers don't implement io.ReaderAt.
+type reopeningReaderAt struct {
+	open func() (io.ReadCloser, error)
+}
+
+func (r *reopeningReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	reader, err := r.open()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	if _, err := io.CopyN(io.Discard, reader, off); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(reader, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+type nopCloser struct {
+}
+
+func (n nopCloser) Close() error {
+	return nil
+}
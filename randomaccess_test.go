@@ -0,0 +1,201 @@
+package attachments
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/keep94/toolbox/kdf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImmutableFS_RandomAccess(t *testing.T) {
+	key := kdf.Random(32)
+	owners := map[string]Owner{
+		"plain":    {Id: 1},
+		"gcm":      {Id: 1, Key: key},
+		"envelope": {Id: 1, Key: key, Envelope: true},
+	}
+	for ownerName, owner := range owners {
+		for _, size := range []int{
+			0, 1, 100, kChunkSize, 2*kChunkSize + 100} {
+			contents := pseudoRandomBytes(size)
+			t.Run(fmt.Sprintf("%s/%d", ownerName, size), func(t *testing.T) {
+				immutableFs := NewImmutableFS(
+					NewInMemoryFS(), NewInMemoryStore(), owner)
+				id, err := immutableFs.Write("file.bin", contents)
+				require.NoError(t, err)
+				file, err := immutableFs.Open(fmt.Sprintf("%d/file.bin", id))
+				require.NoError(t, err)
+				defer file.Close()
+				assert.NoError(t, iotest.TestReader(file, contents))
+			})
+		}
+	}
+}
+
+func TestImmutableFS_RandomAccessSequentialFS(t *testing.T) {
+	// File systems whose readers don't implement io.ReaderAt still work.
+	contents := pseudoRandomBytes(1000)
+	for _, owner := range []Owner{{Id: 1}, {Id: 1, Key: kdf.Random(32)}} {
+		immutableFs := NewImmutableFS(
+			sequentialFS{NewInMemoryFS()}, NewInMemoryStore(), owner)
+		id, err := immutableFs.Write("file.bin", contents)
+		require.NoError(t, err)
+		file, err := immutableFs.Open(fmt.Sprintf("%d/file.bin", id))
+		require.NoError(t, err)
+		assert.NoError(t, iotest.TestReader(file, contents))
+		assert.NoError(t, file.Close())
+	}
+}
+
+func TestImmutableFS_RandomAccessLegacy(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	owner := Owner{Id: 1, Key: kdf.Random(32)}
+	contents := pseudoRandomBytes(1000)
+	checksum := writeLegacyBlob(
+		t, &aesFS{FileSystem: fakeFs, Owner: owner}, contents)
+	entry := Entry{
+		Name: "legacy.bin", Size: 1000, OwnerId: 1, Checksum: checksum}
+	require.NoError(t, store.AddEntry(nil, &entry))
+	file, err := NewImmutableFS(fakeFs, store, owner).Open(entry.Path())
+	require.NoError(t, err)
+	defer file.Close()
+	assert.NoError(t, iotest.TestReader(file, contents))
+}
+
+func TestImmutableFS_ReadAtChunkBoundaries(t *testing.T) {
+	contents := pseudoRandomBytes(3*kChunkSize + 10)
+	immutableFs := NewImmutableFS(
+		NewInMemoryFS(), NewInMemoryStore(), Owner{Id: 1, Key: kdf.Random(32)})
+	id, err := immutableFs.Write("file.bin", contents)
+	require.NoError(t, err)
+	file, err := immutableFs.Open(fmt.Sprintf("%d/file.bin", id))
+	require.NoError(t, err)
+	defer file.Close()
+	readerAt := file.(io.ReaderAt)
+
+	for _, off := range []int{
+		0, kChunkSize - 1, kChunkSize, 2*kChunkSize - 5, 3 * kChunkSize} {
+		buffer := make([]byte, kChunkSize+10)
+		n, err := readerAt.ReadAt(buffer, int64(off))
+		expected := contents[off:]
+		if len(expected) > len(buffer) {
+			expected = expected[:len(buffer)]
+			assert.NoError(t, err)
+		} else {
+			assert.Equal(t, io.EOF, err)
+		}
+		assert.Equal(t, expected, buffer[:n], "offset %d", off)
+	}
+	n, err := readerAt.ReadAt(make([]byte, 1), int64(len(contents)))
+	assert.Zero(t, n)
+	assert.Equal(t, io.EOF, err)
+	_, err = readerAt.ReadAt(make([]byte, 1), -1)
+	assert.Error(t, err)
+}
+
+func TestImmutableFS_SeekResumesVerifiedRead(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	immutableFs := NewImmutableFS(fakeFs, NewInMemoryStore(), Owner{Id: 1})
+	id, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	helloName := fmt.Sprintf("%d/hello.txt", id)
+	writeString(
+		t, fakeFs, idToPath(checksumOf("Hello World!"), 1), "Hello World?")
+
+	file, err := immutableFs.Open(helloName)
+	require.NoError(t, err)
+	defer file.Close()
+	seeker := file.(io.ReadSeeker)
+	contents := make([]byte, 5)
+	_, err = io.ReadFull(file, contents)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", string(contents))
+
+	// Reading out of order isn't checked
+	_, err = seeker.Seek(-6, io.SeekEnd)
+	require.NoError(t, err)
+	contents, err = io.ReadAll(file)
+	require.NoError(t, err)
+	assert.Equal(t, "World?", string(contents))
+
+	// But going back to where the verified read left off is
+	_, err = seeker.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	contents, err = io.ReadAll(file)
+	assert.Equal(t, ErrIntegrity, err)
+	assert.Equal(t, " World?", string(contents))
+
+	_, err = seeker.Seek(-1, io.SeekStart)
+	assert.Error(t, err)
+}
+
+func TestImmutableFS_RandomAccessIntegrity(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	owner := Owner{Id: 1, Key: kdf.Random(32)}
+	immutableFs := NewImmutableFS(fakeFs, NewInMemoryStore(), owner)
+	contents := pseudoRandomBytes(kChunkSize + 100)
+	id, err := immutableFs.Write("file.bin", contents)
+	require.NoError(t, err)
+	name := fmt.Sprintf("%d/file.bin", id)
+	blobName, err := (&aesFS{FileSystem: fakeFs, Owner: owner}).blobPath(
+		checksumOf(string(contents)))
+	require.NoError(t, err)
+	blob := readBlob(t, fakeFs, blobName)
+
+	// Tampered
+	tampered := append([]byte(nil), blob...)
+	tampered[len(tampered)-1] ^= 1
+	writeBytes(t, fakeFs, blobName, tampered)
+	file, err := immutableFs.Open(name)
+	require.NoError(t, err)
+	_, err = file.(io.ReaderAt).ReadAt(make([]byte, 10), kChunkSize)
+	assert.Equal(t, ErrCorrupt, err)
+	_, err = file.(io.ReaderAt).ReadAt(make([]byte, 10), 0)
+	assert.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// The last chunk, including its 16 byte tag, is missing
+	writeBytes(t, fakeFs, blobName, blob[:len(blob)-100-16])
+	file, err = immutableFs.Open(name)
+	require.NoError(t, err)
+	_, err = file.(io.ReaderAt).ReadAt(make([]byte, 10), kChunkSize)
+	assert.Equal(t, ErrIntegrity, err)
+	_, err = io.ReadAll(file)
+	assert.Equal(t, ErrCorrupt, err)
+	require.NoError(t, file.Close())
+}
+
+// sequentialFS hides io.ReaderAt on the readers of the FS it wraps.
+type sequentialFS struct {
+	FS
+}
+
+func (s sequentialFS) Open(name string) (io.ReadCloser, error) {
+	reader, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readerCloser{Reader: reader, Closer: reader}, nil
+}
+
+func pseudoRandomBytes(size int) []byte {
+	result := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(result)
+	return result
+}
+
+func readBlob(t *testing.T, fileSystem FS, name string) []byte {
+	t.Helper()
+	reader, err := fileSystem.Open(name)
+	require.NoError(t, err)
+	defer reader.Close()
+	contents, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return contents
+}
@@ -0,0 +1,291 @@
+package attachments
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+var (
+	errVerify = errors.New("attachments: Rotated blob does not verify")
+)
+
+// RotateReport reports what RotateKey did.
+type RotateReport struct {
+
+	// The number of blobs examined
+	Scanned int
+
+	// The IDs of the blobs re-encrypted with the new key. Blob IDs are
+	// the checksums of the data unless the owner has a NameKey.
+	Rotated []string
+
+	// The IDs of the blobs already encrypted with the new key
+	Current []string
+
+	// The IDs of the blobs left alone because they are corrupt or
+	// because none of the owner's keys could decrypt them.
+	Failed []string
+
+	// The IDs of the blobs that entries reference but that don't exist
+	Missing []string
+}
+
+// RotateKey re-encrypts the blobs on fileSystem that owner's entries in
+// store reference with owner.Key. Entries marked deleted count as
+// references. RotateKey leaves unreferenced blobs and the blobs of other
+// owners alone. owner.OldKeys must hold the keys that the blobs are currently
+// encrypted with. owner.NameKey must be set if the owner has one.
+// RotateKey decrypts each blob, verifies that the checksum of the
+// plaintext matches the checksum of the entry, encrypts the
+// plaintext with owner.Key under a staging name, reads it back to verify
+// it, and finally moves it over the original blob. Since the original
+// blob stays in place until its replacement is complete, an ImmutableFS
+// for owner keeps working throughout the rotation as long as it too has
+// both owner.Key and owner.OldKeys.
+//
+// RotateKey skips blobs that are already encrypted with owner.Key, so
+// if RotateKey fails or the process crashes, running RotateKey again
+// picks up where it left off. CollectGarbage removes any staging files a
+// crash leaves behind. Once RotateKey succeeds with empty Failed and
+// Missing lists, the old keys are no longer needed. If owner has a
+// KeyProvider, its newest key is the new key and its other keys are the
+// old keys.
+//
+// Blobs written with owner.Envelope set have their own data key. For
+// these blobs, RotateKey only rewraps the data key with owner.Key and
+// copies the encrypted data as is, which is much cheaper than
+// re-encrypting. Setting owner.Envelope makes RotateKey also move the
+// other blobs to their own data keys.
+func RotateKey(
+	fileSystem FS, store Store, owner Owner) (*RotateReport, error) {
+	owner, err := owner.withKeys()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := aes.NewCipher(owner.Key); err != nil {
+		return nil, err
+	}
+	rotator := &keyRotator{
+		aesFS:  &aesFS{FileSystem: fileSystem, Owner: owner},
+		report: &RotateReport{},
+	}
+	checksums, err := referencedChecksums(store, owner.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, checksum := range checksums {
+		name, _, err := rotator.aesFS.resolve(checksum)
+		var binaryChecksum []byte
+		if err == nil {
+			binaryChecksum, err = hex.DecodeString(checksum)
+		}
+		if err != nil {
+			rotator.report.Scanned++
+			rotator.report.Failed = append(rotator.report.Failed, checksum)
+			continue
+		}
+		if err := rotator.visit(name, binaryChecksum); err != nil {
+			return nil, err
+		}
+	}
+	return rotator.report, nil
+}
+
+type keyRotator struct {
+	aesFS  *aesFS
+	report *RotateReport
+}
+
+// visit rotates the blob at name holding data with given checksum.
+func (k *keyRotator) visit(name string, binaryChecksum []byte) error {
+	id, ok := pathToId(name, k.aesFS.Owner.Id)
+	if !ok {
+		return nil
+	}
+	k.report.Scanned++
+	header, err := k.readHeader(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		k.report.Missing = append(k.report.Missing, id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if header != nil && header.KeyId == keyId(k.aesFS.Owner.Key) {
+		k.report.Current = append(k.report.Current, id)
+		return nil
+	}
+	if header != nil && header.Version == kEnvelopeVersion {
+		err = k.rotate(name, func(stagingName string) error {
+			return k.rewrap(name, stagingName)
+		})
+	} else {
+		err = k.rotate(name, func(stagingName string) error {
+			return k.reencrypt(name, binaryChecksum, stagingName)
+		})
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		k.report.Missing = append(k.report.Missing, id)
+		return nil
+	}
+	if err == ErrCorrupt || err == ErrWrongKey {
+		k.report.Failed = append(k.report.Failed, id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	k.report.Rotated = append(k.report.Rotated, id)
+	return nil
+}
+
+// readHeader returns the header of the blob at name or nil if the blob
+// has no valid header.
+func (k *keyRotator) readHeader(name string) (*blobHeader, error) {
+	reader, err := k.aesFS.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	header, _, err := readBlobHeader(reader)
+	if err == ErrCorrupt {
+		return nil, nil
+	}
+	return header, err
+}
+
+// rotate calls write to write the rotated form of the blob at name to a
+// staging file and then moves the staging file over the blob.
+func (k *keyRotator) rotate(
+	name string, write func(stagingName string) error) error {
+	stagingName, err := stagingPath(k.aesFS.Owner.Id)
+	if err != nil {
+		return err
+	}
+	err = write(stagingName)
+	if err == nil {
+		err = rename(k.aesFS.FileSystem, stagingName, name)
+	}
+	if err != nil {
+		Remove(k.aesFS.FileSystem, stagingName)
+		return err
+	}
+	return nil
+}
+
+// rewrap writes the blob at name to stagingName with its data key
+// wrapped with the owner's key instead of an old key. The encrypted
+// chunks are copied as is. rewrap verifies that the new header unwraps
+// to the same data key.
+func (k *keyRotator) rewrap(name, stagingName string) error {
+	reader, err := k.aesFS.FileSystem.Open(name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	header, _, err := readBlobHeader(reader)
+	if err != nil {
+		return err
+	}
+	oldKey := findKey(header.KeyId, k.aesFS.Owner.keys())
+	if oldKey == nil {
+		return ErrWrongKey
+	}
+	dataKey, err := header.contentKey(oldKey)
+	if err != nil {
+		return err
+	}
+	wrappedKey, err := wrapKey(k.aesFS.Owner.Key, dataKey)
+	if err != nil {
+		return err
+	}
+	header.KeyId = keyId(k.aesFS.Owner.Key)
+	copy(header.WrappedKey[:], wrappedKey)
+	writer, err := k.aesFS.FileSystem.Write(stagingName)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(header.marshal()); err != nil {
+		abort(k.aesFS.FileSystem, stagingName, writer)
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		abort(k.aesFS.FileSystem, stagingName, writer)
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return k.verifyDataKey(stagingName, dataKey)
+}
+
+// verifyDataKey verifies that the header of name unwraps with the owner's
+// key to dataKey.
+func (k *keyRotator) verifyDataKey(name string, dataKey []byte) error {
+	reader, err := k.aesFS.FileSystem.Open(name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	header, _, err := readBlobHeader(reader)
+	if err != nil {
+		return err
+	}
+	newDataKey, err := header.contentKey(k.aesFS.Owner.Key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(newDataKey, dataKey) {
+		return errVerify
+	}
+	return nil
+}
+
+// reencrypt writes the blob at name holding data with given checksum to
+// stagingName encrypted with the owner's key and verifies what it wrote.
+// reencrypt returns ErrCorrupt if the blob doesn't decrypt to data
+// matching the checksum.
+func (k *keyRotator) reencrypt(
+	name string, binaryChecksum []byte, stagingName string) error {
+	reader, err := k.aesFS.openBlob(name, binaryChecksum)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	_, err = k.aesFS.write(stagingName, io.TeeReader(reader, hash))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), binaryChecksum) {
+		return ErrCorrupt
+	}
+	return k.verify(stagingName, binaryChecksum)
+}
+
+// verify verifies that name decrypts with the owner's key to data with
+// given checksum.
+func (k *keyRotator) verify(name string, binaryChecksum []byte) error {
+	reader, err := k.aesFS.FileSystem.Open(name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	gcmReader, err := newGCMReader(reader, k.aesFS.Owner.Key)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, gcmReader); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), binaryChecksum) {
+		return errVerify
+	}
+	return nil
+}
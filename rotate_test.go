@@ -0,0 +1,398 @@
+package attachments
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/keep94/toolbox/kdf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	errCrash = errors.New("attachments: Simulated crash")
+)
+
+func TestRotateKey(t *testing.T) {
+	fileSystem, err := NewFS(t.TempDir())
+	require.NoError(t, err)
+	assertRotateKey(t, fileSystem)
+	assertRotateKey(t, NewInMemoryFS())
+}
+
+func TestRotateKey_FromUnencrypted(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	_, err := NewImmutableFS(fakeFs, store, Owner{Id: 1}).Write(
+		"hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+
+	owner := Owner{Id: 1, Key: kdf.Random(32), OldKeys: [][]byte{nil}}
+	report, err := RotateKey(fakeFs, store, owner)
+	require.NoError(t, err)
+	assert.Len(t, report.Rotated, 1)
+	assert.Empty(t, report.Failed)
+
+	owner.OldKeys = nil
+	assertReadFile(
+		t, NewImmutableFS(fakeFs, store, owner), "1/hello.txt", "Hello World!")
+}
+
+func TestRotateKey_Resume(t *testing.T) {
+	fakeFs := &crashingFS{fakeFS: NewInMemoryFS().(*fakeFS), renames: 2}
+	store := NewInMemoryStore()
+	oldOwner := Owner{Id: 1, Key: kdf.Random(32)}
+	immutableFs := NewImmutableFS(fakeFs, store, oldOwner)
+	for i := 0; i < 5; i++ {
+		_, err := immutableFs.Write(
+			fmt.Sprintf("%d.txt", i), ([]byte)(fmt.Sprintf("File %d", i)))
+		require.NoError(t, err)
+	}
+	owner := Owner{Id: 1, Key: kdf.Random(32), OldKeys: [][]byte{oldOwner.Key}}
+	_, err := RotateKey(fakeFs, store, owner)
+	assert.Equal(t, errCrash, err)
+
+	// Everything is still readable after the crash
+	rotatingFs := NewImmutableFS(fakeFs, store, owner)
+	for i := 0; i < 5; i++ {
+		assertReadFile(
+			t,
+			rotatingFs,
+			fmt.Sprintf("%d/%d.txt", i+1, i),
+			fmt.Sprintf("File %d", i))
+	}
+	staging, err := List(fakeFs, "1/staging/")
+	require.NoError(t, err)
+	assert.Empty(t, staging)
+
+	fakeFs.renames = -1
+	report, err := RotateKey(fakeFs, store, owner)
+	require.NoError(t, err)
+	assert.Len(t, report.Current, 2)
+	assert.Len(t, report.Rotated, 3)
+
+	newFs := NewImmutableFS(fakeFs, store, Owner{Id: 1, Key: owner.Key})
+	for i := 0; i < 5; i++ {
+		assertReadFile(
+			t,
+			newFs,
+			fmt.Sprintf("%d/%d.txt", i+1, i),
+			fmt.Sprintf("File %d", i))
+	}
+}
+
+func TestRotateKey_Envelope(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	key1 := kdf.Random(32)
+	key2 := kdf.Random(32)
+	envelopeFs := NewImmutableFS(
+		fakeFs, store, Owner{Id: 1, Key: key1, Envelope: true})
+	helloId, err := envelopeFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	plainFs := NewImmutableFS(fakeFs, store, Owner{Id: 1, Key: key1})
+	goodbyeId, err := plainFs.Write(
+		"goodbye.txt", ([]byte)("Goodbye World!"))
+	require.NoError(t, err)
+	helloName := idToPath(checksumOf("Hello World!"), 1)
+	goodbyeName := idToPath(checksumOf("Goodbye World!"), 1)
+	helloBefore := readBytes(fakeFs, helloName)
+
+	// Without Envelope, blobs with data keys get rewrapped while other
+	// blobs get re-encrypted as they are.
+	owner := Owner{Id: 1, Key: key2, OldKeys: [][]byte{key1}}
+	report, err := RotateKey(fakeFs, store, owner)
+	require.NoError(t, err)
+	assert.Len(t, report.Rotated, 2)
+	helloAfter := readBytes(fakeFs, helloName)
+	assert.Equal(
+		t,
+		helloBefore[kEnvelopeHeaderSize:],
+		helloAfter[kEnvelopeHeaderSize:])
+	assert.NotEqual(t, helloBefore[:kPrefixSize], helloAfter[:kPrefixSize])
+	assert.Equal(
+		t,
+		byte(kGCMVersion),
+		readBytes(fakeFs, goodbyeName)[len(kMagic)])
+
+	// With Envelope, all blobs end up with their own data keys.
+	key3 := kdf.Random(32)
+	owner = Owner{Id: 1, Key: key3, OldKeys: [][]byte{key2}, Envelope: true}
+	report, err = RotateKey(fakeFs, store, owner)
+	require.NoError(t, err)
+	assert.Len(t, report.Rotated, 2)
+	assert.Equal(
+		t,
+		byte(kEnvelopeVersion),
+		readBytes(fakeFs, goodbyeName)[len(kMagic)])
+	assert.Equal(
+		t,
+		helloBefore[kEnvelopeHeaderSize:],
+		readBytes(fakeFs, helloName)[kEnvelopeHeaderSize:])
+
+	newFs := NewImmutableFS(fakeFs, store, Owner{Id: 1, Key: key3})
+	assertReadFile(
+		t, newFs, fmt.Sprintf("%d/hello.txt", helloId), "Hello World!")
+	assertReadFile(
+		t, newFs, fmt.Sprintf("%d/goodbye.txt", goodbyeId), "Goodbye World!")
+
+	// A tampered wrapped key fails
+	contents := readBytes(fakeFs, helloName)
+	contents[kEnvelopeHeaderSize-1] ^= 1
+	writeBytes(t, fakeFs, helloName, contents)
+	report, err = RotateKey(
+		fakeFs, store, Owner{Id: 1, Key: key1, OldKeys: [][]byte{key3}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{checksumOf("Hello World!")}, report.Failed)
+}
+
+func TestRotateKey_BadKey(t *testing.T) {
+	_, err := RotateKey(NewInMemoryFS(), NewInMemoryStore(), Owner{Id: 1})
+	assert.Error(t, err)
+	_, err = RotateKey(
+		NewInMemoryFS(), NewInMemoryStore(), Owner{Id: 1, Key: kdf.Random(25)})
+	assert.Error(t, err)
+}
+
+func TestRotateKey_BasicFS(t *testing.T) {
+	fileSystem := basicFS{NewInMemoryFS()}
+	store := NewInMemoryStore()
+	oldOwner := Owner{Id: 1, Key: kdf.Random(32)}
+	helloId, err := NewImmutableFS(fileSystem, store, oldOwner).Write(
+		"hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	owner := Owner{Id: 1, Key: kdf.Random(32), OldKeys: [][]byte{oldOwner.Key}}
+	report, err := RotateKey(fileSystem, store, owner)
+	require.NoError(t, err)
+	assert.Equal(t, []string{checksumOf("Hello World!")}, report.Rotated)
+	assertReadFile(
+		t,
+		NewImmutableFS(fileSystem, store, Owner{Id: 1, Key: owner.Key}),
+		fmt.Sprintf("%d/hello.txt", helloId),
+		"Hello World!")
+}
+
+func TestRotateKey_NameKey(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	oldKey := kdf.Random(32)
+	nameKey := kdf.Random(32)
+
+	// One blob has a derived name. The other still has its plain name
+	// because MigrateBlobNames hasn't gotten to it yet.
+	helloId, err := NewImmutableFS(
+		fakeFs, store, Owner{Id: 1, Key: oldKey, NameKey: nameKey}).Write(
+		"hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	goodbyeId, err := NewImmutableFS(
+		fakeFs, store, Owner{Id: 1, Key: oldKey}).Write(
+		"goodbye.txt", ([]byte)("Goodbye World!"))
+	require.NoError(t, err)
+
+	// Without the NameKey, the blob with the derived name is missing.
+	owner := Owner{Id: 1, Key: kdf.Random(32), OldKeys: [][]byte{oldKey}}
+	report, err := RotateKey(fakeFs, store, owner)
+	require.NoError(t, err)
+	assert.Equal(t, []string{checksumOf("Hello World!")}, report.Missing)
+	assert.Equal(t, []string{checksumOf("Goodbye World!")}, report.Rotated)
+	assert.Empty(t, report.Failed)
+
+	owner.NameKey = nameKey
+	report, err = RotateKey(fakeFs, store, owner)
+	require.NoError(t, err)
+	assert.Len(t, report.Rotated, 1)
+	assert.Len(t, report.Current, 1)
+	assert.Empty(t, report.Failed)
+	assert.Empty(t, report.Missing)
+
+	owner.OldKeys = nil
+	newFs := NewImmutableFS(fakeFs, store, owner)
+	assertReadFile(
+		t, newFs, fmt.Sprintf("%d/hello.txt", helloId), "Hello World!")
+	assertReadFile(
+		t,
+		newFs,
+		fmt.Sprintf("%d/goodbye.txt", goodbyeId),
+		"Goodbye World!")
+}
+
+func TestRotateKey_NameKeyLegacy(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	oldOwner := Owner{Id: 1, Key: kdf.Random(32)}
+	legacyChecksum := writeLegacyBlob(
+		t, &aesFS{FileSystem: fakeFs, Owner: oldOwner}, ([]byte)("Legacy"))
+	legacyEntry := Entry{
+		Name: "legacy.txt", Size: 6, OwnerId: 1, Checksum: legacyChecksum}
+	require.NoError(t, store.AddEntry(nil, &legacyEntry))
+	owner := Owner{
+		Id:      1,
+		Key:     kdf.Random(32),
+		OldKeys: [][]byte{oldOwner.Key},
+		NameKey: kdf.Random(32),
+	}
+	report, err := RotateKey(fakeFs, store, owner)
+	require.NoError(t, err)
+	assert.Equal(t, []string{legacyChecksum}, report.Rotated)
+	assert.Empty(t, report.Failed)
+	owner.OldKeys = nil
+	assertReadFile(
+		t,
+		NewImmutableFS(fakeFs, store, owner),
+		fmt.Sprintf("%d/legacy.txt", legacyEntry.Id),
+		"Legacy")
+}
+
+func TestRotateKey_Missing(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	oldOwner := Owner{Id: 1, Key: kdf.Random(32)}
+	_, err := NewImmutableFS(fakeFs, store, oldOwner).Write(
+		"hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	require.NoError(
+		t, Remove(fakeFs, idToPath(checksumOf("Hello World!"), 1)))
+	report, err := RotateKey(
+		fakeFs,
+		store,
+		Owner{Id: 1, Key: kdf.Random(32), OldKeys: [][]byte{oldOwner.Key}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Scanned)
+	assert.Equal(t, []string{checksumOf("Hello World!")}, report.Missing)
+	assert.Empty(t, report.Rotated)
+}
+
+func TestRotateKey_DBError(t *testing.T) {
+	_, err := RotateKey(
+		NewInMemoryFS(), errorStore{}, Owner{Id: 1, Key: kdf.Random(32)})
+	assert.Equal(t, errDatabase, err)
+}
+
+func assertRotateKey(t *testing.T, fileSystem FS) {
+	store := NewInMemoryStore()
+	key1 := kdf.Random(32)
+	key2 := kdf.Random(32)
+	key3 := kdf.Random(16)
+	oldOwner := Owner{Id: 1, Key: key1}
+	immutableFs := NewImmutableFS(fileSystem, store, oldOwner)
+	helloId, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	bigContents := kdf.Random(3*kChunkSize + 7)
+	bigId, err := immutableFs.Write("big.bin", bigContents)
+	require.NoError(t, err)
+
+	// A blob in the legacy format
+	legacyChecksum := writeLegacyBlob(
+		t,
+		&aesFS{FileSystem: fileSystem, Owner: oldOwner},
+		([]byte)("Legacy"))
+	legacyEntry := Entry{
+		Name: "legacy.txt", Size: 6, OwnerId: 1, Checksum: legacyChecksum}
+	require.NoError(t, store.AddEntry(nil, &legacyEntry))
+	legacyId := legacyEntry.Id
+
+	// A blob that was tampered with
+	rawFs := &aesFS{FileSystem: fileSystem, Owner: oldOwner}
+	corruptChecksum, err := rawFs.Write(([]byte)("Corrupt"))
+	require.NoError(t, err)
+	contents := readBytes(fileSystem, idToPath(corruptChecksum, 1))
+	contents[len(contents)-1] ^= 1
+	writeBytes(t, fileSystem, idToPath(corruptChecksum, 1), contents)
+	corruptEntry := Entry{
+		Name: "corrupt.txt", Size: 7, OwnerId: 1, Checksum: corruptChecksum}
+	require.NoError(t, store.AddEntry(nil, &corruptEntry))
+
+	// Blobs no entry references are untouched
+	orphanChecksum, err := rawFs.Write(([]byte)("Orphan"))
+	require.NoError(t, err)
+
+	// Blobs of other owners are untouched
+	otherFs := NewImmutableFS(fileSystem, store, Owner{Id: 2, Key: key1})
+	otherId, err := otherFs.Write("other.txt", ([]byte)("Other"))
+	require.NoError(t, err)
+
+	// First rotation
+	owner := Owner{Id: 1, Key: key2, OldKeys: [][]byte{key1}}
+	report, err := RotateKey(fileSystem, store, owner)
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Scanned)
+	assert.Len(t, report.Rotated, 3)
+	assert.Empty(t, report.Current)
+	assert.Equal(t, []string{corruptChecksum}, report.Failed)
+
+	// Running again finds nothing left to do
+	report, err = RotateKey(fileSystem, store, owner)
+	require.NoError(t, err)
+	assert.Len(t, report.Current, 3)
+	assert.Empty(t, report.Rotated)
+	assert.Equal(t, []string{corruptChecksum}, report.Failed)
+
+	// Second rotation straight away. Blobs are readable with any key in
+	// the owner's key ring.
+	owner = Owner{Id: 1, Key: key3, OldKeys: [][]byte{key2, key1}}
+	rotatingFs := NewImmutableFS(fileSystem, store, owner)
+	assertReadFile(
+		t, rotatingFs, fmt.Sprintf("%d/hello.txt", helloId), "Hello World!")
+	report, err = RotateKey(fileSystem, store, owner)
+	require.NoError(t, err)
+	assert.Len(t, report.Rotated, 3)
+
+	// Old keys are no longer needed
+	newFs := NewImmutableFS(fileSystem, store, Owner{Id: 1, Key: key3})
+	assertReadFile(
+		t, newFs, fmt.Sprintf("%d/hello.txt", helloId), "Hello World!")
+	assertReadFile(
+		t, newFs, fmt.Sprintf("%d/legacy.txt", legacyId), "Legacy")
+	bigRead, err := fs.ReadFile(newFs, fmt.Sprintf("%d/big.bin", bigId))
+	require.NoError(t, err)
+	assert.Equal(t, bigContents, bigRead)
+	_, err = fs.ReadFile(newFs, fmt.Sprintf("%d/hello.txt", otherId))
+	assert.Error(t, err)
+	assertReadFile(
+		t, otherFs, fmt.Sprintf("%d/other.txt", otherId), "Other")
+
+	// The old key can no longer read anything
+	oldFs := NewImmutableFS(fileSystem, store, oldOwner)
+	_, err = fs.ReadFile(oldFs, fmt.Sprintf("%d/hello.txt", helloId))
+	assert.True(t, errors.Is(err, ErrWrongKey))
+
+	assert.Equal(t, "Orphan", string(readBytes(rawFs, orphanChecksum)))
+
+	// No staging files remain
+	names, err := List(fileSystem, "1/")
+	require.NoError(t, err)
+	assert.Len(t, names, 5)
+	for _, name := range names {
+		_, ok := pathToId(name, 1)
+		assert.True(t, ok, name)
+	}
+}
+
+func checksumOf(s string) string {
+	return hex.EncodeToString(checksum(([]byte)(s)))
+}
+
+func assertReadFile(t *testing.T, fileSys fs.FS, name, expected string) {
+	t.Helper()
+	contents, err := fs.ReadFile(fileSys, name)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(contents))
+}
+
+// crashingFS simulates a crash by failing after renames renames.
+// A negative renames means never fail.
+type crashingFS struct {
+	*fakeFS
+	renames int
+}
+
+func (c *crashingFS) Rename(oldName, newName string) error {
+	if c.renames == 0 {
+		return errCrash
+	}
+	c.renames--
+	return c.fakeFS.Rename(oldName, newName)
+}
@@ -0,0 +1,445 @@
+package attachments
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keep94/consume"
+)
+
+const (
+	// DefaultCheckpointInterval is how many entries Scrub scrubs between
+	// checkpoints when ScrubOptions doesn't say.
+	DefaultCheckpointInterval = 100
+
+	// How many entries Scrub reads from the store at a time
+	kScrubBatchSize = 100
+)
+
+// Kinds of problems that Scrub finds
+const (
+
+	// The blob that the entry's checksum points at doesn't exist.
+	ProblemMissing = "missing"
+
+	// The blob is shorter than the entry's size.
+	ProblemTruncated = "truncated"
+
+	// The blob doesn't match the entry's checksum or size or was
+	// tampered with.
+	ProblemCorrupt = "corrupt"
+
+	// None of the owner's keys can decrypt the blob.
+	ProblemWrongKey = "wrong_key"
+
+	// The blob couldn't be read for some other reason.
+	ProblemUnreadable = "unreadable"
+
+	// The entry itself is bad, e.g. its checksum isn't a valid SHA-256
+	// checksum. Fix the entry in the store; there is no blob to look for.
+	ProblemInvalidEntry = "invalid_entry"
+)
+
+// Checkpoint stores how far Scrub got so that the next Scrub can pick up
+// where it left off.
+type Checkpoint interface {
+
+	// Load returns the id of the last entry scrubbed or 0 to start from
+	// the beginning.
+	Load() (int64, error)
+
+	// Save records that the entries up to and including lastId have been
+	// scrubbed. 0 means start from the beginning next time.
+	Save(lastId int64) error
+}
+
+// NewFileCheckpoint returns a Checkpoint stored in the file at path. The
+// file need not exist. The returned Checkpoint replaces the file
+// atomically each time it saves.
+func NewFileCheckpoint(path string) Checkpoint {
+	return fileCheckpoint(path)
+}
+
+// ScrubOptions contains options for Scrub.
+type ScrubOptions struct {
+
+	// The maximum number of bytes per second Scrub reads. Zero means no
+	// limit.
+	BytesPerSecond int64
+
+	// The maximum number of entries Scrub scrubs. Zero means no limit.
+	// If Scrub stops because of this limit, the Checkpoint lets the next
+	// Scrub continue where this one stopped.
+	MaxEntries int
+
+	// If non-nil, Scrub resumes from and updates Checkpoint. Once Scrub
+	// scrubs the last entry, it resets Checkpoint so that the next Scrub
+	// starts from the beginning.
+	Checkpoint Checkpoint
+
+	// How many entries Scrub scrubs between saving checkpoints. Zero means
+	// DefaultCheckpointInterval.
+	CheckpointInterval int
+}
+
+func (o *ScrubOptions) bytesPerSecond() int64 {
+	if o == nil {
+		return 0
+	}
+	return o.BytesPerSecond
+}
+
+func (o *ScrubOptions) maxEntries() int {
+	if o == nil {
+		return 0
+	}
+	return o.MaxEntries
+}
+
+func (o *ScrubOptions) checkpoint() Checkpoint {
+	if o == nil {
+		return nil
+	}
+	return o.Checkpoint
+}
+
+func (o *ScrubOptions) checkpointInterval() int {
+	if o == nil || o.CheckpointInterval <= 0 {
+		return DefaultCheckpointInterval
+	}
+	return o.CheckpointInterval
+}
+
+// ScrubProblem describes a problem that Scrub found with an entry.
+type ScrubProblem struct {
+
+	// The entry
+	EntryId  int64  `json:"entryId"`
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"`
+
+	// One of the Problem constants
+	Kind string `json:"kind"`
+
+	// Further details such as an error message
+	Detail string `json:"detail,omitempty"`
+}
+
+// ScrubReport reports what Scrub found. ScrubReport marshals to JSON so
+// that monitoring can alert on it.
+type ScrubReport struct {
+	OwnerId  int64     `json:"ownerId"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// The id of the first entry scrubbed minus one
+	ResumedAfter int64 `json:"resumedAfter"`
+
+	// The id of the last entry scrubbed
+	LastId int64 `json:"lastId"`
+
+	// True if Scrub got through all the remaining entries
+	Complete bool `json:"complete"`
+
+	// The number of entries scrubbed
+	Scanned int `json:"scanned"`
+
+	// The number of bytes of plaintext read
+	ScannedBytes int64 `json:"scannedBytes"`
+
+	// The problems found
+	Problems []ScrubProblem `json:"problems"`
+}
+
+// Scrub audits the blobs on fileSystem that owner's entries in store
+// reference. For each entry that isn't marked deleted, in order of id,
+// Scrub reads the blob, recomputes its SHA-256 checksum, and compares it
+// and its size to the entry. Scrub reports problems rather than
+// returning them as errors. Scrub returns an error only if it can't read
+// store or save a checkpoint.
+func Scrub(
+	fileSystem FS,
+	store Store,
+	owner Owner,
+	options *ScrubOptions) (*ScrubReport, error) {
+	owner, err := owner.withKeys()
+	if err != nil {
+		return nil, err
+	}
+	return newScrubber(fileSystem, owner, options).scrub(store)
+}
+
+type scrubber struct {
+	aesFS   *aesFS
+	options *ScrubOptions
+	limiter *rateLimiter
+	report  *ScrubReport
+}
+
+func newScrubber(
+	fileSystem FS, owner Owner, options *ScrubOptions) *scrubber {
+	return &scrubber{
+		aesFS:   &aesFS{FileSystem: fileSystem, Owner: owner},
+		options: options,
+		limiter: newRateLimiter(options.bytesPerSecond()),
+		report:  &ScrubReport{OwnerId: owner.Id, Problems: []ScrubProblem{}},
+	}
+}
+
+func (s *scrubber) scrub(store Store) (*ScrubReport, error) {
+	s.report.Started = time.Now()
+	checkpoint := s.options.checkpoint()
+	var lastId int64
+	if checkpoint != nil {
+		var err error
+		lastId, err = checkpoint.Load()
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.report.ResumedAfter = lastId
+	s.report.LastId = lastId
+	complete, err := s.scrubAfter(store, lastId)
+	if err != nil {
+		return nil, err
+	}
+	s.report.Complete = complete
+	if checkpoint != nil {
+		next := s.report.LastId
+		if s.report.Complete {
+			next = 0
+		}
+		if err := checkpoint.Save(next); err != nil {
+			return nil, err
+		}
+	}
+	s.report.Finished = time.Now()
+	return s.report, nil
+}
+
+// scrubAfter scrubs the entries with ids greater than lastId. Rather than
+// reading all the entries up front, scrubAfter reads them from store a
+// batch at a time. scrubAfter returns true if it scrubbed all of them.
+func (s *scrubber) scrubAfter(store Store, lastId int64) (bool, error) {
+	maxEntries := s.options.maxEntries()
+	interval := s.options.checkpointInterval()
+	checkpoint := s.options.checkpoint()
+	after := &Entry{Id: lastId}
+	for {
+		var entries []Entry
+		var more bool
+		consumer := consume.Page(0, kScrubBatchSize, &entries, &more)
+		err := store.ListEntries(
+			nil, s.aesFS.Owner.Id, Order{}, after, consumer)
+		if err != nil {
+			return false, err
+		}
+		consumer.Finalize()
+		for i := range entries {
+			if maxEntries > 0 && s.report.Scanned == maxEntries {
+				return false, nil
+			}
+			s.scrubEntry(&entries[i])
+			s.report.Scanned++
+			s.report.LastId = entries[i].Id
+			if checkpoint != nil && s.report.Scanned%interval == 0 {
+				if err := checkpoint.Save(entries[i].Id); err != nil {
+					return false, err
+				}
+			}
+		}
+		if !more {
+			return true, nil
+		}
+		after = &entries[len(entries)-1]
+	}
+}
+
+func (s *scrubber) scrubEntry(entry *Entry) {
+	if _, err := hex.DecodeString(entry.Checksum); err != nil ||
+		len(entry.Checksum) != 64 {
+		s.report.Problems = append(
+			s.report.Problems,
+			newProblem(entry, ProblemInvalidEntry, "invalid checksum"))
+		return
+	}
+	reader, err := s.aesFS.Open(entry.Checksum)
+	if err != nil {
+		s.addProblem(entry, err)
+		return
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, s.limiter.reader(reader))
+	s.report.ScannedBytes += size
+	if err == ErrCorrupt && s.truncated(entry) {
+		s.report.Problems = append(
+			s.report.Problems,
+			newProblem(entry, ProblemTruncated, err.Error()))
+		return
+	}
+	if err != nil {
+		s.addProblem(entry, err)
+		return
+	}
+	if size < entry.Size {
+		s.report.Problems = append(
+			s.report.Problems, newProblem(entry, ProblemTruncated, ""))
+		return
+	}
+	if size > entry.Size ||
+		hex.EncodeToString(hash.Sum(nil)) != entry.Checksum {
+		s.report.Problems = append(
+			s.report.Problems, newProblem(entry, ProblemCorrupt, ""))
+	}
+}
+
+// truncated returns true if the blob of entry is in the GCM format and is
+// shorter than a complete blob holding entry.Size bytes. A GCM blob
+// missing its final chunk fails as corrupt, so truncated tells the two
+// apart.
+func (s *scrubber) truncated(entry *Entry) bool {
+	name, _, err := s.aesFS.resolve(entry.Checksum)
+	if err != nil {
+		return false
+	}
+	reader, err := s.aesFS.FileSystem.Open(name)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	header, _, err := readBlobHeader(reader)
+	if err != nil {
+		return false
+	}
+	fileInfo, err := Stat(s.aesFS.FileSystem, name)
+	if err != nil {
+		return false
+	}
+	return fileInfo.Size() < header.blobSize(entry.Size)
+}
+
+func (s *scrubber) addProblem(entry *Entry, err error) {
+	var kind string
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		kind = ProblemMissing
+	case err == ErrCorrupt:
+		kind = ProblemCorrupt
+	case err == ErrWrongKey:
+		kind = ProblemWrongKey
+	default:
+		kind = ProblemUnreadable
+	}
+	s.report.Problems = append(
+		s.report.Problems, newProblem(entry, kind, err.Error()))
+}
+
+func newProblem(entry *Entry, kind, detail string) ScrubProblem {
+	return ScrubProblem{
+		EntryId:  entry.Id,
+		Name:     entry.Name,
+		Checksum: entry.Checksum,
+		Kind:     kind,
+		Detail:   detail,
+	}
+}
+
+// rateLimiter limits the rate at which readers read.
+type rateLimiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	total          int64
+	now            func() time.Time
+	sleep          func(time.Duration)
+}
+
+// newRateLimiter returns a rateLimiter that allows bytesPerSecond bytes
+// per second on average. 0 means no limit.
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{
+		bytesPerSecond: bytesPerSecond,
+		now:            time.Now,
+		sleep:          time.Sleep,
+	}
+}
+
+// reader returns a reader that reads from r at the allowed rate.
+func (r *rateLimiter) reader(reader io.Reader) io.Reader {
+	if r.bytesPerSecond <= 0 {
+		return reader
+	}
+	return &limitedReader{reader: reader, limiter: r}
+}
+
+// wait waits until reading n more bytes keeps the average rate within
+// the limit.
+func (r *rateLimiter) wait(n int) {
+	if r.start.IsZero() {
+		r.start = r.now()
+	}
+	r.total += int64(n)
+	// Scale whole seconds and the remainder separately so that large
+	// totals don't overflow.
+	seconds := r.total / r.bytesPerSecond
+	remainder := r.total % r.bytesPerSecond
+	allowed := time.Duration(seconds)*time.Second + time.Duration(
+		float64(remainder)/float64(r.bytesPerSecond)*float64(time.Second))
+	if elapsed := r.now().Sub(r.start); elapsed < allowed {
+		r.sleep(allowed - elapsed)
+	}
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (l *limitedReader) Read(p []byte) (n int, err error) {
+	n, err = l.reader.Read(p)
+	l.limiter.wait(n)
+	return
+}
+
+type fileCheckpoint string
+
+func (f fileCheckpoint) Load() (int64, error) {
+	contents, err := os.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+}
+
+func (f fileCheckpoint) Save(lastId int64) error {
+	path := string(f)
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(strconv.FormatInt(lastId, 10) + "\n")
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
@@ -0,0 +1,271 @@
+package attachments
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/keep94/toolbox/kdf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrub(t *testing.T) {
+	fileSystem := NewInMemoryFS()
+	store := NewInMemoryStore()
+	owner := Owner{Id: 1, Key: kdf.Random(32)}
+	immutableFs := NewImmutableFS(fileSystem, store, owner)
+	_, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	corruptId, err := immutableFs.Write(
+		"corrupt.txt", ([]byte)("Goodbye World!"))
+	require.NoError(t, err)
+	name := idToPath(checksumOf("Goodbye World!"), 1)
+	contents := readBytes(fileSystem, name)
+	contents[len(contents)-1] ^= 1
+	writeBytes(t, fileSystem, name, contents)
+	missing := Entry{
+		Name: "missing.txt", Size: 7, OwnerId: 1, Checksum: checksumOf("Missing")}
+	require.NoError(t, store.AddEntry(nil, &missing))
+	truncated := Entry{
+		Name:     "truncated.txt",
+		Size:     100,
+		OwnerId:  1,
+		Checksum: checksumOf("Hello World!")}
+	require.NoError(t, store.AddEntry(nil, &truncated))
+	invalid := Entry{Name: "invalid.txt", OwnerId: 1, Checksum: "xyz"}
+	require.NoError(t, store.AddEntry(nil, &invalid))
+	wrongKeyId, err := NewImmutableFS(
+		fileSystem, store, Owner{Id: 1, Key: kdf.Random(32)}).Write(
+		"wrongkey.txt", ([]byte)("Wrong key"))
+	require.NoError(t, err)
+
+	// Deleted entries aren't scrubbed
+	deletedId, err := immutableFs.Write("deleted.txt", ([]byte)("Deleted"))
+	require.NoError(t, err)
+	require.NoError(t, immutableFs.Delete(deletedId))
+
+	report, err := Scrub(fileSystem, store, owner, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), report.OwnerId)
+	assert.Equal(t, 6, report.Scanned)
+	assert.True(t, report.Complete)
+	assert.Equal(t, int64(0), report.ResumedAfter)
+	assert.Equal(t, wrongKeyId, report.LastId)
+	assert.Equal(
+		t,
+		[]string{
+			ProblemCorrupt,
+			ProblemMissing,
+			ProblemTruncated,
+			ProblemInvalidEntry,
+			ProblemWrongKey,
+		},
+		problemKinds(report))
+	assert.Equal(t, corruptId, report.Problems[0].EntryId)
+	assert.Equal(t, "corrupt.txt", report.Problems[0].Name)
+	assert.Equal(t, missing.Id, report.Problems[1].EntryId)
+	assert.Equal(t, checksumOf("Missing"), report.Problems[1].Checksum)
+	assert.Equal(t, truncated.Id, report.Problems[2].EntryId)
+	assert.Equal(t, invalid.Id, report.Problems[3].EntryId)
+	assert.Equal(t, "invalid checksum", report.Problems[3].Detail)
+	assert.Equal(t, wrongKeyId, report.Problems[4].EntryId)
+
+	// The report is machine readable
+	encoded, err := json.Marshal(report)
+	require.NoError(t, err)
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, float64(6), decoded["scanned"])
+	assert.Equal(t, true, decoded["complete"])
+	problems := decoded["problems"].([]interface{})
+	require.Len(t, problems, 5)
+	assert.Equal(t, "corrupt", problems[0].(map[string]interface{})["kind"])
+}
+
+func TestScrub_Healthy(t *testing.T) {
+	fileSystem := NewInMemoryFS()
+	store := NewInMemoryStore()
+	owner := Owner{Id: 1}
+	immutableFs := NewImmutableFS(fileSystem, store, owner)
+	_, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	report, err := Scrub(fileSystem, store, owner, &ScrubOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Scanned)
+	assert.Equal(t, int64(12), report.ScannedBytes)
+	assert.Empty(t, report.Problems)
+
+	// Problems encodes as an empty list rather than null
+	encoded, err := json.Marshal(report)
+	require.NoError(t, err)
+	assert.Contains(t, string(encoded), `"problems":[]`)
+}
+
+func TestScrub_Resume(t *testing.T) {
+	fileSystem := NewInMemoryFS()
+	store := NewInMemoryStore()
+	owner := Owner{Id: 1, Key: kdf.Random(32)}
+	immutableFs := NewImmutableFS(fileSystem, store, owner)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt"} {
+		_, err := immutableFs.Write(name, ([]byte)(name))
+		require.NoError(t, err)
+	}
+	checkpoint := NewFileCheckpoint(
+		filepath.Join(t.TempDir(), "checkpoint"))
+	options := &ScrubOptions{
+		MaxEntries: 2, Checkpoint: checkpoint, CheckpointInterval: 1}
+
+	report, err := Scrub(fileSystem, store, owner, options)
+	require.NoError(t, err)
+	assert.False(t, report.Complete)
+	assert.Equal(t, 2, report.Scanned)
+	assert.Equal(t, int64(2), report.LastId)
+	lastId, err := checkpoint.Load()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), lastId)
+
+	report, err = Scrub(fileSystem, store, owner, options)
+	require.NoError(t, err)
+	assert.False(t, report.Complete)
+	assert.Equal(t, int64(2), report.ResumedAfter)
+	assert.Equal(t, int64(4), report.LastId)
+
+	// Finishing resets the checkpoint
+	report, err = Scrub(fileSystem, store, owner, options)
+	require.NoError(t, err)
+	assert.True(t, report.Complete)
+	assert.Equal(t, 1, report.Scanned)
+	assert.Equal(t, int64(5), report.LastId)
+	lastId, err = checkpoint.Load()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), lastId)
+
+	report, err = Scrub(fileSystem, store, owner, options)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), report.ResumedAfter)
+	assert.Equal(t, int64(2), report.LastId)
+}
+
+func TestScrub_TruncatedGCM(t *testing.T) {
+	fileSystem := NewInMemoryFS()
+	store := NewInMemoryStore()
+	owner := Owner{Id: 1, Key: kdf.Random(32)}
+	immutableFs := NewImmutableFS(fileSystem, store, owner)
+	var ids []int64
+	for _, size := range []int{kChunkSize + 100, kChunkSize + 200, 300} {
+		id, err := immutableFs.Write(
+			fmt.Sprintf("%d.bin", size), pseudoRandomBytes(size))
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	truncate := func(size, by int) {
+		name := idToPath(checksumOf(string(pseudoRandomBytes(size))), 1)
+		contents := readBytes(fileSystem, name)
+		writeBytes(t, fileSystem, name, contents[:len(contents)-by])
+	}
+
+	// Missing the whole final chunk
+	truncate(kChunkSize+100, 100+kTagSize)
+
+	// Missing part of the final chunk
+	truncate(kChunkSize+200, 50)
+
+	// Tampered, not truncated
+	name := idToPath(checksumOf(string(pseudoRandomBytes(300))), 1)
+	contents := readBytes(fileSystem, name)
+	contents[len(contents)-1] ^= 1
+	writeBytes(t, fileSystem, name, contents)
+
+	report, err := Scrub(fileSystem, store, owner, nil)
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		[]string{ProblemTruncated, ProblemTruncated, ProblemCorrupt},
+		problemKinds(report))
+	for i, id := range ids {
+		assert.Equal(t, id, report.Problems[i].EntryId)
+	}
+}
+
+func TestScrub_ManyEntries(t *testing.T) {
+	fileSystem := NewInMemoryFS()
+	store := NewInMemoryStore()
+	owner := Owner{Id: 1}
+	immutableFs := NewImmutableFS(fileSystem, store, owner)
+	for i := 0; i < 2*kScrubBatchSize+10; i++ {
+		_, err := immutableFs.Write("a.txt", ([]byte)(strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+	report, err := Scrub(
+		fileSystem, store, owner, &ScrubOptions{MaxEntries: kScrubBatchSize})
+	require.NoError(t, err)
+	assert.False(t, report.Complete)
+	assert.Equal(t, kScrubBatchSize, report.Scanned)
+	assert.Equal(t, int64(kScrubBatchSize), report.LastId)
+
+	report, err = Scrub(fileSystem, store, owner, nil)
+	require.NoError(t, err)
+	assert.True(t, report.Complete)
+	assert.Equal(t, 2*kScrubBatchSize+10, report.Scanned)
+	assert.Empty(t, report.Problems)
+}
+
+func TestScrub_DBError(t *testing.T) {
+	_, err := Scrub(NewInMemoryFS(), errorStore{}, Owner{Id: 1}, nil)
+	assert.Equal(t, errDatabase, err)
+}
+
+func TestFileCheckpoint(t *testing.T) {
+	checkpoint := NewFileCheckpoint(filepath.Join(t.TempDir(), "checkpoint"))
+	lastId, err := checkpoint.Load()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), lastId)
+	require.NoError(t, checkpoint.Save(42))
+	lastId, err = checkpoint.Load()
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), lastId)
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	var slept time.Duration
+	limiter := newRateLimiter(100)
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	limiter.wait(50)
+	assert.Equal(t, 500*time.Millisecond, slept)
+	now = now.Add(time.Second)
+	limiter.wait(50)
+	assert.Equal(t, 500*time.Millisecond, slept)
+
+	// Limiter allows the average rate, not the instantaneous rate
+	limiter.wait(200)
+	assert.Equal(t, 2*time.Second, slept)
+
+	// Large totals don't overflow
+	slept = 0
+	limiter = newRateLimiter(1 << 20)
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	limiter.wait(10 << 30)
+	limiter.wait(1 << 19)
+	assert.Equal(t, 10240*time.Second+500*time.Millisecond, slept)
+}
+
+func problemKinds(report *ScrubReport) []string {
+	var result []string
+	for _, problem := range report.Problems {
+		result = append(result, problem.Kind)
+	}
+	return result
+}
@@ -0,0 +1,116 @@
+package attachments
+
+import (
+	"archive/zip"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Names older entries may have that can't be used as is in a ZIP
+	// archive are stored with their bad characters replaced.
+	zipNamePolicy = &NamePolicy{Replacement: "_"}
+)
+
+// WriteZip writes the files in fileSystem with given ids to w as a ZIP
+// archive. ids works the same way as in ImmutableFS.List, so WriteZip
+// skips ids with no file. Each file in the archive has the name and
+// timestamp of its Entry. Files go in the archive ordered by id. When
+// names collide, ignoring case, the file with the lowest id keeps its
+// name, and the others get a number before the extension e.g
+// "report (2).pdf". WriteZip streams each file into the archive, so it
+// uses a bounded amount of memory per file no matter how large the
+// files are. If WriteZip returns an error, w may hold part of an archive.
+// WriteZip returns ErrIntegrity if the contents of a file don't match its
+// checksum.
+func WriteZip(
+	w io.Writer, fileSystem ImmutableFS, ids map[int64]bool) error {
+	entries, err := fileSystem.List(nil, ids)
+	if err != nil {
+		return err
+	}
+	names := zipNames(entries)
+	zipWriter := zip.NewWriter(w)
+	for i, entry := range entries {
+		if err := writeZipEntry(
+			zipWriter, fileSystem, entry, names[i]); err != nil {
+			return err
+		}
+	}
+	return zipWriter.Close()
+}
+
+func writeZipEntry(
+	zipWriter *zip.Writer,
+	fileSystem ImmutableFS,
+	entry *Entry,
+	name string) error {
+	file, err := fileSystem.Open(entry.Path())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer, err := zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Unix(entry.Ts, 0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+// zipNames returns the name in the archive for each entry in entries.
+// zipNames expects entries to be ordered by id.
+func zipNames(entries []*Entry) []string {
+	result := make([]string, len(entries))
+	taken := make(map[string]bool, len(entries))
+	for i, entry := range entries {
+		result[i] = zipName(entry)
+		taken[strings.ToLower(result[i])] = true
+	}
+	kept := make(map[string]bool, len(entries))
+	for i, name := range result {
+		key := strings.ToLower(name)
+		if !kept[key] {
+			kept[key] = true
+			continue
+		}
+		for n := 2; ; n++ {
+			candidate := numberedName(name, n)
+			key := strings.ToLower(candidate)
+			if !taken[key] {
+				taken[key] = true
+				result[i] = candidate
+				break
+			}
+		}
+	}
+	return result
+}
+
+// zipName returns the name of entry made safe for a ZIP archive. If
+// there is no safe version of the name, zipName returns the entry's Id.
+func zipName(entry *Entry) string {
+	name, err := zipNamePolicy.Normalize(entry.Name)
+	if err != nil {
+		return strconv.FormatInt(entry.Id, 10)
+	}
+	return name
+}
+
+// numberedName returns name with n before its extension e.g
+// numberedName("report.pdf", 2) = "report (2).pdf".
+func numberedName(name string, n int) string {
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	return base + " (" + strconv.Itoa(n) + ")" + ext
+}
@@ -0,0 +1,123 @@
+package attachments
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/keep94/toolbox/kdf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteZip(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	store := NewInMemoryStore()
+	immutableFs := NewImmutableFS(
+		fakeFs, store, Owner{Id: 1, Key: kdf.Random(32)})
+	write := func(name, contents string) int64 {
+		id, err := immutableFs.Write(name, ([]byte)(contents))
+		require.NoError(t, err)
+		return id
+	}
+	reportId := write("report.pdf", "Report")
+	write("skipped.txt", "Skipped")
+	dupId := write("Report.pdf", "Another report")
+	numberedId := write("report (2).pdf", "Numbered")
+	bigContents := pseudoRandomBytes(2*kChunkSize + 100)
+	bigId, err := immutableFs.Write("big.bin", bigContents)
+	require.NoError(t, err)
+	deletedId := write("deleted.txt", "Deleted")
+	require.NoError(t, immutableFs.Delete(deletedId))
+
+	var buffer bytes.Buffer
+	require.NoError(t, WriteZip(&buffer, immutableFs, map[int64]bool{
+		reportId:   true,
+		dupId:      true,
+		numberedId: true,
+		bigId:      true,
+		deletedId:  true,
+		999:        true,
+	}))
+	files := readZip(t, buffer.Bytes())
+	require.Len(t, files, 4)
+	assert.Equal(t, "report.pdf", files[0].Name)
+	assert.Equal(t, "Report", readZipFile(t, files[0]))
+	assert.Equal(t, "Report (3).pdf", files[1].Name)
+	assert.Equal(t, "Another report", readZipFile(t, files[1]))
+	assert.Equal(t, "report (2).pdf", files[2].Name)
+	assert.Equal(t, "Numbered", readZipFile(t, files[2]))
+	assert.Equal(t, "big.bin", files[3].Name)
+	assert.Equal(t, string(bigContents), readZipFile(t, files[3]))
+
+	entries, err := immutableFs.List(nil, map[int64]bool{reportId: true})
+	require.NoError(t, err)
+	assert.True(
+		t, time.Unix(entries[0].Ts, 0).Equal(files[0].Modified))
+
+	// Empty archive
+	buffer.Reset()
+	require.NoError(t, WriteZip(&buffer, immutableFs, nil))
+	assert.Empty(t, readZip(t, buffer.Bytes()))
+}
+
+func TestWriteZip_Integrity(t *testing.T) {
+	fakeFs := NewInMemoryFS()
+	immutableFs := NewImmutableFS(fakeFs, NewInMemoryStore(), Owner{Id: 1})
+	id, err := immutableFs.Write("hello.txt", ([]byte)("Hello World!"))
+	require.NoError(t, err)
+	writeString(
+		t, fakeFs, idToPath(checksumOf("Hello World!"), 1), "Hello World?")
+	err = WriteZip(io.Discard, immutableFs, map[int64]bool{id: true})
+	assert.Equal(t, ErrIntegrity, err)
+}
+
+func TestZipNames(t *testing.T) {
+	entries := []*Entry{
+		{Id: 1, Name: "a.txt"},
+		{Id: 2, Name: "a.txt"},
+		{Id: 3, Name: "A.TXT"},
+		{Id: 4, Name: "a (2).txt"},
+		{Id: 5, Name: ".bashrc"},
+		{Id: 6, Name: ".bashrc"},
+		{Id: 7, Name: "dir/file"},
+		{Id: 8, Name: ".."},
+		{Id: 9, Name: "noext"},
+		{Id: 10, Name: "noext"},
+	}
+	assert.Equal(
+		t,
+		[]string{
+			"a.txt",
+			"a (3).txt",
+			"A (4).TXT",
+			"a (2).txt",
+			".bashrc",
+			".bashrc (2)",
+			"dir_file",
+			"8",
+			"noext",
+			"noext (2)",
+		},
+		zipNames(entries))
+}
+
+func readZip(t *testing.T, contents []byte) []*zip.File {
+	t.Helper()
+	reader, err := zip.NewReader(
+		bytes.NewReader(contents), int64(len(contents)))
+	require.NoError(t, err)
+	return reader.File
+}
+
+func readZipFile(t *testing.T, file *zip.File) string {
+	t.Helper()
+	reader, err := file.Open()
+	require.NoError(t, err)
+	defer reader.Close()
+	contents, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(contents)
+}